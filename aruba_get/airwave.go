@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,9 +30,22 @@ type Airwave struct {
 	//用户密码
 	Password string `json:"password"`
 	//ap目录ID
-	ApFolderID int `json:"ap_folder_id"`
+	ApFolderID int `json:"ap_folder_id,omitempty"`
+	//多个ap目录ID，配置后不再使用ap_folder_id
+	ApFolderIDs []int `json:"ap_folder_ids,omitempty"`
+	//不为空时作为路由器的Area，否则使用ap目录名称
+	Label string `json:"label,omitempty"`
 
 	records []*Record
+	session *Session
+}
+
+//需要获取的ap目录
+func (aw *Airwave) folders() []int {
+	if len(aw.ApFolderIDs) > 0 {
+		return aw.ApFolderIDs
+	}
+	return []int{aw.ApFolderID}
 }
 
 type ApList struct {
@@ -40,6 +59,63 @@ type Record struct {
 	ControllerID     *ControllerID     `json:"controller_id"`
 	ICMPAddress      *ICMPAddress      `json:"icmp_address"`
 	MonitoringStatus *MonitoringStatus `json:"monitoring_status"`
+
+	//ap资产信息
+	SerialNumber *Field `json:"serial_number"`
+	Firmware     *Field `json:"firmware"`
+	LanMAC       *Field `json:"lan_mac"`
+	//运行时间，单位秒
+	Uptime *Field `json:"uptime"`
+	//最后联系时间，unix时间戳
+	LastContacted *Field `json:"last_contacted"`
+	ClientCount   *Field `json:"client_count"`
+}
+
+//value可能是字符串、数字或null的字段
+type Field struct {
+	Value Value `json:"value"`
+}
+
+type Value string
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var i interface{}
+	if err := json.Unmarshal(b, &i); err != nil {
+		return err
+	}
+	switch x := i.(type) {
+	case nil:
+		*v = ""
+	case string:
+		*v = Value(x)
+	case float64:
+		*v = Value(strconv.FormatFloat(x, 'f', -1, 64))
+	default:
+		*v = Value(fmt.Sprint(x))
+	}
+	return nil
+}
+
+func (f *Field) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.TrimSpace(string(f.Value))
+}
+
+func (f *Field) Int() int64 {
+	n, _ := strconv.ParseFloat(f.String(), 64)
+	return int64(n)
+}
+
+//unix时间戳转换为本地时间，不是数字时原样返回
+func (f *Field) Time() string {
+	s := f.String()
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return s
+	}
+	return time.Unix(n, 0).Format("2006-01-02 15:04:05")
 }
 
 //只需要value：Aruba RAP-3WN
@@ -93,92 +169,273 @@ func NewClient(timeout int) *http.Client {
 	return client
 }
 
-//获取登录cookie
-func (aw *Airwave) GetCookies(client *http.Client) (*http.Cookie, error) {
-	var _login = fmt.Sprintf("https://%s/LOGIN", aw.Addr)
+//登录airwave失败
+type LoginError struct {
+	Addr   string
+	Reason string
+	//网络错误，其他原因时为nil
+	Err error
+}
+
+func (e *LoginError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("airwave %s login failed: %s: %s", e.Addr, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("airwave %s login failed: %s", e.Addr, e.Reason)
+}
+
+//登录状态已经失效：跳转到/LOGIN或者返回了html
+var ErrSessionExpired = errors.New("airwave session expired")
+
+//airwave登录会话，cookie保存在client的cookie jar中，过期时自动重新登录
+type Session struct {
+	aw     *Airwave
+	client *http.Client
+
+	mu     sync.Mutex
+	logged bool
+}
+
+//复制client，不跟随跳转以便识别跳转到登录页面，没有cookie jar时创建一个
+func NewSession(aw *Airwave, client *http.Client) *Session {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if c.Jar == nil {
+		c.Jar, _ = cookiejar.New(nil)
+	}
+	return &Session{aw: aw, client: &c}
+}
+
+//登录airwave，成功时服务器设置cookie并跳转到destination
+func (s *Session) Login(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.login(ctx)
+}
+
+func (s *Session) login(ctx context.Context) error {
+	s.logged = false
+	var _login = fmt.Sprintf("https://%s/LOGIN", s.aw.Addr)
 	var value = url.Values{}
-	value.Set("credential_0", aw.User)
-	value.Set("credential_1", aw.Password)
+	value.Set("credential_0", s.aw.User)
+	value.Set("credential_1", s.aw.Password)
 	value.Set("login", "Log In")
 	value.Set("destination", "/")
 
-	res, err := client.PostForm(_login, value)
+	req, err := http.NewRequest("POST", _login, strings.NewReader(value.Encode()))
 	if err != nil {
-		if urlErr, ok := err.(*url.Error); ok && urlErr.Err != skipRedirect {
-			return nil, errors.New(fmt.Sprintf("when get cookie: %s", err))
-		}
+		return &LoginError{Addr: s.aw.Addr, Reason: "create request", Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &LoginError{Addr: s.aw.Addr, Reason: "request", Err: err}
 	}
-	cookie := strings.SplitN(res.Header.Get("Set-Cookie"), "; ", 2)
-	if len(cookie[0]) <= 0 {
-		return nil, errors.New("get cookie length is zero")
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 400:
+		return &LoginError{Addr: s.aw.Addr, Reason: res.Status}
+	case isLoginRedirect(res):
+		return &LoginError{Addr: s.aw.Addr, Reason: "invalid user or password"}
+	case len(res.Cookies()) == 0:
+		//用户名或密码错误时返回登录页面，不设置cookie
+		return &LoginError{Addr: s.aw.Addr, Reason: "no session cookie, check user and password"}
 	}
+	s.logged = true
+	return nil
+}
 
-	kv := strings.Split(cookie[0], "=")
-	if len(kv) < 2 {
-		return nil, errors.New("cookie key or value invalid")
+//跳转到登录页面
+func isLoginRedirect(res *http.Response) bool {
+	if res.StatusCode < 300 || res.StatusCode >= 400 {
+		return false
 	}
+	return strings.Contains(strings.ToUpper(res.Header.Get("Location")), "/LOGIN")
+}
 
-	//fmt.Printf("%v\n", kv)
-	res.Body.Close()
-	return &http.Cookie{Name: kv[0], Value: kv[1]}, nil
+//GET airwave的json接口，需要时登录，登录过期时重新登录并重试一次
+func (s *Session) GetJSON(ctx context.Context, path string, v interface{}) error {
+	return s.get(ctx, path, func(bs []byte) error {
+		//应该返回json的地方返回了html，一般是登录页面
+		if b := bytes.TrimSpace(bs); len(b) > 0 && b[0] == '<' {
+			return ErrSessionExpired
+		}
+		if err := json.Unmarshal(bs, v); err != nil {
+			return errors.New(fmt.Sprintf("when Unmarshal airwave: %s", err))
+		}
+		return nil
+	})
 }
 
-//获取*Airwave，包含record切片，获取各个AP的wan ip, cookie是认证时服务器返回的
-func (aw *Airwave) GetRaps(client *http.Client, cookie *http.Cookie) error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/list_view.json?list=ap_list&fv_id=0&ap_folder_id=%d&expand_all=1", aw.Addr, aw.ApFolderID), nil)
+//GET airwave的xml接口(AMP API)，登录处理与GetJSON相同
+func (s *Session) GetXML(ctx context.Context, path string, v interface{}) error {
+	return s.get(ctx, path, func(bs []byte) error {
+		if isHTML(bs) {
+			return ErrSessionExpired
+		}
+		if err := xml.Unmarshal(bs, v); err != nil {
+			return errors.New(fmt.Sprintf("when Unmarshal airwave xml: %s", err))
+		}
+		return nil
+	})
+}
+
+func (s *Session) get(ctx context.Context, path string, decode func([]byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.logged {
+		if err := s.login(ctx); err != nil {
+			return err
+		}
+	}
+	err := s.fetch(ctx, path, decode)
+	if err == ErrSessionExpired {
+		if err = s.login(ctx); err != nil {
+			return err
+		}
+		err = s.fetch(ctx, path, decode)
+	}
+	return err
+}
+
+func (s *Session) fetch(ctx context.Context, path string, decode func([]byte) error) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s", s.aw.Addr, path), nil)
 	if err != nil {
 		return err
 	}
-	req.Header["host"] = []string{aw.Addr}
-	req.Header["Referer"] = []string{fmt.Sprintf("https://%s/index.html", aw.Addr)}
-
-	req.AddCookie(cookie)
-	res, err := client.Do(req)
+	req.Header["Referer"] = []string{fmt.Sprintf("https://%s/index.html", s.aw.Addr)}
+	res, err := s.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
-
 	bs, err := ioutil.ReadAll(res.Body)
 	defer res.Body.Close()
 	if err != nil {
 		return err
 	}
 
-	//fmt.Printf("%s\n", bs)
-	var list ApList
-	if err = json.Unmarshal(bs, &list); err != nil {
-		return errors.New(fmt.Sprintf("when Unmarshal airwave: %s", err))
+	switch {
+	case isLoginRedirect(res), res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		s.logged = false
+		return ErrSessionExpired
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("airwave %s%s: %s", s.aw.Addr, path, res.Status)
 	}
-	aw.records = list.Records
-	return nil
+	if err = decode(bs); err == ErrSessionExpired {
+		s.logged = false
+	}
+	return err
 }
 
-//根据controller_id的value值非空获取rap参数
-func (aw *Airwave) GetRouters(client *http.Client) ([]*Router, error) {
-	var cookie, err = aw.GetCookies(client)
+//html页面，一般是登录页面
+func isHTML(bs []byte) bool {
+	b := bytes.ToLower(bytes.TrimSpace(bs))
+	return bytes.HasPrefix(b, []byte("<!doctype html")) || bytes.HasPrefix(b, []byte("<html"))
+}
+
+//获取ap目录folder中的record，获取各个AP的wan ip
+func (aw *Airwave) GetRaps(ctx context.Context, s *Session, folder int) ([]*Record, error) {
+	var list ApList
+	err := s.GetJSON(ctx, fmt.Sprintf("/api/list_view.json?list=ap_list&fv_id=0&ap_folder_id=%d&expand_all=1", folder), &list)
 	if err != nil {
 		return nil, err
 	}
-	if err = aw.GetRaps(client, cookie); err != nil {
-		return nil, err
+	return list.Records, nil
+}
+
+//根据controller_id的value值非空获取rap参数，ctx取消时停止请求
+//第一次调用时登录，之后重复使用同一个会话
+func (aw *Airwave) GetRouters(ctx context.Context, client *http.Client) ([]*Router, error) {
+	if aw.session == nil {
+		aw.session = NewSession(aw, client)
+	}
+	aw.records = aw.records[:0]
+	for _, folder := range aw.folders() {
+		records, err := aw.GetRaps(ctx, aw.session, folder)
+		if _, ok := err.(*LoginError); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("ap folder %d: %s", folder, err)
+		}
+		aw.records = append(aw.records, records...)
 	}
+	return aw.routersOf(aw.records), nil
+}
+
+//把record转换为路由器，跳过controller_id为空的记录
+func (aw *Airwave) routersOf(records []*Record) []*Router {
 	var routers = make([]*Router, 0)
-	for i := 0; i < len(aw.records); i++ {
-		record := aw.records[i]
-		if record.ControllerID.Value == "" {
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if record.ControllerID == nil || record.ControllerID.Value == "" {
 			continue
 		}
 		var up bool = false
-		if record.MonitoringStatus.Value == "Up" {
+		if record.MonitoringStatus != nil && record.MonitoringStatus.Value == "Up" {
 			up = true
 		}
 		r := &Router{
-			Code:   strings.ToUpper(record.ControllerID.Value),
-			Area:   record.ApFolderID.Value,
-			Wanip:  record.ICMPAddress.Value,
-			status: up,
+			Code:    strings.ToUpper(record.ControllerID.Value),
+			status:  up,
+			airwave: aw,
 		}
+		if aw.Label != "" {
+			r.Area = aw.Label
+		} else if record.ApFolderID != nil {
+			r.Area = record.ApFolderID.Value
+		}
+		if record.ICMPAddress != nil {
+			r.Wanip = record.ICMPAddress.Value
+		}
+		if record.Type != nil {
+			r.Model = record.Type.Value
+		}
+		r.Serial = record.SerialNumber.String()
+		r.Firmware = record.Firmware.String()
+		r.LanMAC = strings.ToLower(record.LanMAC.String())
+		r.Uptime = record.Uptime.Int()
+		r.LastContact = record.LastContacted.Time()
+		r.APClients = int(record.ClientCount.Int())
 		routers = append(routers, r)
 	}
-	return routers, nil
+	return routers
+}
+
+//从所有airwave获取路由器，按controller id去重，同一个路由器以状态为Up的记录为准
+//一个airwave失败时继续获取其他的，complete为false表示结果不完整，全部失败时返回错误
+func FetchRouters(ctx context.Context, aws []*Airwave, client *http.Client, logger *log.Logger) (rs []*Router, complete bool, err error) {
+	var (
+		index  = make(map[string]int)
+		failed int
+	)
+	complete = true
+	for _, aw := range aws {
+		routers, err := aw.GetRouters(ctx, client)
+		if err != nil {
+			logger.Printf("get routers from airwave %s error: %s\n", aw.Addr, err)
+			airwaveErrors.WithLabelValues(aw.Addr).Inc()
+			complete = false
+			failed++
+			continue
+		}
+		logger.Printf("get routers from airwave %s: %d\n", aw.Addr, len(routers))
+		for _, r := range routers {
+			if i, ok := index[r.Code]; ok {
+				if !rs[i].status && r.status {
+					rs[i] = r
+				}
+				continue
+			}
+			index[r.Code] = len(rs)
+			rs = append(rs, r)
+		}
+	}
+	if failed == len(aws) {
+		return nil, false, errors.New("all airwave servers failed")
+	}
+	return rs, complete, nil
 }
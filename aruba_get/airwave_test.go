@@ -2,98 +2,178 @@ package main
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
-	"net/url"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
-var aw = &Airwave{
-	Addr:       "5.5.2.46",
-	User:       "J-Admin",
-	Password:   "SF@admin123",
-	ApFolderID: 32,
+//模拟airwave：登录成功时设置cookie，cookie无效时跳转到/LOGIN
+type fakeAirwave struct {
+	logins  int
+	session string
 }
 
-var (
-	mysqlHost     = "127.0.0.1"
-	mysqlPort     = "3306"
-	mysqlUser     = "root"
-	mysqlPassword = "123789"
-	mysqlDatabase = "aruba"
-)
+func (f *fakeAirwave) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/LOGIN":
+		r.ParseForm()
+		if r.PostFormValue("credential_0") != "admin" || r.PostFormValue("credential_1") != "secret" {
+			fmt.Fprint(w, "<html>login</html>")
+			return
+		}
+		f.logins++
+		f.session = fmt.Sprintf("s%d", f.logins)
+		http.SetCookie(w, &http.Cookie{Name: "AMPAuth", Value: f.session, Path: "/"})
+		http.Redirect(w, r, "/", http.StatusFound)
+	case "/api/list_view.json":
+		if c, err := r.Cookie("AMPAuth"); err != nil || c.Value != f.session {
+			http.Redirect(w, r, "/LOGIN", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, `{"records": [
+			{"controller_id": {"value": "a01"}, "icmp_address": {"value": "10.0.0.1"}, "monitoring_status": {"value": "Up"}},
+			{"controller_id": {"value": "a02"}},
+			{"type": {"value": "Aruba RAP-3WN"}}
+		]}`)
+	case "/ap_detail.xml":
+		if c, err := r.Cookie("AMPAuth"); err != nil || c.Value != f.session {
+			http.Redirect(w, r, "/LOGIN", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, ampDetailTest)
+	case "/client_detail.xml":
+		if c, err := r.Cookie("AMPAuth"); err != nil || c.Value != f.session {
+			http.Redirect(w, r, "/LOGIN", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, ampClientTest)
+	default:
+		http.NotFound(w, r)
+	}
+}
 
-func TestAw(t *testing.T) {
-	rs, err := aw.GetRouters()
-	if err != nil {
-		t.Fatalf("%s\n", err)
-		return
+func TestAirwaveSession(t *testing.T) {
+	fake := new(fakeAirwave)
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+
+	a := &Airwave{Addr: strings.TrimPrefix(srv.URL, "https://"), User: "admin", Password: "secret"}
+	client := NewClient(5)
+	for i := 0; i < 3; i++ {
+		rs, err := a.GetRouters(context.Background(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 2 || rs[0].Code != "A01" || !rs[0].status || rs[1].status {
+			t.Fatalf("routers = %#v", rs)
+		}
 	}
-	db := OpenMysql(mysqlHost, mysqlPort, mysqlUser, mysqlPassword, mysqlDatabase)
-	rss, err := Diff(db, rs)
-	if err != nil {
-		t.Fatalf("%s\n", err)
-		return
+	if fake.logins != 1 {
+		t.Errorf("logged in %d times, want 1", fake.logins)
 	}
-	for i := 0; i < len(rss); i++ {
-		t.Logf("%#v\n", rss[i])
+
+	//服务器端会话过期后重新登录一次
+	fake.session = "expired"
+	if _, err := a.GetRouters(context.Background(), client); err != nil {
+		t.Fatal(err)
 	}
-	if err = SyncRouters(db, rss); err != nil {
-		t.Fatalf("%s\n", err)
-		return
+	if fake.logins != 2 {
+		t.Errorf("logged in %d times after expiry, want 2", fake.logins)
 	}
 }
 
-func TestAWCookie(t *testing.T) {
-	c := NewClient(5)
-	ctx, cancel := context.WithCancel(context.Background())
-	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		cancel()
-		if len(via) > 0 {
-			return errors.New("02013bac")
-		}
-		return nil
-	}
+func TestAirwaveLoginError(t *testing.T) {
+	srv := httptest.NewTLSServer(new(fakeAirwave))
+	defer srv.Close()
 
-	var _login = fmt.Sprintf("https://%s/LOGIN", aw.Addr)
-	var value = url.Values{}
-	value.Set("credential_0", aw.User)
-	value.Set("credential_1", aw.Password)
-	value.Set("login", "Log In")
-	value.Set("destination", "/")
+	a := &Airwave{Addr: strings.TrimPrefix(srv.URL, "https://"), User: "admin", Password: "wrong"}
+	_, err := a.GetRouters(context.Background(), NewClient(5))
+	if _, ok := err.(*LoginError); !ok {
+		t.Fatalf("err = %#v, want *LoginError", err)
+	}
 
-	req, err := http.NewRequest("POST", _login, nil)
-	if err != nil {
-		t.Fatalf("%s\n", err)
+	//无法连接时也返回*LoginError而不是panic
+	a = &Airwave{Addr: "127.0.0.1:1", User: "admin", Password: "secret"}
+	_, err = a.GetRouters(context.Background(), NewClient(5))
+	if e, ok := err.(*LoginError); !ok || e.Err == nil {
+		t.Fatalf("err = %#v, want *LoginError with network error", err)
 	}
+}
 
-	req.Form = value
-	req.WithContext(ctx)
-	res, err := c.PostForm(_login, value)
+func TestFetchRouters(t *testing.T) {
+	north := httptest.NewTLSServer(new(fakeAirwave))
+	defer north.Close()
+	south := httptest.NewTLSServer(new(fakeAirwave))
+	defer south.Close()
+
+	client := NewClient(5)
+	logger := log.New(ioutil.Discard, "", 0)
+	var aws = []*Airwave{
+		{Addr: strings.TrimPrefix(north.URL, "https://"), User: "admin", Password: "secret", ApFolderIDs: []int{1, 2}, Label: "north"},
+		{Addr: strings.TrimPrefix(south.URL, "https://"), User: "admin", Password: "secret", Label: "south"},
+	}
+	rs, complete, err := FetchRouters(context.Background(), aws, client, logger)
 	if err != nil {
-		urlErr, ok := err.(*url.Error)
-		if !ok {
-			t.Fatalf("when get cookie: %s\n", err)
-		}
-		if urlErr.Err != context.Canceled {
-			t.Logf("%s, want:%s\n", urlErr.Err, context.Canceled)
-		}
-		t.Logf("%s\n", urlErr.Err)
+		t.Fatal(err)
 	}
-	t.Logf("%s\n", res.Request.URL)
-	cookie := strings.SplitN(res.Header.Get("Set-Cookie"), "; ", 2)
-	if len(cookie[0]) <= 0 {
-		t.Fatalf("get cookie length is zero")
+	//两个目录和两个服务器返回同样的controller id，只保留一个
+	if !complete || len(rs) != 2 {
+		t.Fatalf("complete = %v, %d routers, want 2", complete, len(rs))
+	}
+	if rs[0].Area != "north" {
+		t.Errorf("area = %q, want label north", rs[0].Area)
 	}
 
-	kv := strings.Split(cookie[0], "=")
-	if len(kv) < 2 {
-		t.Fatalf("cookie key or value invalid")
+	//一个airwave失败时返回其他airwave的结果
+	aws = append(aws, &Airwave{Addr: "127.0.0.1:1", User: "admin", Password: "secret"})
+	rs, complete, err = FetchRouters(context.Background(), aws, client, logger)
+	if err != nil || complete || len(rs) != 2 {
+		t.Errorf("with one failed airwave: %d routers, complete %v, err %v", len(rs), complete, err)
 	}
 
-	//fmt.Printf("%v\n", kv)
-	t.Logf("Name: %s, Values: %s\n", kv[0], kv[1])
+	if _, _, err = FetchRouters(context.Background(), aws[2:], client, logger); err == nil {
+		t.Error("all airwave failed but err is nil")
+	}
+}
 
+func TestRecordInventory(t *testing.T) {
+	var list ApList
+	err := json.Unmarshal([]byte(`{"records": [{
+		"controller_id": {"value": "b01"},
+		"type": {"value": "Aruba RAP-3WN"},
+		"serial_number": {"value": "AX0012345"},
+		"firmware": {"value": "6.4.4.8-4.2.4.5_57965"},
+		"lan_mac": {"value": "6C:F3:7F:00:00:01"},
+		"uptime": {"value": 86400},
+		"last_contacted": {"value": "1500000000"},
+		"client_count": {"value": 7}
+	}, {
+		"controller_id": {"value": "b02"},
+		"uptime": {"value": null},
+		"client_count": {"value": "3"}
+	}]}`), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := new(Airwave)
+	r := fake.routersOf(list.Records)[0]
+	if r.Model != "Aruba RAP-3WN" || r.Serial != "AX0012345" || r.Firmware != "6.4.4.8-4.2.4.5_57965" {
+		t.Errorf("inventory = %#v", r)
+	}
+	if r.LanMAC != "6c:f3:7f:00:00:01" || r.Uptime != 86400 || r.APClients != 7 {
+		t.Errorf("inventory = %#v", r)
+	}
+	if want := time.Unix(1500000000, 0).Format("2006-01-02 15:04:05"); r.LastContact != want {
+		t.Errorf("last contact = %q, want %q", r.LastContact, want)
+	}
+	r = fake.routersOf(list.Records)[1]
+	if r.Uptime != 0 || r.APClients != 3 || r.Model != "" {
+		t.Errorf("inventory = %#v", r)
+	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//采集客户端的方式
+const (
+	//登录每个RAP执行show clients wired
+	CollectorRap = "rap"
+	//从airwave的AMP API按目录获取所有客户端
+	CollectorAirwave = "airwave"
+)
+
+func (cfg *Config) checkCollector() error {
+	switch cfg.Collector {
+	case "", CollectorRap:
+		if cfg.Rap3 != nil {
+			return cfg.Rap3.checkAPI()
+		}
+		return nil
+	case CollectorAirwave:
+		//轮询按每个路由器的间隔执行，airwave按目录一次获取
+		if cfg.Poll != nil {
+			return errors.New("poll mode only supports the rap collector")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown collector %q, want rap or airwave", cfg.Collector)
+}
+
+//ap_detail.xml?ap_folder_id=32的结果，只用于把客户端连接的ap对应到路由器
+type AmpAPDetail struct {
+	APs []*AmpAP `xml:"ap"`
+}
+
+type AmpAP struct {
+	ID   string `xml:"id,attr"`
+	Name string `xml:"name"`
+	//instant ap所属虚拟控制器的设备id，虚拟控制器的名称即路由器code
+	ControllerID string `xml:"controller_id"`
+	LanMAC       string `xml:"lan_mac"`
+}
+
+//client_detail.xml?ap_folder_id=32的结果，包含目录中所有客户端
+type AmpClientDetail struct {
+	Clients []*AmpClient `xml:"client"`
+}
+
+type AmpClient struct {
+	MAC        string `xml:"mac,attr"`
+	DeviceType string `xml:"device_type"`
+	//客户端的连接记录，已经断开的连接有disconnect_time
+	Associations []*AmpAssociation `xml:"association"`
+}
+
+type AmpAssociation struct {
+	APID           string `xml:"ap_id"`
+	Username       string `xml:"username"`
+	IP             string `xml:"lan_ip"`
+	Role           string `xml:"role"`
+	SSID           string `xml:"ssid"`
+	SNR            int    `xml:"snr"`
+	AuthType       string `xml:"auth_type"`
+	DisconnectTime string `xml:"disconnect_time"`
+}
+
+//当前的连接，没有时返回nil
+func (c *AmpClient) current() *AmpAssociation {
+	for i := len(c.Associations) - 1; i >= 0; i-- {
+		if a := c.Associations[i]; a.DisconnectTime == "" {
+			return a
+		}
+	}
+	return nil
+}
+
+//获取airwave中所有目录的客户端，key为路由器code，wireless为false时只返回有线客户端
+func (aw *Airwave) GetClients(ctx context.Context, client *http.Client, wireless bool) (map[string][]*Client, error) {
+	if aw.session == nil {
+		aw.session = NewSession(aw, client)
+	}
+	var clients = make(map[string][]*Client)
+	for _, folder := range aw.folders() {
+		var (
+			aps AmpAPDetail
+			cd  AmpClientDetail
+		)
+		err := aw.session.GetXML(ctx, fmt.Sprintf("/ap_detail.xml?ap_folder_id=%d", folder), &aps)
+		if err == nil {
+			err = aw.session.GetXML(ctx, fmt.Sprintf("/client_detail.xml?ap_folder_id=%d", folder), &cd)
+		}
+		if _, ok := err.(*LoginError); ok {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("ap folder %d: %s", folder, err)
+		}
+		for code, cs := range aps.clients(&cd, wireless) {
+			clients[code] = append(clients[code], cs...)
+		}
+	}
+	return clients, nil
+}
+
+//按连接的ap所属的路由器code分组客户端，没有ssid的连接是有线客户端
+func (d *AmpAPDetail) clients(cd *AmpClientDetail, wireless bool) map[string][]*Client {
+	var aps = make(map[string]*AmpAP, len(d.APs))
+	for _, ap := range d.APs {
+		aps[ap.ID] = ap
+	}
+	var clients = make(map[string][]*Client)
+	for _, c := range cd.Clients {
+		a := c.current()
+		if a == nil {
+			continue
+		}
+		ap, ok := aps[a.APID]
+		if !ok {
+			continue
+		}
+		medium := MediumWired
+		if a.SSID != "" {
+			medium = MediumWireless
+		}
+		if medium == MediumWireless && !wireless {
+			continue
+		}
+		code := ap.Name
+		if vc, ok := aps[ap.ControllerID]; ok && vc.Name != "" {
+			code = vc.Name
+		}
+		code = strings.ToUpper(strings.TrimSpace(code))
+		clients[code] = append(clients[code], &Client{
+			Name:   a.Username,
+			IP:     a.IP,
+			MAC:    strings.ToLower(c.MAC),
+			OS:     c.DeviceType,
+			AP:     strings.ToLower(ap.LanMAC),
+			Role:   a.Role,
+			Medium: medium,
+			SSID:   a.SSID,
+			Signal: a.SNR,
+			Auth:   a.AuthType,
+		})
+	}
+	return clients
+}
+
+//从airwave获取所有路由器的客户端并保存，不需要连接RAP，状态不是Up的路由器也会保存
+//一个airwave失败时它的路由器都记为失败
+func (cfg *Config) CollectAirwave(ctx context.Context, client *http.Client, routers []*Router, logger *log.Logger) *Run {
+	run := NewRun("cron")
+	var byAirwave = make(map[*Airwave][]*Router)
+	for _, r := range routers {
+		byAirwave[r.airwave] = append(byAirwave[r.airwave], r)
+	}
+	for aw, rs := range byAirwave {
+		if aw == nil {
+			for _, r := range rs {
+				run.Add(skipped(r))
+			}
+			continue
+		}
+		start := time.Now()
+		clients, err := aw.GetClients(ctx, client, cfg.Rap3 != nil && cfg.Rap3.Wireless)
+		cfg.watchdog.Ping()
+		if err != nil {
+			logger.Printf("get clients from airwave %s error: %s\n", aw.Addr, err)
+			airwaveErrors.WithLabelValues(aw.Addr).Inc()
+		}
+		for _, r := range rs {
+			rr := &RouterRun{
+				Code:    r.Code,
+				Wanip:   r.Wanip,
+				Gateway: r.GateWay,
+				Start:   start,
+			}
+			if err == nil {
+				cs := clients[r.Code]
+				cfg.ouis.Enrich(cs)
+				cs = cfg.classifier.Classify(cs)
+				if e := cfg.store.InsertClients(r.Code, cs); e != nil {
+					logger.Printf("code %s insert data failed: %s\n", r.Code, e)
+					rr.Error = fmt.Sprintf("insert data failed: %s", e)
+				}
+				rr.Clients = len(cs)
+			} else {
+				rr.Error = err.Error()
+			}
+			rr.Duration = time.Since(start)
+			if rr.Error != "" {
+				rr.Status = RunFailed
+				rr.Clients = 0
+			} else {
+				rr.Status = RunOK
+			}
+			observeRouterRun(rr)
+			run.Add(rr)
+		}
+	}
+	run.Finish()
+	return run
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//虚拟控制器A01下有两个ap，A02没有客户端
+var ampDetailTest = `<?xml version="1.0" encoding="utf-8"?>
+<amp:amp_ap_detail version="1" xmlns:amp="http://www.airwave.com">
+  <ap id="10">
+    <name>a01</name>
+    <lan_mac>6C:F3:7F:00:00:10</lan_mac>
+  </ap>
+  <ap id="11">
+    <name>a01-ap2</name>
+    <controller_id>10</controller_id>
+    <lan_mac>6C:F3:7F:00:00:11</lan_mac>
+  </ap>
+  <ap id="20">
+    <name>a02</name>
+  </ap>
+</amp:amp_ap_detail>`
+
+//有线、无线、已经断开和其他目录的客户端
+var ampClientTest = `<?xml version="1.0" encoding="utf-8"?>
+<amp:amp_client_detail version="1" xmlns:amp="http://www.airwave.com">
+  <client mac="00:11:22:33:44:55">
+    <device_type>Windows</device_type>
+    <association>
+      <ap_id>10</ap_id>
+      <username>alice</username>
+      <lan_ip>10.62.15.11</lan_ip>
+      <role>Mac-Auth</role>
+    </association>
+  </client>
+  <client mac="00:11:22:33:44:66">
+    <association>
+      <ap_id>10</ap_id>
+      <lan_ip>10.62.15.12</lan_ip>
+      <ssid>staff</ssid>
+      <snr>45</snr>
+    </association>
+  </client>
+  <client mac="00:11:22:33:44:77">
+    <association>
+      <ap_id>10</ap_id>
+      <lan_ip>10.62.15.20</lan_ip>
+      <disconnect_time>1489561200</disconnect_time>
+    </association>
+    <association>
+      <ap_id>11</ap_id>
+      <lan_ip>10.62.15.13</lan_ip>
+    </association>
+  </client>
+  <client mac="00:11:22:33:44:88">
+    <association>
+      <ap_id>10</ap_id>
+      <lan_ip>10.62.15.14</lan_ip>
+      <disconnect_time>1489561200</disconnect_time>
+    </association>
+  </client>
+  <client mac="00:11:22:33:44:99">
+    <association>
+      <ap_id>99</ap_id>
+      <lan_ip>10.62.15.15</lan_ip>
+    </association>
+  </client>
+</amp:amp_client_detail>`
+
+func TestAmpClients(t *testing.T) {
+	var (
+		aps AmpAPDetail
+		cd  AmpClientDetail
+	)
+	if err := xml.Unmarshal([]byte(ampDetailTest), &aps); err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal([]byte(ampClientTest), &cd); err != nil {
+		t.Fatal(err)
+	}
+	clients := aps.clients(&cd, false)
+	cs := clients["A01"]
+	if len(clients) != 1 || len(cs) != 2 {
+		t.Fatalf("wired clients = %v, want 2 of A01", clients)
+	}
+	if cs[0].Name != "alice" || cs[0].IP != "10.62.15.11" || cs[0].AP != "6c:f3:7f:00:00:10" || cs[0].OS != "Windows" || cs[0].Medium != MediumWired {
+		t.Errorf("client = %#v", cs[0])
+	}
+	//当前连接在第二个ap，属于虚拟控制器A01
+	if cs[1].MAC != "00:11:22:33:44:77" || cs[1].IP != "10.62.15.13" || cs[1].AP != "6c:f3:7f:00:00:11" {
+		t.Errorf("client = %#v", cs[1])
+	}
+
+	cs = aps.clients(&cd, true)["A01"]
+	if len(cs) != 3 || cs[1].Medium != MediumWireless || cs[1].SSID != "staff" || cs[1].Signal != 45 {
+		t.Errorf("clients with wireless = %v", cs)
+	}
+}
+
+func TestCollectAirwave(t *testing.T) {
+	srv := httptest.NewTLSServer(new(fakeAirwave))
+	defer srv.Close()
+
+	cfg := &Config{
+		Collector: CollectorAirwave,
+		Airwaves: []*Airwave{
+			{Addr: strings.TrimPrefix(srv.URL, "https://"), User: "admin", Password: "secret", ApFolderIDs: []int{1}},
+			{Addr: "127.0.0.1:1", User: "admin", Password: "secret"},
+		},
+		store: dbTest,
+	}
+	client := NewClient(5)
+	logger := log.New(ioutil.Discard, "", 0)
+	rs, _, err := FetchRouters(context.Background(), cfg.airwaves(), client, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//其他airwave上的路由器
+	rs = append(rs, &Router{Code: "C01", airwave: cfg.Airwaves[1]})
+
+	run := cfg.CollectAirwave(context.Background(), client, rs, logger)
+	want := RunSummary{Total: 3, Succeeded: 2, Failed: 1}
+	if run.RunSummary != want {
+		t.Errorf("summary = %+v, want %+v", run.RunSummary, want)
+	}
+
+	now := time.Now()
+	cs, err := dbTest.SelectClientsByTime("A01", now.Format("2006-01-02"), now.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 {
+		t.Errorf("A01 has %d sightings, want 2", len(cs))
+	}
+}
+
+func TestCheckCollector(t *testing.T) {
+	var cases = []struct {
+		cfg *Config
+		ok  bool
+	}{
+		{&Config{}, true},
+		{&Config{Collector: "rap", Poll: &Poll{}}, true},
+		{&Config{Collector: "airwave"}, true},
+		{&Config{Collector: "airwave", Poll: &Poll{}}, false},
+		{&Config{Collector: "snmp"}, false},
+	}
+	for _, c := range cases {
+		if err := c.cfg.checkCollector(); (err == nil) != c.ok {
+			t.Errorf("collector %q poll %v: err = %v", c.cfg.Collector, c.cfg.Poll != nil, err)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	//"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
 )
 
@@ -19,20 +21,35 @@ type Client struct {
 	Network string
 	AP      string
 	Role    string
+	//wired或wireless
+	Medium string
+
+	//无线客户端的信息，有线客户端为空
+	SSID    string
+	Band    string
+	Channel string
+	//信噪比，单位dB
+	Signal int
+	//速率，单位mbps
+	Speed int
+	Auth  string
+	//设备类型，由classify规则确定，没有匹配的规则时为空
+	Class string
+	//oui对应的厂商，随机mac没有厂商
+	Vendor string
+	//本地管理的随机mac
+	Random bool
 }
 
+const (
+	MediumWired    = "wired"
+	MediumWireless = "wireless"
+)
+
 func (c Client) String() string {
 	return fmt.Sprintf("Name:%s, IP:%s, MAC:%s, OS:%s, Role:%s", c.Name, c.IP, c.MAC, c.OS, c.Role)
 }
 
-/*
-	Regexp used to split column
-	(Name)\s{2}(IP Address)\s{2}(Mac Address)\s{2}(OS)\s{2}(Network)\s+(Access Point)\s{2}(Role)\s{2}.*
-	Name  IP Address   MAC Address        OS      Network  Access Point       Role           Speed (mbps)
-	----  ----------   -----------        --      -------  ------------       ----           ------------
-*/
-var re = regexp.MustCompile(`(.+)\s{2}([.0-9]+)\s{2,}([:a-zA-Z0-9]+)\s{2}(.+)\s{2}(eth[012])\s+([:a-zA-Z0-9]+)\s{2}(.+)\s{2}.*`)
-
 // SSID's Data contain authentication key
 type SSID struct {
 	Name string `xml:"name,attr"`
@@ -75,50 +92,83 @@ type Rap3 struct {
 	User   string `json:"user"`
 	Passwd string `json:"passwd"`
 	Cmd    string `json:"cmd"`
-	//特殊MAC地址，查询同一厂商的设备，用于识别rap没有识别的电脑
+	//特殊MAC地址，同一厂商的设备分类为pc，用于识别rap没有识别的电脑
 	IncludeMac []string `json:"include_mac"`
-	OnlyPC     bool     `json:"only_pc"`
+	//只保存分类为pc的客户端，其他类型和没有分类的客户端都去掉；ip为0.0.0.0时只保存Windows客户端
+	OnlyPC bool `json:"only_pc"`
+	//同时执行wireless_cmd获取无线客户端，wireless_cmd默认为show clients
+	Wireless    bool   `json:"wireless"`
+	WirelessCmd string `json:"wireless_cmd"`
+	//执行命令的方式：auto(默认)、rest、cgi或者ssh
+	API string `json:"api,omitempty"`
+	//swarm.cgi和REST API的端口，默认为4343
+	Port int `json:"port,omitempty"`
+	//ssh登录的配置，用于关闭了web管理的路由器
+	SSH *SSHConfig `json:"ssh,omitempty"`
+}
+
+const (
+	defaultWirelessCmd = `%27show%20clients%27`
+	defaultRapPort     = 4343
+)
+
+func (rap Rap3) port() int {
+	if rap.Port > 0 {
+		return rap.Port
+	}
+	return defaultRapPort
 }
 
 // create new url
 func (rap Rap3) NewRequestURL(op, ip, sid string) (string, error) {
-	p := fmt.Sprintf("https://%s:4343/%s", ip, rap.Path)
+	p := fmt.Sprintf("https://%s:%d/%s", ip, rap.port(), rap.Path)
 	var u string
 	switch op {
 	//opcode = login
 	case "login":
 		u = fmt.Sprintf("%s?opcode=login&user=%s&passwd=%s&refresh=false",
-			p, rap.User, rap.Passwd)
+			p, url.QueryEscape(rap.User), url.QueryEscape(rap.Passwd))
 	//opcode = support
 	case "support":
-		if sid == "" {
-			return "", errors.New(`sid is ""`)
-		}
-		u = fmt.Sprintf("%s?opcode=support&sid=%s&cmd=%s&refresh=false",
-			p, sid, rap.Cmd)
+		return rap.supportURL(ip, sid, rap.Cmd)
 	}
 	//fmt.Println(u)
 	return u, nil
 }
 
-func (rap Rap3) TrimMAC() {
+//在路由器上执行命令cmd的地址
+func (rap Rap3) supportURL(ip, sid, cmd string) (string, error) {
+	if sid == "" {
+		return "", errors.New(`sid is ""`)
+	}
+	return fmt.Sprintf("https://%s:%d/%s?opcode=support&sid=%s&cmd=%s&refresh=false",
+		ip, rap.port(), rap.Path, sid, cmd), nil
+}
+
+//include_mac只保留厂商部分(前3个字节)，统一为小写的xx:xx:xx
+func (rap *Rap3) TrimMAC() {
 	for i := 0; i < len(rap.IncludeMac); i++ {
-		if len(rap.IncludeMac[i]) >= 8 {
-			rap.IncludeMac[i] = strings.ToLower(string(rap.IncludeMac[i][:8]))
+		if h := macHex(rap.IncludeMac[i]); len(h) >= 6 {
+			rap.IncludeMac[i] = h[0:2] + ":" + h[2:4] + ":" + h[4:6]
 		}
 	}
 }
 
-func (rap Rap3) GetClientsWired(client *http.Client, ip string) (c []*Client, err error) {
+//登录路由器，返回执行命令使用的sid
+func (rap Rap3) login(ctx context.Context, client *http.Client, ip string) (string, error) {
 	//登录地址
 	lu, err := rap.NewRequestURL("login", ip, "")
 
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	lreq, err := http.NewRequest("GET", lu, nil)
+	if err != nil {
+		return "", err
 	}
-	login, err := client.Get(lu)
+	login, err := client.Do(lreq.WithContext(ctx))
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("login failed: %s\n", err))
+		return "", errors.New(fmt.Sprintf("login failed: %s\n", err))
 	}
 
 	b, err := ioutil.ReadAll(login.Body)
@@ -126,72 +176,140 @@ func (rap Rap3) GetClientsWired(client *http.Client, ip string) (c []*Client, er
 	//
 	//fmt.Printf("%s\n", b)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("read body failed: %s\n", err))
+		return "", errors.New(fmt.Sprintf("read body failed: %s\n", err))
 	}
 
 	var li Login
 	//  parse step of login
 	if err = xml.Unmarshal(b, &li); err != nil {
-		return nil, errors.New(fmt.Sprintf("xml unmarshal failed: %s\n", err))
+		return "", errors.New(fmt.Sprintf("xml unmarshal failed: %s\n", err))
 	}
+	return li.GetSID(), nil
+}
 
-	// use aruba, run command: show clients wired
-	cu, err := rap.NewRequestURL("support", ip, li.GetSID())
+//执行命令cmd，返回命令的输出
+func (rap Rap3) show(ctx context.Context, client *http.Client, ip, sid, cmd string) ([]byte, error) {
+	cu, err := rap.supportURL(ip, sid, cmd)
 	if err != nil {
 		return nil, err
 	}
 
 	req, err := http.NewRequest("GET", cu, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	res, err := client.Do(req)
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("show clients wired failed: %s\n", err))
+		return nil, errors.New(fmt.Sprintf("%s failed: %s\n", unquoteCmd(cmd), err))
 	}
 	bs, err := ioutil.ReadAll(res.Body)
 	defer res.Body.Close()
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("read clients list failed: %s\n", err))
 	}
+	return bs, nil
+}
 
-	// parse lines in body
-	cs := strings.Split(string(bs), "\n")
-
-	if cs != nil {
-		// split cs in lines
-		for _, line := range cs {
-			// get client name, ip, mac...
-			cl := re.FindStringSubmatch(line)
-			if cl != nil {
-				isPC := true
-				// append to c, if cl is matched and length is 8
-				if len(cl) == 8 {
-					for i := 0; i < len(cl); i++ {
-						// delete space prefix or suffix
-						cl[i] = strings.TrimSpace(cl[i])
-					}
-					// when only_pc is set false, all clients return
-					if rap.OnlyPC {
-						switch {
-						case strings.HasPrefix(cl[4], "Win"):
-							isPC = true
-						case cl[2] == `0.0.0.0`:
-							isPC = false
-						default:
-							for _, mac := range rap.IncludeMac {
-								if strings.HasPrefix(strings.ToLower(cl[3]), mac) {
-									isPC = true
-									break
-								}
-							}
-							isPC = false
-						}
-					}
-				}
-				if isPC {
-					c = append(c, &Client{cl[1], cl[2], cl[3], cl[4], cl[5], cl[6], cl[7]})
-				}
-			}
+//配置中的命令是转义后的，日志中显示原始命令
+func unquoteCmd(cmd string) string {
+	if s, err := url.QueryUnescape(cmd); err == nil {
+		return strings.Trim(s, "'")
+	}
+	return cmd
+}
+
+//获取有线客户端，wireless为true时同时获取无线客户端，只登录一次
+//router的transport和固件版本用于选择执行命令的方式，api为成功时使用的方式
+//只有无线客户端失败时返回有线客户端和*WirelessError
+func (rap Rap3) GetClients(ctx context.Context, client *http.Client, ip string, router *Router) (cs []*Client, warnings []string, api string, err error) {
+	var errs []string
+	for _, t := range rap.transports(router) {
+		cs, warnings, err = rap.getClients(ctx, client, t, ip)
+		if err == nil {
+			return cs, warnings, t.Name(), nil
+		}
+		//有线客户端已经获取，不再使用其他方式
+		if _, ok := err.(*WirelessError); ok {
+			return cs, warnings, t.Name(), err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", t.Name(), strings.TrimSpace(err.Error())))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, "", errors.New(strings.Join(errs, "; "))
+}
+
+func (rap Rap3) getClients(ctx context.Context, client *http.Client, t transport, ip string) ([]*Client, []string, error) {
+	s, err := t.open(ctx, client, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.close()
+	bs, err := s.show(ctx, rap.Cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs, warnings := rap.parseClients(bs, MediumWired)
+	if !rap.Wireless {
+		return cs, warnings, nil
+	}
+	ws, ww, err := rap.clientsWireless(ctx, s)
+	if err != nil {
+		return cs, warnings, &WirelessError{err}
+	}
+	return append(cs, ws...), append(warnings, ww...), nil
+}
+
+//解析show clients wired和show clients的输出，按表头确定每一列，medium为客户端的连接方式
+//不同固件的列可能不同，不存在的列为空值
+func (rap Rap3) parseClients(bs []byte, medium string) (c []*Client, warnings []string) {
+	t := FindTable(ParseTables(string(bs)), "IP Address", "MAC Address")
+	if t == nil {
+		if out := strings.TrimSpace(string(bs)); out != "" {
+			warnings = append(warnings, fmt.Sprintf("no client table in output: %q", strings.SplitN(out, "\n", 2)[0]))
+		}
+		return nil, warnings
+	}
+	warnings = append(warnings, t.Warnings...)
+	for _, row := range t.Rows {
+		cl := &Client{
+			Name:    t.Get(row, "Name"),
+			IP:      t.Get(row, "IP Address"),
+			MAC:     strings.ToLower(t.Get(row, "MAC Address")),
+			OS:      t.Get(row, "OS"),
+			Network: t.Get(row, "Network"),
+			AP:      strings.ToLower(t.Get(row, "Access Point")),
+			Role:    t.Get(row, "Role"),
+			Medium:  medium,
+			SSID:    t.Get(row, "ESSID", "SSID"),
+			Channel: t.Get(row, "Channel"),
+			Signal:  leadingInt(t.Get(row, "Signal", "SNR")),
+			Speed:   leadingInt(t.Get(row, "Speed (mbps)", "Speed")),
+			Auth:    t.Get(row, "Auth", "Auth Type", "Authentication"),
 		}
+		if medium == MediumWireless {
+			cl.Band = band(cl.Channel)
+		}
+		if net.ParseIP(cl.IP) == nil {
+			warnings = append(warnings, fmt.Sprintf("line %d: invalid ip address %q", row.Line, cl.IP))
+			continue
+		}
+		if _, err := net.ParseMAC(cl.MAC); err != nil {
+			warnings = append(warnings, fmt.Sprintf("line %d: invalid mac address %q", row.Line, cl.MAC))
+			continue
+		}
+		c = append(c, cl)
 	}
 	return
 }
+
+//开头的数字，如45(good)中的45，没有数字时返回0
+func leadingInt(s string) int {
+	var n int
+	for i := 0; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		n = n*10 + int(s[i]-'0')
+	}
+	return n
+}
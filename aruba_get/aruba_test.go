@@ -1,25 +1,28 @@
+//go:build live
+// +build live
+
+//需要连接真实的路由器，使用go test -tags live执行
 package main
 
 import (
+	"context"
 	"testing"
 )
 
 var r3 = Rap3{
-	Path:    "swarm.cgi",
-	User:    "admin",
-	Passwd:  `admin`,
-	Cmd:     `%27show%20clients%20wired%27`,
-	Timeout: 5,
-	Filter:  true,
+	Path:   "swarm.cgi",
+	User:   "admin",
+	Passwd: `admin`,
+	Cmd:    `%27show%20clients%20wired%27`,
 }
 
-var ipTest = "101.0.133.1"
+var rapIPTest = "101.0.133.1"
 
 func TestArubaGetWired(t *testing.T) {
 	r3.TrimMAC()
-	cs, err := r3.GetClientsWired(ipTest)
+	cs, _, _, err := r3.GetClients(context.Background(), NewClient(5), rapIPTest, nil)
 	if err != nil {
-		t.Fatalf("GetClientsWired: %#v\n", err)
+		t.Fatalf("GetClients: %#v\n", err)
 		return
 	}
 	for i := 0; i < len(cs); i++ {
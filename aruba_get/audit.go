@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+//修改的来源和对象，与aruba_query保持一致
+const (
+	ActorCollector = "collector"
+	ObjectRouter   = "router"
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+)
+
+//字段修改前后的值，创建时Before为nil
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+//一条修改记录，aruba_query的/admin/audit中查看
+type AuditEntry struct {
+	Time      string
+	ActorType string
+	Actor     string
+	Object    string
+	Target    string
+	Action    string
+	Changes   map[string]*Change
+}
+
+func (s *sqlStore) InsertAudit(e *AuditEntry) error {
+	b, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	if e.Time == "" {
+		e.Time = time.Now().Format(runTimeFormat)
+	}
+	_, err = s.db.Exec(`insert into audit_log (created_at, actor_type, actor, object, target, action, changes)
+	values (?, ?, ?, ?, ?, ?, ?)`, e.Time, e.ActorType, e.Actor, e.Object, e.Target, e.Action, string(b))
+	return err
+}
+
+//before和after不同时记录
+func addChange(cs map[string]*Change, field string, before, after interface{}) {
+	if before != after {
+		cs[field] = &Change{Before: before, After: after}
+	}
+}
+
+//采集时修改的字段，before为nil时是新的路由器
+func routerChanges(before, after *Router) map[string]*Change {
+	var cs = make(map[string]*Change)
+	create := before == nil
+	if create {
+		before = new(Router)
+	}
+	addChange(cs, "name", before.Name, after.Name)
+	addChange(cs, "gateway", before.GateWay, after.GateWay)
+	addChange(cs, "wanip", before.Wanip, after.Wanip)
+	addChange(cs, "area", before.Area, after.Area)
+	addChange(cs, "autoupdate", before.AutoUpdate, after.AutoUpdate)
+	//新的路由器只记录不为空的字段
+	if create {
+		for _, c := range cs {
+			c.Before = nil
+		}
+	}
+	return cs
+}
+
+//记录采集对路由器的修改，没有变化时不记录
+func (cfg *Config) auditRouter(before, after *Router, logger *log.Logger) {
+	cs := routerChanges(before, after)
+	if len(cs) == 0 {
+		return
+	}
+	action := ActionUpdate
+	if before == nil {
+		action = ActionCreate
+	}
+	e := &AuditEntry{
+		ActorType: ActorCollector,
+		Actor:     "aruba_get",
+		Object:    ObjectRouter,
+		Target:    after.Code,
+		Action:    action,
+		Changes:   cs,
+	}
+	if err := cfg.store.InsertAudit(e); err != nil {
+		logger.Printf("audit %s router %s error: %s\n", action, after.Code, err)
+	}
+}
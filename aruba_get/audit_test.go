@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestAuditRouter(t *testing.T) {
+	cfg := &Config{store: dbTest}
+	lg := log.New(ioutil.Discard, "", 0)
+	before := &Router{Code: "AUDIT1", Name: "jinan", Wanip: "1.1.1.1", AutoUpdate: 1}
+	after := *before
+	//没有变化时不记录
+	cfg.auditRouter(before, &after, lg)
+	after.Wanip = "2.2.2.2"
+	cfg.auditRouter(before, &after, lg)
+	cfg.auditRouter(nil, &Router{Code: "AUDIT2", Name: "qingdao"}, lg)
+
+	rows, err := dbTest.(*Sqlite).db.Query(`select actor_type, target, action, changes from audit_log
+	where target in ('AUDIT1', 'AUDIT2') order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var actor, target, action, changes string
+		if err = rows.Scan(&actor, &target, &action, &changes); err != nil {
+			t.Fatal(err)
+		}
+		var cs map[string]*Change
+		if err = json.Unmarshal([]byte(changes), &cs); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, actor+" "+action+" "+target)
+		if target == "AUDIT1" && (len(cs) != 1 || cs["wanip"] == nil || cs["wanip"].Before != "1.1.1.1" || cs["wanip"].After != "2.2.2.2") {
+			t.Errorf("changes of AUDIT1: %s", changes)
+		}
+		if target == "AUDIT2" && (cs["name"] == nil || cs["name"].Before != nil) {
+			t.Errorf("changes of AUDIT2: %s", changes)
+		}
+	}
+	if len(got) != 2 || got[0] != "collector update AUDIT1" || got[1] != "collector create AUDIT2" {
+		t.Errorf("audit log: %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+//设备类型
+const (
+	ClassPC      = "pc"
+	ClassPhone   = "phone"
+	ClassPrinter = "printer"
+	ClassPOS     = "pos-terminal"
+	ClassIoT     = "iot"
+)
+
+var deviceClasses = []string{ClassPC, ClassPhone, ClassPrinter, ClassPOS, ClassIoT}
+
+//分类规则，设置的条件都满足时客户端属于class
+//os、name、role和vendor为正则表达式，oui为mac地址前缀，ip为地址、CIDR或者a-b范围
+//random为true时只匹配随机mac，为false时只匹配厂商分配的mac
+type Rule struct {
+	Class  string   `json:"class"`
+	OS     string   `json:"os,omitempty"`
+	OUI    []string `json:"oui,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	IP     []string `json:"ip,omitempty"`
+	Role   string   `json:"role,omitempty"`
+	Vendor string   `json:"vendor,omitempty"`
+	Random *bool    `json:"random,omitempty"`
+
+	os, name, role, vendor *regexp.Regexp
+	ouis                   []string
+	ips                    []ipRange
+}
+
+//包括from和to的地址范围
+type ipRange struct {
+	from, to net.IP
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		from, to := make(net.IP, len(n.IP)), make(net.IP, len(n.IP))
+		for i := range n.IP {
+			from[i] = n.IP[i] & n.Mask[i]
+			to[i] = n.IP[i] | ^n.Mask[i]
+		}
+		return ipRange{from.To16(), to.To16()}, nil
+	}
+	var a, b = s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		a, b = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	from, to := net.ParseIP(a), net.ParseIP(b)
+	if from == nil || to == nil || bytes.Compare(from.To16(), to.To16()) > 0 {
+		return ipRange{}, fmt.Errorf("invalid ip range %q", s)
+	}
+	return ipRange{from.To16(), to.To16()}, nil
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, r.from) >= 0 && bytes.Compare(ip, r.to) <= 0
+}
+
+//mac地址的16进制数字，忽略分隔符，如C0-3F-D5和c03f.d5都为c03fd5
+func macHex(mac string) string {
+	var b = make([]byte, 0, len(mac))
+	for _, c := range strings.ToLower(mac) {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') {
+			b = append(b, byte(c))
+		}
+	}
+	return string(b)
+}
+
+func (r *Rule) compile() error {
+	var known bool
+	for _, c := range deviceClasses {
+		if r.Class == c {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown device class %q, should be one of %s", r.Class, strings.Join(deviceClasses, ", "))
+	}
+	var err error
+	for _, v := range []struct {
+		expr string
+		re   **regexp.Regexp
+	}{{r.OS, &r.os}, {r.Name, &r.name}, {r.Role, &r.role}, {r.Vendor, &r.vendor}} {
+		if v.expr == "" {
+			continue
+		}
+		if *v.re, err = regexp.Compile(v.expr); err != nil {
+			return fmt.Errorf("class %s: %s", r.Class, err)
+		}
+	}
+	r.ouis = r.ouis[:0]
+	for _, oui := range r.OUI {
+		if h := macHex(oui); h != "" {
+			r.ouis = append(r.ouis, h)
+		}
+	}
+	r.ips = r.ips[:0]
+	for _, s := range r.IP {
+		ipr, err := parseIPRange(s)
+		if err != nil {
+			return fmt.Errorf("class %s: %s", r.Class, err)
+		}
+		r.ips = append(r.ips, ipr)
+	}
+	return nil
+}
+
+//客户端是否满足规则的所有条件
+func (r *Rule) Match(c *Client) bool {
+	if r.os != nil && !r.os.MatchString(c.OS) {
+		return false
+	}
+	if r.name != nil && !r.name.MatchString(c.Name) {
+		return false
+	}
+	if r.role != nil && !r.role.MatchString(c.Role) {
+		return false
+	}
+	if r.vendor != nil && !r.vendor.MatchString(c.Vendor) {
+		return false
+	}
+	if r.Random != nil && *r.Random != c.Random {
+		return false
+	}
+	if len(r.ouis) > 0 {
+		var ok bool
+		mac := macHex(c.MAC)
+		for _, oui := range r.ouis {
+			if strings.HasPrefix(mac, oui) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ips) > 0 {
+		var ok bool
+		ip := net.ParseIP(c.IP)
+		for _, ipr := range r.ips {
+			if ipr.contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//按顺序使用第一个匹配的规则设置客户端的类型
+type Classifier struct {
+	rules []*Rule
+	//只保留类型为pc的客户端
+	onlyPC bool
+}
+
+//rules之后添加rap3中only_pc和include_mac对应的规则：Windows和include_mac厂商的设备为pc
+func NewClassifier(rules []*Rule, rap *Rap3) (*Classifier, error) {
+	cl := new(Classifier)
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+		cl.rules = append(cl.rules, r)
+	}
+	if rap != nil {
+		cl.onlyPC = rap.OnlyPC
+		rap.TrimMAC()
+		legacy := []*Rule{{Class: ClassPC, OS: "^Win"}}
+		if len(rap.IncludeMac) > 0 {
+			legacy = append(legacy, &Rule{Class: ClassPC, OUI: rap.IncludeMac})
+		}
+		for _, r := range legacy {
+			if err := r.compile(); err != nil {
+				return nil, err
+			}
+			cl.rules = append(cl.rules, r)
+		}
+	}
+	return cl, nil
+}
+
+//设置cs中每个客户端的类型，only_pc时去掉不是pc的客户端，以及除Windows以外没有ip地址的客户端
+//cl为nil时不分类
+func (cl *Classifier) Classify(cs []*Client) []*Client {
+	if cl == nil {
+		return cs
+	}
+	var res = cs[:0]
+	for _, c := range cs {
+		c.Class = ""
+		for _, r := range cl.rules {
+			if r.Match(c) {
+				c.Class = r.Class
+				break
+			}
+		}
+		//与旧版本一致，Windows客户端没有ip地址时也保存
+		if cl.onlyPC && (c.Class != ClassPC || c.IP == "0.0.0.0" && !strings.HasPrefix(c.OS, "Win")) {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+//根据classify和rap3编译分类规则
+func (cfg *Config) LoadClassifier() error {
+	cl, err := NewClassifier(cfg.Classify, cfg.Rap3)
+	if err != nil {
+		return fmt.Errorf("classify: %s", err)
+	}
+	cfg.classifier = cl
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var rulesTest = []*Rule{
+	{Class: ClassPOS, IP: []string{"10.62.15.100-10.62.15.199"}, Role: "^pos"},
+	{Class: ClassPrinter, OUI: []string{"00-00-48"}},
+	{Class: ClassPhone, OS: "(?i)^(ios|android)"},
+	{Class: ClassIoT, Name: "^cam-", IP: []string{"10.62.16.0/24"}},
+}
+
+func TestClassify(t *testing.T) {
+	rap := &Rap3{IncludeMac: []string{"C0:3F:D5:7E:FD:EE"}}
+	cl, err := NewClassifier(rulesTest, rap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rap.IncludeMac[0] != "c0:3f:d5" {
+		t.Errorf("TrimMAC = %q, want c0:3f:d5", rap.IncludeMac[0])
+	}
+	var cases = []struct {
+		c     Client
+		class string
+	}{
+		{Client{IP: "10.62.15.150", Role: "pos-terminal", OS: "Win 7"}, ClassPOS},
+		{Client{IP: "10.62.15.200", Role: "pos-terminal", OS: "Win 7"}, ClassPC},
+		{Client{IP: "10.62.15.20", MAC: "00:00:48:11:22:33"}, ClassPrinter},
+		{Client{IP: "10.62.15.21", OS: "Android"}, ClassPhone},
+		{Client{IP: "10.62.16.9", Name: "cam-01"}, ClassIoT},
+		{Client{IP: "10.62.17.9", Name: "cam-02"}, ""},
+		//include_mac厂商的设备为pc
+		{Client{IP: "10.62.15.30", MAC: "c0:3f:d5:00:00:01", OS: "Linux"}, ClassPC},
+		{Client{IP: "10.62.15.31", MAC: "00:11:22:33:44:55", OS: "Linux"}, ""},
+	}
+	for _, c := range cases {
+		client := c.c
+		cl.Classify([]*Client{&client})
+		if client.Class != c.class {
+			t.Errorf("class of %+v = %q, want %q", c.c, client.Class, c.class)
+		}
+	}
+}
+
+func TestClassifyOnlyPC(t *testing.T) {
+	cl, err := NewClassifier(nil, &Rap3{OnlyPC: true, IncludeMac: []string{"c03fd5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := cl.Classify([]*Client{
+		{IP: "10.62.15.11", MAC: "00:11:22:33:44:55", OS: "Win 10"},
+		{IP: "10.62.15.12", MAC: "c0:3f:d5:00:00:01", OS: "Linux"},
+		{IP: "10.62.15.13", MAC: "00:11:22:33:44:66", OS: "Linux"},
+		{IP: "0.0.0.0", MAC: "c0:3f:d5:00:00:02"},
+		{IP: "0.0.0.0", MAC: "00:11:22:33:44:77", OS: "Win 7"},
+	})
+	if len(cs) != 3 || cs[0].IP != "10.62.15.11" || cs[1].IP != "10.62.15.12" || cs[2].OS != "Win 7" {
+		t.Errorf("only_pc kept %+v", cs)
+	}
+}
+
+func TestRuleErrors(t *testing.T) {
+	for _, r := range []*Rule{
+		{Class: "laptop"},
+		{Class: ClassPC, OS: "("},
+		{Class: ClassPC, IP: []string{"10.0.0.9-10.0.0.1"}},
+		{Class: ClassPC, IP: []string{"10.0.0"}},
+	} {
+		if _, err := NewClassifier([]*Rule{r}, nil); err == nil {
+			t.Errorf("rule %+v compiled", r)
+		}
+	}
+}
+
+func TestInsertClass(t *testing.T) {
+	cs := []*Client{{IP: "10.62.15.20", MAC: "00:00:48:11:22:33", Class: ClassPrinter}}
+	if err := dbTest.InsertClients("K01", cs); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	got, err := dbTest.SelectClientsByTime("K01", now.Format("2006-01-02"), now.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Class != ClassPrinter {
+		t.Errorf("clients = %+v", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//从所有airwave获取路由器列表，添加新的路由器，并更新auto_update的路由器信息
+//有airwave失败时complete为false，返回的列表只包含成功的airwave上的路由器
+func (cfg *Config) RefreshRouters(ctx context.Context, client *http.Client, logger *log.Logger) (awRs []*Router, complete bool, err error) {
+	logger.Println("starting connect remote airwave")
+
+	awRs, complete, err = FetchRouters(ctx, cfg.airwaves(), client, logger)
+	if err != nil {
+		return nil, false, fmt.Errorf("get routers from airwave error: %s", err)
+	}
+	logger.Printf("get routers number: %d\n", len(awRs))
+	observeRouters(awRs)
+
+	//修改前的路由器，用于记录采集的修改
+	dbRs, err := cfg.store.SelectRouters()
+	if err != nil {
+		return nil, false, fmt.Errorf("select routers error: %s", err)
+	}
+	var old = make(map[string]*Router)
+	for _, r := range dbRs {
+		old[r.Code] = r
+	}
+
+	rss, err := Diff(cfg.store, awRs)
+	if err != nil {
+		return nil, false, fmt.Errorf("diff routers error: %s", err)
+	}
+	for i := 0; i < len(rss); i++ {
+		logger.Printf("new router found, code: %s\n", rss[i].Code)
+	}
+	if err = SyncRouters(cfg.store, rss); err != nil {
+		return nil, false, fmt.Errorf("add new routers into database error: %s", err)
+	}
+	logger.Println("add new routers success")
+	for _, r := range rss {
+		cfg.auditRouter(nil, r, logger)
+	}
+	if err = cfg.store.UpdateInventory(awRs); err != nil {
+		logger.Printf("update inventory of routers error: %s\n", err)
+	}
+	now := time.Now()
+	if err = cfg.store.EnsurePartitions(now, now.AddDate(0, 1, 0)); err != nil {
+		logger.Println("add partitions of client_sightings error: ", err)
+	}
+
+	for _, r := range awRs {
+		if r.AutoUpdate == 0 {
+			continue
+		}
+		if err = cfg.store.UpdateRouter(r); err != nil {
+			logger.Printf("update router %s failed: %s\n", r.Code, err)
+			continue
+		} else if cfg.Debug {
+			logger.Printf("update router %s success\n", r.Code)
+		}
+		//UpdateRouter只修改这些字段
+		if before := old[r.Code]; before != nil {
+			after := *before
+			after.Name, after.GateWay, after.Wanip, after.Area, after.AutoUpdate = r.Name, r.GateWay, r.Wanip, r.Area, r.AutoUpdate
+			cfg.auditRouter(before, &after, logger)
+		}
+	}
+	return awRs, complete, nil
+}
+
+const defaultMaxConcurrency = 20
+
+//同时连接路由器的最大数量
+func (cfg *Config) maxConcurrency() int {
+	if cfg.MaxConcurrency > 0 {
+		return cfg.MaxConcurrency
+	}
+	return defaultMaxConcurrency
+}
+
+//所有采集共用的并发限制，ctx取消时不再等待
+func (cfg *Config) acquire(ctx context.Context) error {
+	cfg.limitOnce.Do(func() {
+		cfg.limit = make(chan struct{}, cfg.maxConcurrency())
+	})
+	select {
+	case cfg.limit <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cfg *Config) release() {
+	<-cfg.limit
+}
+
+//使用max_concurrency个worker采集所有状态为Up的路由器
+//ctx取消时正在进行的请求立即结束，还没有开始的路由器记为失败，已经获取的数据仍然保存
+func (cfg *Config) CollectAll(ctx context.Context, client *http.Client, routers []*Router, logger *log.Logger) *Run {
+	var (
+		run  = NewRun("cron")
+		wg   sync.WaitGroup
+		jobs = make(chan *Router)
+	)
+	for i := 0; i < cfg.maxConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for router := range jobs {
+				rr, _ := cfg.CollectRouter(ctx, client, router, logger)
+				run.Add(rr)
+				cfg.watchdog.Ping()
+			}
+		}()
+	}
+	for _, r := range routers {
+		if !r.status {
+			logger.Printf("%s status is %v, skip\n", r.Code, r.status)
+			run.Add(skipped(r))
+			continue
+		}
+		select {
+		case jobs <- r:
+		case <-ctx.Done():
+			run.Add(canceled(r, ctx.Err()))
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	run.Finish()
+	return run
+}
+
+//获取路由器的在线客户端并保存，使用wan ip失败时通过gateway重试
+//每次请求的截止时间为timeout秒，返回的结果不为nil，失败时包含错误信息
+func (cfg *Config) CollectRouter(ctx context.Context, client *http.Client, router *Router, logger *log.Logger) (*RouterRun, error) {
+	if err := cfg.acquire(ctx); err != nil {
+		return canceled(router, err), err
+	}
+	defer cfg.release()
+
+	rr := &RouterRun{
+		Code:    router.Code,
+		Wanip:   router.Wanip,
+		Gateway: router.GateWay,
+		Start:   time.Now(),
+	}
+	cs, err := cfg.collectClients(ctx, client, router, rr, logger)
+	rr.Duration = time.Since(rr.Start)
+	switch {
+	case err != nil:
+		rr.Status = RunFailed
+		rr.Error = err.Error()
+	case rr.Fallback:
+		rr.Status = RunGateway
+	default:
+		rr.Status = RunOK
+	}
+	rr.Clients = len(cs)
+	observeRouterRun(rr)
+	return rr, err
+}
+
+func (cfg *Config) collectClients(ctx context.Context, client *http.Client, router *Router, rr *RouterRun, logger *log.Logger) ([]*Client, error) {
+	//获取在线的客户端
+	cs, warnings, api, err := cfg.getClients(ctx, client, router.Wanip, router)
+	if werr, ok := err.(*WirelessError); ok {
+		//无线客户端失败时保存有线客户端，错误记录在本次采集中
+		logger.Printf("code %s show clients by wan ip %s: %s\n", router.Code, router.Wanip, werr)
+		rr.Error, err = werr.Error(), nil
+	}
+	if err != nil {
+		logger.Printf("code %s show clients failed by wan ip %s: %s\n", router.Code, router.Wanip, err)
+		if router.GateWay == "" {
+			logger.Printf("code %s gateway is not exists\n", router.Code)
+			return nil, err
+		}
+
+		logger.Printf("code %s retry by gateway %s\n", router.Code, router.GateWay)
+		rr.Fallback = true
+		cs, warnings, api, err = cfg.getClients(ctx, client, router.GateWay, router)
+		if werr, ok := err.(*WirelessError); ok {
+			logger.Printf("code %s show clients by gateway %s: %s\n", router.Code, router.GateWay, werr)
+			rr.Error, err = werr.Error(), nil
+		}
+		if err != nil {
+			logger.Printf("code %s show clients retry use gateway failed: %s\n", router.Code, err)
+			return nil, err
+		}
+		logger.Printf("code %s retry by gateway success via %s\n", router.Code, api)
+	} else if cfg.Debug {
+		logger.Printf("code %s show clients by wan ip %s via %s\n", router.Code, router.Wanip, api)
+	}
+	//无法解析的行只记录日志，其他客户端仍然保存
+	for _, w := range warnings {
+		logger.Printf("code %s parse warning: %s\n", router.Code, w)
+	}
+	if len(warnings) > 0 {
+		parseWarnings.WithLabelValues(router.Code).Add(float64(len(warnings)))
+	}
+	cfg.ouis.Enrich(cs)
+	cs = cfg.classifier.Classify(cs)
+	//插入数据到client_sightings
+	if err = cfg.store.InsertClients(router.Code, cs); err != nil {
+		logger.Printf("code %s insert data failed: %s\n", router.Code, err)
+		return nil, errors.New(fmt.Sprintf("insert data failed: %s", err))
+	} else if cfg.Debug {
+		logger.Printf("code %s insert data success, first: %s\n", router.Code, cs)
+	}
+	return cs, nil
+}
+
+//获取有线客户端，rap3配置wireless时同时获取无线客户端，router用于选择REST API、swarm.cgi或者ssh
+func (cfg *Config) getClients(ctx context.Context, client *http.Client, ip string, router *Router) ([]*Client, []string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Second)
+	defer cancel()
+	return cfg.Rap3.GetClients(ctx, client, ip, router)
+}
+
+//保存一次采集的结果，失败时只记录日志
+func (cfg *Config) SaveRun(run *Run, logger *log.Logger) {
+	observeRun(run)
+	if err := cfg.store.InsertRun(run); err != nil {
+		logger.Printf("save collection run failed: %s\n", err)
+	}
+}
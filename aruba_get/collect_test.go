@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunAdd(t *testing.T) {
+	run := NewRun("cron")
+	run.Add(&RouterRun{Code: "T01", Status: RunOK})
+	run.Add(&RouterRun{Code: "T02", Status: RunGateway, Fallback: true})
+	run.Add(&RouterRun{Code: "T03", Status: RunFailed, Error: "timeout"})
+	run.Add(&RouterRun{Code: "T04", Status: RunSkipped})
+	want := RunSummary{Total: 4, Succeeded: 2, Failed: 1, Gateway: 1, Skipped: 1}
+	if run.RunSummary != want {
+		t.Errorf("summary = %+v, want %+v", run.RunSummary, want)
+	}
+	if len(run.Routers) != 4 {
+		t.Errorf("run has %d routers, want 4", len(run.Routers))
+	}
+}
+
+func TestCollectAll(t *testing.T) {
+	cfg := &Config{
+		Timeout:        1,
+		MaxConcurrency: 2,
+		Rap3:           &Rap3{Path: "swarm.cgi"},
+		store:          dbTest,
+	}
+	//本机没有监听4343端口，连接会立即失败
+	var routers = []*Router{
+		{Code: "T01", Wanip: "127.0.0.1", status: true},
+		{Code: "T02", Wanip: "127.0.0.1", GateWay: "127.0.0.2", status: true},
+		{Code: "T03", Wanip: "127.0.0.1", status: true},
+		{Code: "T04", Wanip: "127.0.0.1", status: false},
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	run := cfg.CollectAll(context.Background(), &http.Client{}, routers, logger)
+	want := RunSummary{Total: 4, Failed: 3, Skipped: 1}
+	if run.RunSummary != want {
+		t.Errorf("summary = %+v, want %+v", run.RunSummary, want)
+	}
+	for _, rr := range run.Routers {
+		if rr.Code == "T02" && !rr.Fallback {
+			t.Errorf("T02 did not retry by gateway")
+		}
+		if rr.Status == RunFailed && rr.Error == "" {
+			t.Errorf("%s failed without error text", rr.Code)
+		}
+	}
+	if err := dbTest.InsertRun(run); err != nil {
+		t.Fatal(err)
+	}
+	if run.ID == 0 {
+		t.Error("run id is not set after InsertRun")
+	}
+	if n := len(cfg.limit); n != 0 {
+		t.Errorf("%d slots still held after CollectAll", n)
+	}
+}
+
+func TestCollectRouterCanceled(t *testing.T) {
+	cfg := &Config{
+		Timeout: 10,
+		Rap3:    &Rap3{Path: "swarm.cgi"},
+		store:   dbTest,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	//取消的context不会等待timeout
+	_, err := cfg.CollectRouter(ctx, &http.Client{}, &Router{Code: "T01", Wanip: "192.0.2.1"}, log.New(ioutil.Discard, "", 0))
+	if err == nil {
+		t.Fatal("CollectRouter with canceled context succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("CollectRouter took %s after cancel", d)
+	}
+}
+
+func TestCollectAllCanceled(t *testing.T) {
+	cfg := &Config{
+		Timeout:        10,
+		MaxConcurrency: 1,
+		Rap3:           &Rap3{Path: "swarm.cgi"},
+		store:          dbTest,
+	}
+	var routers = []*Router{
+		{Code: "T01", Wanip: "192.0.2.1", status: true},
+		{Code: "T02", Wanip: "192.0.2.2", status: true},
+		{Code: "T03", Wanip: "192.0.2.3", status: true},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	//收到退出信号后所有路由器都记为失败，不会等待timeout
+	run := cfg.CollectAll(ctx, &http.Client{}, routers, log.New(ioutil.Discard, "", 0))
+	if run.Total != 3 || run.Failed != 3 {
+		t.Errorf("summary = %+v, want 3 failed", run.RunSummary)
+	}
+	if d := run.Duration(); d > 5*time.Second {
+		t.Errorf("CollectAll took %s after cancel", d)
+	}
+}
@@ -1,40 +1,115 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
-//mysql database configure
-type MysqlDB struct {
+//database configure, driver为mysql(默认)或者sqlite3
+type DBConfig struct {
+	Driver   string `json:"driver"`
 	Host     string `json:"host"`
 	Port     string `json:"port"`
 	User     string `json:"user"`
 	Password string `json:"password"`
 	DB       string `json:"db"`
+	//sqlite3数据库文件, 相对路径基于程序目录
+	Path string `json:"path,omitempty"`
 }
 
 //配置文件
 type Config struct {
-	Debug    bool     `json:debug"`
-	Hour     int      `json:"hour"`
-	Minute   int      `json:"minute"`
-	Timeout  int      `json:"timeout"`
-	Airwave  *Airwave `json:"airwave"`
-	Rap3     *Rap3    `json:"rap3"`
-	Database *MysqlDB `json:"database"`
+	Debug  bool `json:"debug"`
+	Hour   int  `json:"hour"`
+	Minute int  `json:"minute"`
+	//cron表达式列表，为空时使用hour和minute每天执行一次
+	Schedule []string `json:"schedule"`
+	//schedule使用的时区，如Asia/Shanghai，为空时使用本地时区
+	Timezone string `json:"timezone"`
+	//配置poll时使用持续轮询模式，不再使用schedule
+	Poll    *Poll `json:"poll,omitempty"`
+	Timeout int   `json:"timeout"`
+	//采集方式：rap(默认)登录每个RAP，airwave从airwave的AMP API获取
+	Collector string `json:"collector,omitempty"`
+	//同时连接路由器的最大数量
+	MaxConcurrency int `json:"max_concurrency"`
+	//单个airwave，兼容旧的配置文件
+	Airwave *Airwave `json:"airwave,omitempty"`
+	//多个airwave服务器
+	Airwaves []*Airwave `json:"airwaves,omitempty"`
+	Rap3     *Rap3      `json:"rap3"`
+	//设备分类规则，按顺序使用第一个匹配的规则
+	Classify []*Rule   `json:"classify,omitempty"`
+	Database *DBConfig `json:"database"`
+	//prometheus指标的监听地址，如127.0.0.1:9101，为空时不启用
+	Metrics string `json:"metrics,omitempty"`
 
-	db *sql.DB
+	store      Store
+	classifier *Classifier
+	ouis       *OUIRegistry
+	//采集中每完成一个路由器发送一次，nil时不发送
+	watchdog *Watchdog
+
+	limit     chan struct{}
+	limitOnce sync.Once
+}
+
+//配置的所有airwave
+func (cfg *Config) airwaves() []*Airwave {
+	var aws = make([]*Airwave, 0, len(cfg.Airwaves)+1)
+	if cfg.Airwave != nil {
+		aws = append(aws, cfg.Airwave)
+	}
+	for _, aw := range cfg.Airwaves {
+		if aw != nil {
+			aws = append(aws, aw)
+		}
+	}
+	return aws
 }
 
-func (cfg *Config) OpenMysql() {
-	db := OpenMysql(cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.Password, cfg.Database.DB)
-	cfg.db = db
+//打开配置的数据库
+func (cfg *Config) OpenStore() error {
+	if cfg.Database.Driver == "sqlite3" && !filepath.IsAbs(cfg.Database.Path) {
+		cfg.Database.Path = filepath.Join(Basedir(), cfg.Database.Path)
+	}
+	if cfg.Database.Driver == "sqlite3" {
+		Mkdir(filepath.Dir(cfg.Database.Path))
+	}
+	s, err := OpenStore(cfg.Database)
+	if err != nil {
+		return err
+	}
+	cfg.store = s
+	return nil
+}
+
+//定时任务的cron表达式和时区
+func (cfg *Config) Cron() ([]string, *time.Location, error) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(cfg.Schedule) > 0 {
+		return cfg.Schedule, loc, nil
+	}
+	if cfg.Hour < 0 || cfg.Hour > 23 {
+		return nil, nil, errors.New("hour must between 0 and 23")
+	}
+	if cfg.Minute < 0 || cfg.Minute > 59 {
+		return nil, nil, errors.New("minute must between 0 and 59")
+	}
+	return []string{fmt.Sprintf("%d %d * * *", cfg.Minute, cfg.Hour)}, loc, nil
 }
 
 //生成配置文件到file
@@ -84,7 +159,8 @@ func Mkdir(dir string) {
 }
 
 func NewLogger(file string) *log.Logger {
-	fi, err := os.Create(file)
+	//追加到原有日志，重启时不清空
+	fi, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		log.Fatalln(err)
 	}
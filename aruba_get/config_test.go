@@ -1,3 +1,7 @@
+//go:build live
+// +build live
+
+//需要本地的配置文件，使用go test -tags live执行
 package main
 
 import (
@@ -14,7 +18,7 @@ func TestReadConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Logf("%#v\n", cfg)
-	login, err := cfg.Rap3.NewRequestURL("login", ipTest)
+	login, err := cfg.Rap3.NewRequestURL("login", ipTest, "")
 	if err != nil {
 		t.Fatal(err)
 	}
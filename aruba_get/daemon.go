@@ -0,0 +1,141 @@
+//pid文件、systemd通知和watchdog，aruba_get和aruba_query分别编译，没有共用的包，两个daemon.go保持一致
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//加锁的pid文件，同一时间只能运行一个实例
+type PidFile struct {
+	path string
+	file *os.File
+}
+
+//创建pid文件并加排他锁，已经有实例在运行时返回错误
+func LockPidFile(path string) (*PidFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		return nil, fmt.Errorf("another instance is running, pid %s: %s", strings.TrimSpace(string(b)), err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PidFile{path: path, file: f}, nil
+}
+
+//删除pid文件并解锁
+func (p *PidFile) Remove() error {
+	err := os.Remove(p.path)
+	if e := p.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+//向systemd发送状态，例如READY=1、STOPPING=1、WATCHDOG=1
+//没有设置NOTIFY_SOCKET(不是由systemd以Type=notify启动)时返回false
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	//抽象命名空间的socket以@开头
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//systemd要求的watchdog间隔，没有启用WatchdogSec时返回0
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+//systemd watchdog，主循环取得进展时调用Ping发送WATCHDOG=1
+//只在空闲等待和每完成一项工作时发送，采集或者更新卡住时systemd在WatchdogSec后重启服务
+//没有启用WatchdogSec时为nil，所有方法都可以在nil上调用
+type Watchdog struct {
+	ticker *time.Ticker
+	logger *log.Logger
+}
+
+func NewWatchdog(logger *log.Logger) *Watchdog {
+	d := watchdogInterval()
+	if d == 0 {
+		return nil
+	}
+	logger.Printf("systemd watchdog enabled, interval %s\n", d)
+	return &Watchdog{ticker: time.NewTicker(d / 2), logger: logger}
+}
+
+//主循环空闲等待时按watchdog间隔的一半触发，nil时永远不会触发
+func (w *Watchdog) C() <-chan time.Time {
+	if w == nil {
+		return nil
+	}
+	return w.ticker.C
+}
+
+func (w *Watchdog) Ping() {
+	if w == nil {
+		return
+	}
+	if _, err := Notify("WATCHDOG=1"); err != nil {
+		w.logger.Printf("notify watchdog: %s\n", err)
+	}
+}
+
+//等待d，期间按间隔发送WATCHDOG=1，ctx取消时返回false
+func (w *Watchdog) Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-w.C():
+			w.Ping()
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+func (w *Watchdog) Stop() {
+	if w != nil {
+		w.ticker.Stop()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLockPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aruba.pid")
+
+	pf, err := LockPidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(b) != want {
+		t.Errorf("pid file = %q, want %q", b, want)
+	}
+	//第二个实例不能获得锁
+	if _, err = LockPidFile(path); err == nil {
+		t.Fatal("second LockPidFile succeeded")
+	}
+	if err = pf.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file still exists after Remove: %v", err)
+	}
+	pf, err = LockPidFile(path)
+	if err != nil {
+		t.Fatalf("lock after Remove: %s", err)
+	}
+	pf.Remove()
+}
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Errorf("Notify without NOTIFY_SOCKET = %v, %v", ok, err)
+	}
+
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if ok, err := Notify("READY=1"); !ok || err != nil {
+		t.Fatalf("Notify = %v, %v", ok, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf = make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Errorf("received %q, want READY=1", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if d := watchdogInterval(); d != 30*time.Second {
+		t.Errorf("interval = %s, want 30s", d)
+	}
+	//WATCHDOG_PID是其他进程时不发送
+	os.Setenv("WATCHDOG_PID", "1")
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("interval for other pid = %s, want 0", d)
+	}
+	os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("interval without WATCHDOG_USEC = %s, want 0", d)
+	}
+}
+
+func TestWatchdogSleep(t *testing.T) {
+	//没有启用watchdog时只等待
+	var w *Watchdog
+	w.Ping()
+	if !w.Sleep(context.Background(), time.Millisecond) {
+		t.Error("nil watchdog Sleep returned false")
+	}
+
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", addr)
+	os.Setenv("WATCHDOG_USEC", "40000")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	w = NewWatchdog(log.New(ioutil.Discard, "", 0))
+	defer w.Stop()
+	//空闲等待时按间隔的一半发送
+	if !w.Sleep(context.Background(), 50*time.Millisecond) {
+		t.Fatal("Sleep returned false")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf = make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("received %q, %v, want WATCHDOG=1", buf[:n], err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w.Sleep(ctx, time.Hour) {
+		t.Error("Sleep after cancel returned true")
+	}
+}
@@ -3,20 +3,339 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+//mysql和sqlite3共用的sql实现
+type sqlStore struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+//mysql存储
+type Mysql struct {
+	sqlStore
+}
+
 //连接数据库
-func OpenMysql(host, port, user, password, database string) *sql.DB {
+func OpenMysql(host, port, user, password, database string) (*Mysql, error) {
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
 		user, password, host, port, database))
 	if err != nil {
-		log.Fatalf("open mysql failed: %s", err)
+		return nil, fmt.Errorf("open mysql failed: %s", err)
 	}
-	return db
+	return &Mysql{sqlStore{db, mysqlMigrations}}, nil
+}
+
+//mysql数据库版本，只能在末尾添加新的版本
+var mysqlMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Before:  adoptLegacyMysql,
+		Up: []string{
+			`create table if not exists routers (
+				code varchar(10) not null,
+				name varchar(100) not null default '',
+				gateway varchar(15) not null default '',
+				wanip varchar(15) not null default '',
+				area varchar(100) not null default '',
+				sp varchar(100) not null default '',
+				autoupdate tinyint(1) not null default 1,
+				primary key (code)
+			) engine=InnoDB default charset=utf8`,
+			`create table if not exists users (
+				user varchar(100) not null,
+				password varchar(256) not null,
+				admin tinyint(1) not null default 0,
+				primary key (user)
+			) engine=InnoDB default charset=utf8`,
+			//client_sightings按月分区，pmax保存尚未建立分区的数据
+			`create table if not exists client_sightings (
+				id bigint unsigned not null auto_increment,
+				code varchar(10) not null,
+				name varchar(100) not null default '',
+				ip varchar(15) not null,
+				mac char(17) not null,
+				os varchar(50) not null default '',
+				network varchar(10) not null default 'eth1',
+				ap char(17) not null,
+				role varchar(50) not null,
+				time timestamp not null default current_timestamp,
+				primary key (code, time, id),
+				key id (id),
+				key mac (mac)
+			) engine=InnoDB default charset=utf8
+			partition by range (unix_timestamp(time)) (
+				partition pmax values less than maxvalue
+			)`,
+		},
+		Down: []string{
+			`drop table if exists client_sightings`,
+			`drop table if exists users`,
+			`drop table if exists routers`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "sightings migration progress",
+		Up: []string{
+			`create table if not exists sightings_migration (
+				code varchar(10) not null,
+				last_id bigint not null default 0,
+				primary key (code)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists sightings_migration`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "collection runs",
+		Up: []string{
+			`create table if not exists collection_runs (
+				id bigint unsigned not null auto_increment,
+				mode varchar(10) not null default 'cron',
+				started_at datetime not null,
+				finished_at datetime not null,
+				total int not null default 0,
+				succeeded int not null default 0,
+				failed int not null default 0,
+				fallback int not null default 0,
+				skipped int not null default 0,
+				duration_ms bigint not null default 0,
+				primary key (id),
+				key started_at (started_at)
+			) engine=InnoDB default charset=utf8`,
+			`create table if not exists collection_run_routers (
+				id bigint unsigned not null auto_increment,
+				run_id bigint unsigned not null,
+				code varchar(10) not null,
+				wanip varchar(15) not null default '',
+				gateway varchar(15) not null default '',
+				fallback tinyint(1) not null default 0,
+				status varchar(10) not null,
+				error_text text,
+				clients int not null default 0,
+				started_at datetime not null,
+				duration_ms bigint not null default 0,
+				primary key (id),
+				key run_id (run_id),
+				key code_started_at (code, started_at)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists collection_run_routers`,
+			`drop table if exists collection_runs`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "router inventory",
+		Up: []string{
+			`alter table routers
+				add column model varchar(100) not null default '',
+				add column serial varchar(50) not null default '',
+				add column firmware varchar(50) not null default '',
+				add column lan_mac varchar(17) not null default '',
+				add column uptime bigint not null default 0,
+				add column last_contact varchar(19) not null default '',
+				add column ap_clients int not null default 0,
+				add column inventory_at varchar(19) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers
+				drop column model,
+				drop column serial,
+				drop column firmware,
+				drop column lan_mac,
+				drop column uptime,
+				drop column last_contact,
+				drop column ap_clients,
+				drop column inventory_at`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "client medium",
+		Up: []string{
+			`alter table client_sightings
+				add column medium varchar(10) not null default 'wired',
+				add column ssid varchar(64) not null default '',
+				add column band varchar(10) not null default '',
+				add column channel varchar(10) not null default '',
+				add column snr int not null default 0,
+				add column speed int not null default 0,
+				add column auth varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings
+				drop column medium,
+				drop column ssid,
+				drop column band,
+				drop column channel,
+				drop column snr,
+				drop column speed,
+				drop column auth`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "client class",
+		Up: []string{
+			`alter table client_sightings add column class varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings drop column class`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "client vendor",
+		Up: []string{
+			`alter table client_sightings
+				add column vendor varchar(100) not null default '',
+				add column random tinyint(1) not null default 0`,
+		},
+		Down: []string{
+			`alter table client_sightings
+				drop column vendor,
+				drop column random`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "router transport",
+		Up: []string{
+			`alter table routers add column transport varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers drop column transport`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "user sessions",
+		Up: []string{
+			//id为会话token的sha256，token只保存在浏览器的cookie中
+			`create table if not exists sessions (
+				id char(64) not null,
+				user varchar(100) not null,
+				created_at datetime not null,
+				expires_at datetime not null,
+				primary key (id),
+				key user (user),
+				key expires_at (expires_at)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists sessions`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "session source",
+		Up: []string{
+			//source为local或ldap，ldap用户的角色在登录时确定
+			`alter table sessions
+				add column source varchar(10) not null default 'local',
+				add column role varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table sessions
+				drop column source,
+				drop column role`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "user roles",
+		Up: []string{
+			//逗号分隔的角色名称，角色在aruba_query的配置中定义
+			`alter table users add column roles varchar(255) not null default ''`,
+			`alter table sessions modify column role varchar(255) not null default ''`,
+		},
+		Down: []string{
+			`alter table users drop column roles`,
+			`alter table sessions modify column role varchar(10) not null default ''`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "api tokens",
+		Up: []string{
+			//hash为token的sha256，token只在创建时显示一次；expires_at为null时不过期
+			`create table if not exists api_tokens (
+				id char(16) not null,
+				user varchar(100) not null,
+				name varchar(100) not null default '',
+				hash char(64) not null,
+				scopes varchar(20) not null default 'read',
+				source varchar(10) not null default 'local',
+				role varchar(255) not null default '',
+				created_at datetime not null,
+				expires_at datetime null,
+				last_used_at datetime null,
+				primary key (id),
+				unique key hash (hash),
+				key user (user)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists api_tokens`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "audit log",
+		Up: []string{
+			//路由器和用户的修改记录，actor_type为user、token、collector、system或cli，changes为修改前后的json
+			`create table if not exists audit_log (
+				id bigint not null auto_increment,
+				created_at datetime not null,
+				actor_type varchar(10) not null,
+				actor varchar(100) not null,
+				token char(16) not null default '',
+				ip varchar(45) not null default '',
+				object varchar(10) not null,
+				target varchar(100) not null,
+				action varchar(10) not null,
+				changes text not null,
+				primary key (id),
+				key created_at (created_at),
+				key object_target (object, target)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists audit_log`,
+		},
+	},
+}
+
+//旧版本由db/aruba.sql建立的数据库没有schema_version，routers缺少autoupdate列，
+//template_client只是每个路由器客户端表的模板，使用client_sightings后不再需要
+func adoptLegacyMysql(db *sql.DB) error {
+	var columns, autoupdate int
+	err := db.QueryRow(`select count(*), coalesce(sum(column_name = 'autoupdate'), 0) from information_schema.columns
+	where table_schema = database() and table_name = 'routers'`).Scan(&columns, &autoupdate)
+	if err != nil {
+		return err
+	}
+	if columns > 0 && autoupdate == 0 {
+		if _, err = db.Exec(`alter table routers add column autoupdate tinyint(1) not null default 1`); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`drop table if exists template_client`)
+	return err
 }
 
 //用于初始化数据库和连接路由器
@@ -28,12 +347,26 @@ type Router struct {
 	Area       string `json:"area"`
 	SP         string `json:"servcie_provider"`
 	AutoUpdate int    `json:"auto_update"`
+	//采集时执行命令的方式：rest、cgi或者ssh，为空时根据rap3的api选择
+	Transport string `json:"transport"`
+
+	//airwave中的ap资产信息，每次刷新路由器列表时更新
+	Model       string `json:"model"`
+	Serial      string `json:"serial"`
+	Firmware    string `json:"firmware"`
+	LanMAC      string `json:"lan_mac"`
+	Uptime      int64  `json:"uptime"`
+	LastContact string `json:"last_contact"`
+	APClients   int    `json:"ap_clients"`
+	InventoryAt string `json:"inventory_at"`
 	/*
 		User     string `json:"user"`
 		Password string `json:"password"`
 	*/
 
 	status bool
+	//获取到该路由器的airwave
+	airwave *Airwave
 }
 
 //转换Code为大写字母
@@ -43,8 +376,8 @@ func ToUpper(r *Router) *Router {
 }
 
 //添加router信息到routers
-func InsertRouters(db *sql.DB, rs []*Router) error {
-	tx, err := db.Begin()
+func (s *sqlStore) InsertRouters(rs []*Router) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
@@ -52,7 +385,8 @@ func InsertRouters(db *sql.DB, rs []*Router) error {
 
 	stmt, err := tx.Prepare(query)
 	if err != nil {
-		return nil
+		tx.Rollback()
+		return err
 	}
 	defer stmt.Close()
 
@@ -70,21 +404,22 @@ func InsertRouters(db *sql.DB, rs []*Router) error {
 	return tx.Commit()
 }
 
-func UpdateRouter(db *sql.DB, r *Router) error {
+func (s *sqlStore) UpdateRouter(r *Router) error {
 	r = ToUpper(r)
-	_, err := db.Exec(`update routers set name=?, gateway=?, wanip=?, area=?, autoupdate=? where code = ?`, r.Name, r.GateWay, r.Wanip, r.Area, r.AutoUpdate, r.Code)
+	_, err := s.db.Exec(`update routers set name=?, gateway=?, wanip=?, area=?, autoupdate=? where code = ?`, r.Name, r.GateWay, r.Wanip, r.Area, r.AutoUpdate, r.Code)
 	return err
 }
 
-func UpdateRouterSP(db *sql.DB, r *Router) error {
+func (s *sqlStore) UpdateRouterSP(r *Router) error {
 	r = ToUpper(r)
-	_, err := db.Exec(`update routers set sp=? where code = ?`, r.SP, r.Code)
+	_, err := s.db.Exec(`update routers set sp=? where code = ?`, r.SP, r.Code)
 	return err
 }
 
-func DeleteRouter(db *sql.DB, r *Router) error {
+//删除路由器及其客户端记录
+func (s *sqlStore) DeleteRouter(r *Router) error {
 	r = ToUpper(r)
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
@@ -92,24 +427,23 @@ func DeleteRouter(db *sql.DB, r *Router) error {
 	if _, err = tx.Exec(`delete from routers where code = ?`, r.Code); err != nil {
 		return err
 	}
-	if _, err = tx.Exec(`drop table IF EXITS ?`, r.Code); err != nil {
+	if _, err = tx.Exec(`delete from client_sightings where code = ?`, r.Code); err != nil {
 		return err
 	}
 	return tx.Commit()
-
 }
 
 //从tab表获取router列表
-func SelectRouters(db *sql.DB) ([]*Router, error) {
+func (s *sqlStore) SelectRouters() ([]*Router, error) {
 	var rs = make([]*Router, 0)
-	rows, err := db.Query(`select code, name, gateway, wanip, area, sp, autoupdate from routers`)
+	rows, err := s.db.Query(`select code, name, gateway, wanip, area, sp, autoupdate, transport from routers`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var r = new(Router)
-		if err = rows.Scan(&r.Code, &r.Name, &r.GateWay, &r.Wanip, &r.Area, &r.SP, &r.AutoUpdate); err != nil {
+		if err = rows.Scan(&r.Code, &r.Name, &r.GateWay, &r.Wanip, &r.Area, &r.SP, &r.AutoUpdate, &r.Transport); err != nil {
 			return nil, err
 		}
 		rs = append(rs, r)
@@ -120,79 +454,85 @@ func SelectRouters(db *sql.DB) ([]*Router, error) {
 	return rs, nil
 }
 
-//根据routers列表创建每个表
-func CreateTables(db *sql.DB, rs []*Router) error {
-	tx, err := db.Begin()
+//更新路由器的ap资产信息
+func (s *sqlStore) UpdateInventory(rs []*Router) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	for i := 0; i < len(rs); i++ {
-		r := ToUpper(rs[i])
-		var query = fmt.Sprintf("create table IF NOT EXISTS %s like template_client", r.Code)
-		_, err := tx.Exec(query)
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`update routers set model=?, serial=?, firmware=?, lan_mac=?, uptime=?,
+	last_contact=?, ap_clients=?, inventory_at=? where code = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	for _, r := range rs {
+		r.InventoryAt = now
+		_, err = stmt.Exec(r.Model, r.Serial, r.Firmware, r.LanMAC, r.Uptime,
+			r.LastContact, r.APClients, r.InventoryAt, strings.ToUpper(r.Code))
 		if err != nil {
-			if e1 := tx.Rollback(); e1 != nil {
-				err = e1
-			}
 			return err
 		}
 	}
 	return tx.Commit()
 }
 
-func Diff(db *sql.DB, rs []*Router) ([]*Router, error) {
-	dbrouters, err := SelectRouters(db)
+//为client_sightings建立from到to之间每个月的分区
+func (m *Mysql) EnsurePartitions(from, to time.Time) error {
+	//分区名为p200601，取最后一个已有的分区
+	var last sql.NullString
+	err := m.db.QueryRow(`select max(partition_name) from information_schema.partitions
+	where table_schema = database() and table_name = 'client_sightings' and partition_name <> 'pmax'`).Scan(&last)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	var routers = make([]*Router, 0)
-DIFF:
-	for _, r := range rs {
-		for _, dbr := range dbrouters {
-			if r.Code == dbr.Code {
-				r.Name = dbr.Name
-				r.GateWay = dbr.GateWay
-				if dbr.Area != "" {
-					r.Area = dbr.Area
-				}
-				r.AutoUpdate = dbr.AutoUpdate
-				continue DIFF
-			}
+	var parts []string
+	month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.Local)
+	for ; !month.After(to); month = month.AddDate(0, 1, 0) {
+		name := month.Format("p200601")
+		if last.Valid && name <= last.String {
+			continue
 		}
-		routers = append(routers, r)
-	}
-	return routers, nil
-}
-
-func SyncRouters(db *sql.DB, rs []*Router) error {
-	if err := CreateTables(db, rs); err != nil {
-		return err
+		parts = append(parts, fmt.Sprintf("partition %s values less than (unix_timestamp('%s'))",
+			name, month.AddDate(0, 1, 0).Format("2006-01-02")))
 	}
-	if err := InsertRouters(db, rs); err != nil {
-		return err
+	if len(parts) == 0 {
+		return nil
 	}
-	return nil
+	parts = append(parts, "partition pmax values less than maxvalue")
+	_, err = m.db.Exec(fmt.Sprintf("alter table client_sightings reorganize partition pmax into (%s)", strings.Join(parts, ", ")))
+	return err
 }
 
-//添加client信息到表tab
-func InsertClients(db *sql.DB, tab string, cs []*Client) error {
-	tx, err := db.Begin()
+//添加路由器code的client信息到client_sightings
+func (s *sqlStore) InsertClients(code string, cs []*Client) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	var query = fmt.Sprintf(`insert into %s (name, ip, mac, os, network, ap, role)
-	values (?, ?, ?, ?, ?, ?, ?)`, tab)
+	var query = `insert into client_sightings (code, name, ip, mac, os, network, ap, role,
+	medium, ssid, band, channel, snr, speed, auth, class, vendor, random)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	stmt, err := tx.Prepare(query)
 	if err != nil {
-		return nil
+		tx.Rollback()
+		return err
 	}
 	defer stmt.Close()
 
+	code = strings.ToUpper(code)
 	for i := 0; i < len(cs); i++ {
 		c := cs[i]
-		_, err = stmt.Exec(c.Name, c.IP, c.MAC, c.OS, c.Network, c.AP, c.Role)
+		medium := c.Medium
+		if medium == "" {
+			medium = MediumWired
+		}
+		_, err = stmt.Exec(code, c.Name, c.IP, c.MAC, c.OS, c.Network, c.AP, c.Role,
+			medium, c.SSID, c.Band, c.Channel, c.Signal, c.Speed, c.Auth, c.Class, c.Vendor, c.Random)
 		if err != nil {
 			if e1 := tx.Rollback(); e1 != nil {
 				err = e1
@@ -203,17 +543,21 @@ func InsertClients(db *sql.DB, tab string, cs []*Client) error {
 	return tx.Commit()
 }
 
-//使用month(timestamp)
-func SelectClientsByTime(db *sql.DB, tab, begin, end string) ([]*Client, error) {
-	var query = fmt.Sprintf(`select name, ip, mac, os, network, ap, role from %s where time between ? and ?`, tab)
-	rows, err := db.Query(query, begin, end)
+//查询路由器code在begin和end之间的client
+func (s *sqlStore) SelectClientsByTime(code, begin, end string) ([]*Client, error) {
+	rows, err := s.db.Query(`select name, ip, mac, os, network, ap, role,
+	medium, ssid, band, channel, snr, speed, auth, class, vendor, random from client_sightings
+	where code = ? and time between ? and ?`, strings.ToUpper(code), begin, end)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	var cs = make([]*Client, 0)
 	for rows.Next() {
 		var c = new(Client)
-		if err = rows.Scan(&c.Name, &c.IP, &c.MAC, &c.OS, &c.Network, &c.AP, &c.Role); err != nil {
+		if err = rows.Scan(&c.Name, &c.IP, &c.MAC, &c.OS, &c.Network, &c.AP, &c.Role,
+			&c.Medium, &c.SSID, &c.Band, &c.Channel, &c.Signal, &c.Speed, &c.Auth, &c.Class,
+			&c.Vendor, &c.Random); err != nil {
 			return nil, err
 		}
 		cs = append(cs, c)
@@ -228,28 +572,31 @@ type UserPassword struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Admin    bool   `json:"admin"`
+	//逗号分隔的角色名称，为空时admin为false的用户是viewer
+	Roles string `json:"roles"`
 }
 
-func InsertUser(db *sql.DB, user *UserPassword) error {
-	_, err := db.Exec(`insert into users (user, password, admin) values (?, ?, ?)`, user.User, user.Password, user.Admin)
+func (s *sqlStore) InsertUser(user *UserPassword) error {
+	_, err := s.db.Exec(`insert into users (user, password, admin, roles) values (?, ?, ?, ?)`,
+		user.User, user.Password, user.Admin, user.Roles)
 	return err
 }
 
-func DeleteUser(db *sql.DB, username string) error {
-	_, err := db.Exec(`delete from users where user = ?`, username)
+func (s *sqlStore) DeleteUser(username string) error {
+	_, err := s.db.Exec(`delete from users where user = ?`, username)
 	return err
 }
 
-func UpdateUser(db *sql.DB, user *UserPassword) error {
-	_, err := db.Exec(`update users set user=?, password=?, admin=?`,
-		user.User, user.Password, user.Admin)
+func (s *sqlStore) UpdateUser(user *UserPassword) error {
+	_, err := s.db.Exec(`update users set password=?, admin=?, roles=? where user = ?`,
+		user.Password, user.Admin, user.Roles, user.User)
 	return err
 }
 
-func SelectUser(db *sql.DB, username string) (*UserPassword, error) {
-	row := db.QueryRow(`select user, password, admin from users where user = ?`, username)
+func (s *sqlStore) SelectUser(username string) (*UserPassword, error) {
+	row := s.db.QueryRow(`select user, password, admin, roles from users where user = ?`, username)
 	var up = new(UserPassword)
-	if err := row.Scan(&up.User, &up.Password, &up.Admin); err != nil {
+	if err := row.Scan(&up.User, &up.Password, &up.Admin, &up.Roles); err != nil {
 		return nil, err
 	}
 	return up, nil
@@ -1,18 +1,15 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-var (
-	mysqlHost     = "127.0.0.1"
-	mysqlPort     = "3306"
-	mysqlUser     = "root"
-	mysqlPassword = "123789"
-	mysqlDatabase = "aruba"
-)
-
 var routerTest = &Router{
 	Code: "531",
 }
@@ -45,14 +42,30 @@ var userTest = &UserPassword{
 	Admin:    true,
 }
 
-var dbTest = OpenMysql(mysqlHost, mysqlPort, mysqlUser, mysqlPassword, mysqlDatabase)
+//测试使用临时目录中的sqlite3数据库
+var dbTest = openTestStore()
+
+func openTestStore() Store {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err = s.MigrateUp(); err != nil {
+		log.Fatalln(err)
+	}
+	return s
+}
 
 func TestInsertRouter(t *testing.T) {
-	if err := InsertRouters(dbTest, []*Router{routerTest}); err != nil {
+	if err := dbTest.InsertRouters([]*Router{routerTest}); err != nil {
 		t.Fatalf("%s\n", err)
 		return
 	}
-	t.Logf("insert routers%s\n", routerTest)
+	t.Logf("insert routers: %#v\n", routerTest)
 }
 
 func TestUpdateRouter(t *testing.T) {
@@ -62,7 +75,7 @@ func TestUpdateRouter(t *testing.T) {
 		GateWay: "101.22.29.1",
 		Area:    "531",
 	}
-	err := UpdateRouter(dbTest, rt)
+	err := dbTest.UpdateRouter(rt)
 	if err != nil {
 		t.Fatalf("UpdateRouter: %s\n", err)
 		return
@@ -70,20 +83,47 @@ func TestUpdateRouter(t *testing.T) {
 	t.Logf("UpdateRouter: %#v\n", rt)
 }
 
+func TestUpdateInventory(t *testing.T) {
+	var rt = &Router{
+		Code:      "531",
+		Model:     "Aruba RAP-3WN",
+		Firmware:  "6.4.4.8",
+		Uptime:    3600,
+		APClients: 2,
+	}
+	if err := dbTest.UpdateInventory([]*Router{rt}); err != nil {
+		t.Fatalf("UpdateInventory: %s\n", err)
+	}
+	var (
+		firmware string
+		uptime   int64
+	)
+	err := dbTest.(*Sqlite).db.QueryRow(`select firmware, uptime from routers where code = '531'`).Scan(&firmware, &uptime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firmware != rt.Firmware || uptime != rt.Uptime {
+		t.Errorf("inventory of 531: %s, %d", firmware, uptime)
+	}
+}
+
 func TestSelectRoutersAndTables(t *testing.T) {
-	rs, err := SelectRouters(dbTest)
+	rs, err := dbTest.SelectRouters()
 	if err != nil {
 		t.Fatalf("SelectRouter: %s\n", err)
 		return
 	}
-	err = CreateTables(dbTest, rs)
-	if err != nil {
-		t.Fatalf("CreateTables: %s\n", err)
+	if len(rs) != 1 {
+		t.Fatalf("SelectRouter: got %d routers, want 1\n", len(rs))
+	}
+	now := time.Now()
+	if err = dbTest.EnsurePartitions(now, now.AddDate(0, 1, 0)); err != nil {
+		t.Fatalf("EnsurePartitions: %s\n", err)
 	}
 }
 
 func TestInsertClients(t *testing.T) {
-	err := InsertClients(dbTest, tabTest, csTest)
+	err := dbTest.InsertClients(tabTest, csTest)
 	if err != nil {
 		t.Fatalf("InsertClients: %s\n", err)
 		return
@@ -93,21 +133,49 @@ func TestInsertClients(t *testing.T) {
 	}
 }
 
+//没有建表时返回错误，并且不占用唯一的连接
+func TestInsertPrepareError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSqlite(filepath.Join(dir, "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.InsertRouters([]*Router{{Code: "531"}}); err == nil {
+		t.Error("InsertRouters: want error without routers table")
+	}
+	if err = s.InsertClients(tabTest, csTest); err == nil {
+		t.Error("InsertClients: want error without client_sightings table")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err = s.db.ExecContext(ctx, `select 1`); err != nil {
+		t.Fatalf("transaction left open: %s", err)
+	}
+}
+
 func TestSelectClients(t *testing.T) {
 	ts := time.Now()
 	tt := ts.Format("2006-01-02")
-	cs, err := SelectClients(dbTest, tabTest, tt)
+	cs, err := dbTest.SelectClientsByTime(tabTest, tt, ts.AddDate(0, 0, 1).Format("2006-01-02"))
 	if err != nil {
 		t.Fatalf("SelectClients: %s\n", err)
 		return
 	}
+	if len(cs) != len(csTest) {
+		t.Fatalf("SelectClients: got %d clients, want %d\n", len(cs), len(csTest))
+	}
 	for i := 0; i < len(cs); i++ {
 		t.Logf("SelectClients: %#v, %s, %#v\n", tabTest, tt, cs[i])
 	}
 }
 
 func TestInsertUser(t *testing.T) {
-	err := InsertUser(dbTest, userTest)
+	err := dbTest.InsertUser(userTest)
 	if err != nil {
 		t.Fatalf("InsertUser: %s\n", err)
 		return
@@ -121,7 +189,7 @@ func TestUpdateUser(t *testing.T) {
 		Password: "pass",
 		Admin:    false,
 	}
-	err := UpdateUser(dbTest, ut1)
+	err := dbTest.UpdateUser(ut1)
 	if err != nil {
 		t.Fatalf("UpdateUser: %s\n", err)
 		return
@@ -130,7 +198,7 @@ func TestUpdateUser(t *testing.T) {
 }
 
 func TestSelectUser(t *testing.T) {
-	up, err := SelectUser(dbTest, userTest.User)
+	up, err := dbTest.SelectUser(userTest.User)
 	if err != nil {
 		t.Fatalf("SelectUser: %s\n", err)
 		return
@@ -139,7 +207,7 @@ func TestSelectUser(t *testing.T) {
 }
 
 func TestDeleteUser(t *testing.T) {
-	err := DeleteUser(dbTest, userTest.User)
+	err := dbTest.DeleteUser(userTest.User)
 	if err != nil {
 		t.Fatalf("DeleteUser: %s\n", err)
 		return
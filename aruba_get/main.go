@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"strings"
+	"syscall"
 )
 
 const (
@@ -21,32 +22,60 @@ var (
 	//版本信息
 	VERSION = flag.Bool("version", false, "打印版本信息")
 	TEST    = flag.Bool("test", false, "测试配置文件")
+	//数据库版本迁移
+	MIGRATE = flag.String("migrate", "", "数据库版本迁移: up|down|status, sightings复制旧版本每个路由器的客户端表到client_sightings")
+	//导入IEEE的oui列表
+	UPDATEOUI = flag.String("update-oui", "", "导入IEEE的oui.csv到etc/oui.csv，多个文件以逗号分隔")
 )
 
 //配置JSON模板
 var cfgT = &Config{
-	Debug:   false,
-	Hour:    10,
-	Minute:  20,
-	Timeout: 10,
-	Airwave: &Airwave{
-		Addr:       "5.5.5.16",
-		User:       "user",
-		Password:   "password",
-		ApFolderID: 32,
+	Debug:  false,
+	Hour:   10,
+	Minute: 20,
+	Schedule: []string{
+		"*/30 0-4 * * *",
+		"0 5 * * *",
+	},
+	Timezone:       "Asia/Shanghai",
+	Timeout:        10,
+	MaxConcurrency: 20,
+	Airwaves: []*Airwave{
+		&Airwave{
+			Addr:        "5.5.5.16",
+			User:        "user",
+			Password:    "password",
+			ApFolderIDs: []int{32, 33},
+			Label:       "north",
+		},
+		&Airwave{
+			Addr:        "5.5.6.16",
+			User:        "user",
+			Password:    "password",
+			ApFolderIDs: []int{12},
+			Label:       "south",
+		},
 	},
 	Rap3: &Rap3{
 		Path:   "swarm.cgi",
 		User:   "admin",
 		Passwd: "passwd",
 		Cmd:    `%27show%20clients%20wired%27`,
-		OnlyPC: true,
+		//为true时只保存类型为pc的客户端，没有分类的客户端也不保存
+		OnlyPC: false,
 		IncludeMac: []string{
 			`c0:3f:d5:7e:fd:ee`,
 			`44:37:e6:ce:78:8a`,
 		},
 	},
-	Database: &MysqlDB{
+	Classify: []*Rule{
+		&Rule{Class: ClassPOS, IP: []string{"10.62.0.0/16"}, Role: "^pos"},
+		&Rule{Class: ClassPrinter, OS: "(?i)printer", OUI: []string{"00:00:48"}},
+		&Rule{Class: ClassPhone, OS: "(?i)^(ios|android)"},
+		&Rule{Class: ClassIoT, Name: "(?i)^(cam|sensor)-"},
+	},
+	Database: &DBConfig{
+		Driver:   "mysql",
 		Host:     "127.0.0.1",
 		Port:     "3306",
 		User:     "root",
@@ -78,6 +107,16 @@ func main() {
 		return
 	}
 
+	ouiFile := filepath.Join(confDir, "oui.csv")
+	if *UPDATEOUI != "" {
+		n, err := UpdateOUI(ouiFile, strings.Split(*UPDATEOUI, ",")...)
+		if err != nil {
+			log.Fatalln("update oui error: ", err)
+		}
+		fmt.Printf("%d oui assignments saved to %s\n", n, ouiFile)
+		return
+	}
+
 	CONF := filepath.Clean(filepath.Join(confDir, "config.json"))
 
 	cfg, err := ReadConfigFile(CONF)
@@ -87,120 +126,164 @@ func main() {
 
 	if *TEST {
 		switch {
-		case cfg.Airwave == nil:
+		case len(cfg.airwaves()) == 0:
 			fmt.Println("configure contain invaild airwave config")
-		case cfg.Rap3 == nil:
+		case cfg.checkCollector() != nil:
+			fmt.Println("configure contain invalid collector:", cfg.checkCollector())
+		case cfg.Rap3 == nil && cfg.Collector != CollectorAirwave:
 			fmt.Println("configure contain invalid rap3 config")
+		case cfg.LoadClassifier() != nil:
+			fmt.Println("configure contain invalid", cfg.LoadClassifier())
 		case cfg.Database == nil:
 			fmt.Println("configure contain invalid database config")
-		case cfg.Hour < 0 || cfg.Hour > 4:
-			fmt.Println("hour must between 0 and 4")
 		default:
+			specs, loc, err := cfg.Cron()
+			if err == nil {
+				_, err = Cron(specs, loc)
+			}
+			if err != nil {
+				fmt.Println("configure contain invalid schedule:", err)
+				return
+			}
 			fmt.Printf("%s is ok\n", CONF)
 		}
 		return
 	}
 
+	if *MIGRATE != "" {
+		if err = cfg.OpenStore(); err != nil {
+			log.Fatalln("open database error: ", err)
+		}
+		defer cfg.store.Close()
+		if *MIGRATE == "sightings" {
+			if err = CheckSchema(cfg.store); err == nil {
+				err = MigrateSightings(cfg.store, os.Stdout)
+			}
+		} else {
+			err = RunMigrate(cfg.store, *MIGRATE, os.Stdout)
+		}
+		if err != nil {
+			log.Fatalln("migrate error: ", err)
+		}
+		return
+	}
+
 	fi := filepath.Join(tmpDir, "aruba.log")
 
 	var logger = NewLogger(fi)
 	logger.Printf("%s started\n", os.Args[0])
 	logger.Printf("version: %s\n", version)
-	pid, pidFile := os.Getpid(), filepath.Join(tmpDir, "aruba.pid")
-	logger.Printf("pid: %d, path: %s\n", pid, pidFile)
-	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d", pid)), 0666); err != nil {
-		logger.Printf("write pid: %s\n", err)
-		return
+	//log.Fatalln不执行defer，run返回后pid文件已经删除
+	if err = run(cfg, logger, filepath.Join(tmpDir, "aruba.pid"), ouiFile); err != nil {
+		logger.Println(err)
+		log.Fatalln(err)
 	}
+}
 
-	//设置数据库连接
-	cfg.OpenMysql()
-	logger.Printf("connect to mysql %s:%s\n", cfg.Database.Host, cfg.Database.Port)
-	//启动定时器
-	tick, err := Cron(cfg.Hour, cfg.Minute)
+//以守护进程运行，返回错误前删除pid文件并关闭数据库
+func run(cfg *Config, logger *log.Logger, pidFile, ouiFile string) error {
+	logger.Printf("pid: %d, path: %s\n", os.Getpid(), pidFile)
+	//pid文件加锁，防止同时运行多个实例重复插入数据
+	pf, err := LockPidFile(pidFile)
 	if err != nil {
-		log.Fatalln(err)
+		return fmt.Errorf("lock pid file: %s", err)
 	}
+	defer pf.Remove()
 
-	logger.Printf("cron_jobs at %d:%d\n", cfg.Hour, cfg.Minute)
-
+	//设置数据库连接
+	if err = cfg.OpenStore(); err != nil {
+		return fmt.Errorf("open database error: %s", err)
+	}
+	defer cfg.store.Close()
+	if cfg.Database.Driver == "sqlite3" {
+		logger.Printf("open sqlite3 %s\n", cfg.Database.Path)
+	} else {
+		logger.Printf("connect to mysql %s:%s\n", cfg.Database.Host, cfg.Database.Port)
+	}
+	//数据库版本必须与程序一致
+	if err = CheckSchema(cfg.store); err != nil {
+		return err
+	}
+	if err = cfg.checkCollector(); err != nil {
+		return err
+	}
+	if err = cfg.LoadClassifier(); err != nil {
+		return err
+	}
+	//oui列表错误时不设置厂商
+	if cfg.ouis, err = LoadOUI(ouiFile); err != nil {
+		logger.Printf("load oui from %s error: %s\n", ouiFile, err)
+	} else {
+		logger.Printf("load %d oui assignments\n", cfg.ouis.Len())
+	}
 	client := NewClient(cfg.Timeout)
-	var wg sync.WaitGroup
+	ctx := notifyContext(logger)
 
-	for range tick {
-		//打印日志
-		logger.Println("--------")
-		logger.Println("starting connect remote airwave")
+	//以systemd Type=notify运行时通知启动完成并启动watchdog
+	if ok, err := Notify("READY=1"); err != nil {
+		logger.Printf("notify systemd: %s\n", err)
+	} else if ok {
+		logger.Println("notify systemd ready")
+	}
+	cfg.watchdog = NewWatchdog(logger)
+	defer cfg.watchdog.Stop()
+	if cfg.Metrics != "" {
+		go func() {
+			if err := ServeMetrics(ctx, cfg.Metrics, logger); err != nil {
+				logger.Printf("metrics: %s\n", err)
+			}
+		}()
+	}
 
-		awRs, err := cfg.Airwave.GetRouters(client)
-		if err != nil {
-			logger.Println("get routers from airwave error: ", err)
+	//持续轮询模式
+	if cfg.Poll != nil {
+		logger.Printf("polling routers every %d seconds, jitter %d seconds\n", cfg.Poll.Interval, cfg.Poll.Jitter)
+		cfg.RunPoll(ctx, client, logger)
+		logger.Println("aruba_get stopped")
+		return nil
+	}
+
+	//启动定时器
+	specs, loc, err := cfg.Cron()
+	if err != nil {
+		return err
+	}
+	tick, err := Cron(specs, loc)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("cron_jobs at %q, timezone %s\n", specs, loc)
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Println("aruba_get stopped")
+			return nil
+		case <-cfg.watchdog.C():
+			//等待下一次采集，主循环没有卡住
+			cfg.watchdog.Ping()
 			continue
+		case <-tick:
 		}
-		logger.Printf("get routers number: %d\n", len(awRs))
+		//打印日志
 		logger.Println("--------")
-
-		rss, err := Diff(cfg.db, awRs)
+		awRs, _, err := cfg.RefreshRouters(ctx, client, logger)
 		if err != nil {
-			logger.Println("diff routers error: ", err)
+			logger.Println(err)
 			continue
 		}
-		for i := 0; i < len(rss); i++ {
-			logger.Printf("new router found, code: %s\n", rss[i].Code)
-		}
-		if err = SyncRouters(cfg.db, rss); err != nil {
-			logger.Println("add new routers into database error: ", err)
-			continue
-		}
-		logger.Println("add new routers success")
 		logger.Println("--------")
-		logger.Println("update router and show client wired starting")
-		for _, r := range awRs {
-			if r.AutoUpdate != 0 {
-				err = UpdateRouter(cfg.db, r)
-				if err != nil {
-					logger.Printf("update router %s failed: %s\n", r.Code, err)
-				}
-				if cfg.Debug {
-					logger.Printf("update router %s success\n", r.Code)
-				}
-			}
-			if !r.status {
-				logger.Printf("%s status is %v, skip\n", r.Code, r.status)
-				continue
-			}
-			wg.Add(1)
-			//为每个路由器启动一个goroutine
-			go func(client *http.Client, router *Router) {
-				defer wg.Done()
-				//获取在线的客户端
-				cs, err := cfg.Rap3.GetClientsWired(client, router.Wanip)
-				if err != nil {
-					logger.Printf("code %s show clients wired failed by wan ip %s\n", router.Code, router.Wanip)
-					if router.GateWay == "" {
-						logger.Printf("code %s gateway is not exists\n", router.Code)
-						return
-					}
-
-					logger.Printf("code %s retry by gateway %s\n", router.Code, router.GateWay)
-					cs, err = cfg.Rap3.GetClientsWired(client, router.GateWay)
-					if err != nil {
-						logger.Printf("code %s show clients wired retry use gateway failed\n", router.Code)
-						return
-					}
-					logger.Printf("code %s retry by gateway success\n", router.Code)
-				} else if cfg.Debug {
-					logger.Printf("code %s show clients wired by wan ip %s\n", router.Code, router.GateWay)
-				}
-				//插入数据到数据库表，表名为r.Code
-				if err = InsertClients(cfg.db, router.Code, cs); err != nil {
-					logger.Printf("code %s insert data failed: %s\n", router.Code, err)
-				} else if cfg.Debug {
-					logger.Printf("code %s insert data success, first: %s\n", router.Code, cs)
-				}
-			}(client, r)
+		var result *Run
+		if cfg.Collector == CollectorAirwave {
+			logger.Println("update router and get clients from airwave starting")
+			result = cfg.CollectAirwave(ctx, client, awRs, logger)
+		} else {
+			logger.Println("update router and show client wired starting")
+			result = cfg.CollectAll(ctx, client, awRs, logger)
 		}
-		wg.Wait()
+		logger.Printf("summary: %s\n", &result.RunSummary)
+		cfg.SaveRun(result, logger)
 
 		logger.Println("--------")
 		/*
@@ -213,7 +296,7 @@ func main() {
 					logger.Printf("%s do not need auto update\n", r.Code)
 					continue
 				}
-				if err = UpdateRouterSP(cfg.db, r); err != nil {
+				if err = cfg.store.UpdateRouterSP(r); err != nil {
 					logger.Printf("when update %s sp error: %s\n", r.Code, err)
 					continue
 				}
@@ -225,3 +308,20 @@ func main() {
 		logger.Println("--------")
 	}
 }
+
+//收到SIGINT或SIGTERM时取消ctx，正在进行的采集结束并保存后退出，再次收到时立即退出
+func notifyContext(logger *log.Logger) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logger.Printf("received %s, stopping\n", s)
+		Notify("STOPPING=1")
+		cancel()
+		s = <-sig
+		logger.Printf("received %s again, exit now\n", s)
+		os.Exit(1)
+	}()
+	return ctx
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//aruba_get自己的指标，不包括go运行时的指标
+var metrics = prometheus.NewRegistry()
+
+//默认的耗时区间，单位秒
+var defaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//aruba_get的指标
+var (
+	factory = promauto.With(metrics)
+
+	routersDiscovered = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "aruba_routers_discovered", Help: "Routers returned by the last Airwave refresh."})
+	airwaveErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_airwave_errors_total", Help: "Failed router list requests by Airwave server."}, []string{"airwave"})
+	routersStatus = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aruba_routers_status", Help: "Routers returned by the last Airwave refresh by monitoring status."}, []string{"status"})
+	collectDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Name: "aruba_collect_duration_seconds", Help: "Time to collect and store the clients of one router.", Buckets: defaultBuckets})
+	collectLast = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aruba_collect_last_duration_seconds", Help: "Duration of the last collection of each router."}, []string{"code"})
+	collectLastSuccess = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aruba_collect_last_success_timestamp_seconds", Help: "Unix time of the last successful collection of each router."}, []string{"code"})
+	collectErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_collect_errors_total", Help: "Failed collections of each router."}, []string{"code"})
+	gatewayFallbacks = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_collect_gateway_fallback_total", Help: "Collections retried via the gateway after the wan ip failed."}, []string{"code"})
+	parseWarnings = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_parse_warnings_total", Help: "Lines of router CLI output that could not be parsed."}, []string{"code"})
+	clientsInserted = factory.NewCounter(prometheus.CounterOpts{
+		Name: "aruba_clients_inserted_total", Help: "Clients inserted into client_sightings."})
+	runClients = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aruba_run_clients_inserted", Help: "Clients inserted by the last run."}, []string{"mode"})
+	runsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_runs_total", Help: "Finished collection runs."}, []string{"mode"})
+)
+
+//记录airwave返回的路由器数量和状态
+func observeRouters(rs []*Router) {
+	var up, down int
+	for _, r := range rs {
+		if r.status {
+			up++
+		} else {
+			down++
+		}
+	}
+	routersDiscovered.Set(float64(len(rs)))
+	routersStatus.WithLabelValues("up").Set(float64(up))
+	routersStatus.WithLabelValues("down").Set(float64(down))
+}
+
+//记录一个路由器的采集结果
+func observeRouterRun(rr *RouterRun) {
+	collectDuration.Observe(rr.Duration.Seconds())
+	collectLast.WithLabelValues(rr.Code).Set(rr.Duration.Seconds())
+	if rr.Fallback {
+		gatewayFallbacks.WithLabelValues(rr.Code).Inc()
+	}
+	if rr.Status == RunFailed {
+		collectErrors.WithLabelValues(rr.Code).Inc()
+		return
+	}
+	collectLastSuccess.WithLabelValues(rr.Code).Set(float64(rr.Start.Add(rr.Duration).Unix()))
+	clientsInserted.Add(float64(rr.Clients))
+}
+
+//记录一次采集
+func observeRun(run *Run) {
+	var n int
+	for _, rr := range run.Routers {
+		n += rr.Clients
+	}
+	runsTotal.WithLabelValues(run.Mode).Inc()
+	runClients.WithLabelValues(run.Mode).Set(float64(n))
+}
+
+//路由器已经从airwave删除
+func forgetRouter(code string) {
+	collectLast.DeleteLabelValues(code)
+	collectLastSuccess.DeleteLabelValues(code)
+}
+
+//prometheus文本格式的/metrics
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+//在addr上提供/metrics，ctx取消时关闭
+func ServeMetrics(ctx context.Context, addr string, logger *log.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	logger.Printf("metrics listen on %s\n", addr)
+	if err = hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
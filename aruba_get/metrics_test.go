@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+//抓取/metrics并用prometheus的解析器检查格式
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type = %q", ct)
+	}
+	var p expfmt.TextParser
+	if _, err := p.TextToMetricFamilies(strings.NewReader(w.Body.String())); err != nil {
+		t.Errorf("parse metrics: %s", err)
+	}
+	return w.Body.String()
+}
+
+//其他测试也会采集，histogram和没有标签的counter比较前后的差
+func collected(t *testing.T) (samples uint64, clients float64) {
+	mfs, err := metrics.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "aruba_collect_duration_seconds" {
+			samples = mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return samples, testutil.ToFloat64(clientsInserted)
+}
+
+func TestMetrics(t *testing.T) {
+	samples, clients := collected(t)
+	observeRouters([]*Router{
+		{Code: "M01", status: true},
+		{Code: "M02", status: true},
+		{Code: "M03", status: false},
+	})
+	observeRouterRun(&RouterRun{Code: "M01", Status: RunGateway, Fallback: true, Clients: 3,
+		Start: time.Unix(1500000000, 0), Duration: 200 * time.Millisecond})
+	observeRouterRun(&RouterRun{Code: "M02", Status: RunFailed, Duration: 2 * time.Second})
+
+	if n, c := collected(t); n-samples != 2 || c-clients != 3 {
+		t.Errorf("observed %d collections and %v clients, want 2 and 3", n-samples, c-clients)
+	}
+	body := scrape(t)
+	for _, line := range []string{
+		"# TYPE aruba_routers_discovered gauge",
+		"aruba_routers_discovered 3",
+		`aruba_routers_status{status="up"} 2`,
+		`aruba_routers_status{status="down"} 1`,
+		`aruba_collect_gateway_fallback_total{code="M01"} 1`,
+		`aruba_collect_errors_total{code="M02"} 1`,
+		`aruba_collect_last_duration_seconds{code="M02"} 2`,
+		`aruba_collect_last_success_timestamp_seconds{code="M01"} 1.5e+09`,
+		"# TYPE aruba_collect_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+	//删除的路由器不再输出
+	forgetRouter("M01")
+	if body = scrape(t); strings.Contains(body, `aruba_collect_last_success_timestamp_seconds{code="M01"}`) {
+		t.Error("metrics of removed router M01 still exported")
+	}
+}
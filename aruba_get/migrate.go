@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+//每次事务复制的行数
+const migrateBatch = 1000
+
+//旧版本的每个路由器一张表，表名即路由器code
+var legacyTable = regexp.MustCompile(`^[0-9A-Za-z_]+$`)
+
+func scanLegacyTables(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var tabs []string
+	for rows.Next() {
+		var tab string
+		if err := rows.Scan(&tab); err != nil {
+			return nil, err
+		}
+		if legacyTable.MatchString(tab) {
+			tabs = append(tabs, tab)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tabs, nil
+}
+
+//列出routers中仍然存在的旧客户端表
+func (m *Mysql) LegacyTables() ([]string, error) {
+	rows, err := m.db.Query(`select table_name from information_schema.tables
+	where table_schema = database() and table_name in (select code from routers)`)
+	if err != nil {
+		return nil, err
+	}
+	return scanLegacyTables(rows)
+}
+
+func (s *Sqlite) LegacyTables() ([]string, error) {
+	rows, err := s.db.Query(`select name from sqlite_master
+	where type = 'table' and name in (select code from routers)`)
+	if err != nil {
+		return nil, err
+	}
+	return scanLegacyTables(rows)
+}
+
+//旧表中最早一条记录的时间，表为空时返回零值
+func (s *sqlStore) OldestSighting(tab string) (time.Time, error) {
+	var t sql.NullString
+	if err := s.db.QueryRow(fmt.Sprintf("select min(time) from `%s`", tab)).Scan(&t); err != nil {
+		return time.Time{}, err
+	}
+	if !t.Valid {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", t.String, time.Local)
+}
+
+//从旧表tab复制最多batch行到client_sightings，复制和进度在同一个事务中提交
+func (s *sqlStore) MigrateTable(tab string, batch int) (n int64, done bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRow(`select last_id from sightings_migration where code = ?`, tab).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	var end sql.NullInt64
+	query := fmt.Sprintf("select max(id) from (select id from `%s` where id > ? order by id limit ?) t", tab)
+	if err = tx.QueryRow(query, last, batch).Scan(&end); err != nil {
+		return 0, false, err
+	}
+	if !end.Valid {
+		return 0, true, tx.Commit()
+	}
+
+	query = fmt.Sprintf("insert into client_sightings (code, name, ip, mac, os, network, ap, role, time) "+
+		"select ?, name, ip, mac, os, network, ap, role, time from `%s` where id > ? and id <= ?", tab)
+	res, err := tx.Exec(query, tab, last, end.Int64)
+	if err != nil {
+		return 0, false, err
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return 0, false, err
+	}
+	if _, err = tx.Exec(`replace into sightings_migration (code, last_id) values (?, ?)`, tab, end.Int64); err != nil {
+		return 0, false, err
+	}
+	return n, false, tx.Commit()
+}
+
+//复制所有旧客户端表到client_sightings，可以重复执行，进度保存在sightings_migration
+func MigrateSightings(s Store, w io.Writer) error {
+	tabs, err := s.LegacyTables()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "found %d legacy tables\n", len(tabs))
+
+	//先为最早的数据建立分区
+	var oldest = time.Now()
+	for _, tab := range tabs {
+		t, err := s.OldestSighting(tab)
+		if err != nil {
+			return fmt.Errorf("%s: %s", tab, err)
+		}
+		if !t.IsZero() && t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if err = s.EnsurePartitions(oldest, time.Now().AddDate(0, 1, 0)); err != nil {
+		return err
+	}
+
+	for _, tab := range tabs {
+		var total int64
+		for {
+			n, done, err := s.MigrateTable(tab, migrateBatch)
+			if err != nil {
+				return fmt.Errorf("%s: %s", tab, err)
+			}
+			if done {
+				break
+			}
+			total += n
+		}
+		fmt.Fprintf(w, "%s: %d rows copied\n", tab, total)
+	}
+	fmt.Fprintln(w, "migrate done, legacy tables are kept and can be dropped by hand")
+	return nil
+}
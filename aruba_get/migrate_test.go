@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateSightings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSqlite(filepath.Join(dir, "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	//旧版本的客户端表
+	if err = s.InsertRouters([]*Router{{Code: "A01"}, {Code: "A02"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{"A01", "A02"} {
+		_, err = s.db.Exec(fmt.Sprintf(`create table %s (
+			id integer primary key autoincrement,
+			name varchar(100) not null default '', ip varchar(15) not null, mac char(17) not null,
+			os varchar(50) not null default '', network varchar(10) not null default 'eth1',
+			ap char(17) not null, role varchar(50) not null, time text not null)`, code))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2500; i++ {
+		_, err = s.db.Exec(`insert into A01 (ip, mac, ap, role, time) values (?, ?, ?, ?, ?)`,
+			"10.0.0.1", fmt.Sprintf("00:00:00:00:%02x:%02x", i/256, i%256), "ap", "role", "2017-01-02 03:04:05")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//模拟中断：只复制一批
+	tabs, err := s.LegacyTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tabs) != 2 {
+		t.Fatalf("found %d legacy tables, want 2", len(tabs))
+	}
+	if _, _, err = s.MigrateTable("A01", migrateBatch); err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateSightings(s, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	//重复执行不会产生重复记录
+	if err = MigrateSightings(s, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := s.SelectClientsByTime("A01", "2017-01-01", "2017-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2500 {
+		t.Fatalf("migrated %d rows, want 2500", len(cs))
+	}
+}
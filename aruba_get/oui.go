@@ -0,0 +1,203 @@
+package main
+
+import (
+	"embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:generate go run oui_gen.go
+
+//程序内置的IEEE列表：oui.csv(MA-L)、mam.csv(MA-M)和oui36.csv(MA-S)，使用go generate从IEEE下载
+//
+//go:embed oui/*.csv
+var ieeeOUI embed.FS
+
+//mac地址前缀到厂商的对应关系，前缀为6(MA-L)、7(MA-M)或9(MA-S)个16进制数字
+type OUIRegistry struct {
+	vendors map[string]string
+}
+
+//读取IEEE的CSV文件(oui.csv、mam.csv、oui36.csv)：Registry,Assignment,Organization Name,...
+func ParseOUI(r io.Reader) (*OUIRegistry, error) {
+	reg := &OUIRegistry{vendors: make(map[string]string)}
+	if err := reg.read(r); err != nil {
+		return nil, err
+	}
+	if len(reg.vendors) == 0 {
+		return nil, errors.New("no oui assignment found")
+	}
+	return reg, nil
+}
+
+func (reg *OUIRegistry) read(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read oui csv: %s", err)
+		}
+		//跳过表头和格式不正确的行
+		if len(rec) < 3 {
+			continue
+		}
+		prefix := macHex(rec[1])
+		vendor := strings.TrimSpace(rec[2])
+		if prefix != strings.ToLower(strings.TrimSpace(rec[1])) || vendor == "" {
+			continue
+		}
+		switch len(prefix) {
+		case 6, 7, 9:
+			reg.vendors[prefix] = vendor
+		}
+	}
+}
+
+//内置的IEEE列表
+func DefaultOUI() (*OUIRegistry, error) {
+	reg := &OUIRegistry{vendors: make(map[string]string)}
+	for _, name := range []string{"oui/oui.csv", "oui/mam.csv", "oui/oui36.csv"} {
+		f, err := ieeeOUI.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.read(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if len(reg.vendors) == 0 {
+		return nil, errors.New("no oui assignment found")
+	}
+	return reg, nil
+}
+
+//内置的列表加上-update-oui导入的path，path中的前缀覆盖内置的厂商，path不存在时只使用内置的列表
+func LoadOUI(path string) (*OUIRegistry, error) {
+	reg, err := DefaultOUI()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = reg.read(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return reg, nil
+}
+
+//导入IEEE的CSV文件，保存到path，启动时覆盖内置列表中相同的前缀，用于不重新编译程序时更新
+//可以导入多个文件，已有的前缀会被覆盖；只导入一个文件时其他列表仍然使用内置的数据
+func UpdateOUI(path string, files ...string) (int, error) {
+	reg := &OUIRegistry{vendors: make(map[string]string)}
+	if old, err := os.Open(path); err == nil {
+		err = reg.read(old)
+		old.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		n, err := ParseOUI(f)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", file, err)
+		}
+		for prefix, vendor := range n.vendors {
+			reg.vendors[prefix] = vendor
+		}
+	}
+	if err := reg.Save(path); err != nil {
+		return 0, err
+	}
+	return reg.Len(), nil
+}
+
+//按前缀排序保存为IEEE格式的CSV
+func (reg *OUIRegistry) Save(path string) error {
+	var prefixes = make([]string, 0, len(reg.vendors))
+	for prefix := range reg.vendors {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"Registry", "Assignment", "Organization Name"})
+	for _, prefix := range prefixes {
+		registry := map[int]string{6: "MA-L", 7: "MA-M", 9: "MA-S"}[len(prefix)]
+		w.Write([]string{registry, strings.ToUpper(prefix), reg.vendors[prefix]})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (reg *OUIRegistry) Len() int {
+	return len(reg.vendors)
+}
+
+//mac地址的厂商，先匹配较长的前缀，没有找到和本地管理的地址返回空
+func (reg *OUIRegistry) Vendor(mac string) string {
+	h := macHex(mac)
+	if reg == nil || len(h) < 6 || RandomMAC(mac) {
+		return ""
+	}
+	for _, n := range []int{9, 7, 6} {
+		if len(h) >= n {
+			if v, ok := reg.vendors[h[:n]]; ok {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+//本地管理的单播地址(第一个字节的第2位为1)，通常是手机和电脑的随机mac
+func RandomMAC(mac string) bool {
+	h := macHex(mac)
+	if len(h) < 2 {
+		return false
+	}
+	b, err := strconv.ParseUint(h[:2], 16, 8)
+	return err == nil && b&0x02 != 0 && b&0x01 == 0
+}
+
+//设置客户端的厂商和是否为随机mac，reg为nil时只判断随机mac
+func (reg *OUIRegistry) Enrich(cs []*Client) {
+	for _, c := range cs {
+		c.Random = RandomMAC(c.MAC)
+		c.Vendor = reg.Vendor(c.MAC)
+	}
+}
@@ -0,0 +1,88 @@
+//go:build ignore
+// +build ignore
+
+//下载IEEE的MA-L、MA-M和MA-S列表到oui目录，编译时内置到程序中
+//在aruba_get目录执行：go generate
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var registries = []struct {
+	file string
+	url  string
+}{
+	{"oui.csv", "https://standards-oui.ieee.org/oui/oui.csv"},
+	{"mam.csv", "https://standards-oui.ieee.org/oui28/mam.csv"},
+	{"oui36.csv", "https://standards-oui.ieee.org/oui36/oui36.csv"},
+}
+
+func main() {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	for _, r := range registries {
+		n, err := download(client, r.url, filepath.Join("oui", r.file))
+		if err != nil {
+			log.Fatalf("%s: %s", r.url, err)
+		}
+		fmt.Printf("%s: %d assignments\n", r.file, n)
+	}
+}
+
+//只保存前三列(Registry,Assignment,Organization Name)，去掉地址减小程序的大小
+func download(client *http.Client, url, path string) (int, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("http status %s", res.Status)
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".tmp")
+	cr := csv.NewReader(res.Body)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	w := csv.NewWriter(f)
+	var n int
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		w.Write(rec[:3])
+		n++
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	//只有表头时保留原来的文件
+	if n <= 1 {
+		return 0, fmt.Errorf("no assignment found")
+	}
+	return n - 1, os.Rename(path+".tmp", path)
+}
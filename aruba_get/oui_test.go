@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//IEEE的oui.csv、mam.csv和oui36.csv格式
+var ouiCSVTest = `Registry,Assignment,Organization Name,Organization Address
+MA-L,6CF37F,"Aruba, a Hewlett Packard Enterprise Company",3333 Scott Blvd Santa Clara CA US 95054
+MA-L,70B3D5,IEEE Registration Authority,445 Hoes Lane Piscataway NJ US 08554
+MA-M,70B3D51,"Example Sensors, Ltd.",Shenzhen CN
+MA-S,70B3D5123,Example POS Co.,Shanghai CN
+MA-L,bad,Broken Entry,
+`
+
+func TestParseOUI(t *testing.T) {
+	reg, err := ParseOUI(strings.NewReader(ouiCSVTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Len() != 4 {
+		t.Errorf("parsed %d assignments, want 4", reg.Len())
+	}
+	var cases = map[string]string{
+		"6c:f3:7f:c0:00:10": "Aruba, a Hewlett Packard Enterprise Company",
+		"70-B3-D5-12-34-56": "Example POS Co.",
+		"70b3.d51f.0000":    "Example Sensors, Ltd.",
+		"70:b3:d5:20:00:00": "IEEE Registration Authority",
+		"00:11:22:33:44:55": "",
+		//随机mac没有厂商
+		"6e:f3:7f:c0:00:10": "",
+	}
+	for mac, want := range cases {
+		if got := reg.Vendor(mac); got != want {
+			t.Errorf("Vendor(%s) = %q, want %q", mac, got, want)
+		}
+	}
+	if _, err = ParseOUI(strings.NewReader("Registry,Assignment,Organization Name\n")); err == nil {
+		t.Error("ParseOUI without assignments succeeded")
+	}
+}
+
+func TestRandomMAC(t *testing.T) {
+	var cases = map[string]bool{
+		"da:a1:19:00:00:01": true,
+		"02:00:00:00:00:01": true,
+		"6c:f3:7f:c0:00:10": false,
+		//组播地址
+		"03:00:00:00:00:01": false,
+		"":                  false,
+	}
+	for mac, want := range cases {
+		if got := RandomMAC(mac); got != want {
+			t.Errorf("RandomMAC(%q) = %v, want %v", mac, got, want)
+		}
+	}
+}
+
+func TestUpdateOUI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "oui.csv")
+	//文件不存在时使用内置的列表
+	reg, err := LoadOUI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := reg.Vendor("00:0b:86:00:00:01"); !strings.HasPrefix(v, "Aruba") {
+		t.Errorf("default vendor of 00:0b:86 = %q", v)
+	}
+	if reg.Len() < 20000 {
+		t.Errorf("default list has %d assignments", reg.Len())
+	}
+
+	src := filepath.Join(dir, "ieee.csv")
+	if err = ioutil.WriteFile(src, []byte(ouiCSVTest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := UpdateOUI(path, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("UpdateOUI saved %d assignments, want 4", n)
+	}
+	if reg, err = LoadOUI(path); err != nil {
+		t.Fatal(err)
+	}
+	if v := reg.Vendor("70:b3:d5:12:34:56"); v != "Example POS Co." {
+		t.Errorf("vendor after update = %q", v)
+	}
+	//导入的列表只覆盖相同的前缀，其他前缀仍然使用内置的列表
+	if v := reg.Vendor("00:0b:86:00:00:01"); !strings.HasPrefix(v, "Aruba") {
+		t.Errorf("vendor of 00:0b:86 after update = %q", v)
+	}
+}
+
+func TestEnrichClassify(t *testing.T) {
+	reg, err := ParseOUI(strings.NewReader(ouiCSVTest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := true
+	cl, err := NewClassifier([]*Rule{
+		{Class: ClassPOS, Vendor: "(?i)pos"},
+		{Class: ClassPhone, Random: &random},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := []*Client{
+		{MAC: "70:b3:d5:12:34:56"},
+		{MAC: "da:a1:19:00:00:01"},
+		{MAC: "6c:f3:7f:c0:00:10"},
+	}
+	reg.Enrich(cs)
+	cl.Classify(cs)
+	if cs[0].Class != ClassPOS || cs[1].Class != ClassPhone || !cs[1].Random || cs[2].Class != "" {
+		t.Errorf("classes = %q, %q, %q", cs[0].Class, cs[1].Class, cs[2].Class)
+	}
+}
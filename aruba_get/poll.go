@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//持续轮询模式的配置，时间单位为秒
+type Poll struct {
+	//默认轮询间隔
+	Interval int `json:"interval"`
+	//每次轮询增加0到jitter秒的随机延迟
+	Jitter int `json:"jitter"`
+	//连续失败时间隔按2的指数增长，最大不超过max_backoff
+	MaxBackoff int `json:"max_backoff"`
+	//从airwave刷新路由器列表的间隔
+	Refresh int `json:"refresh"`
+	//单独指定路由器的轮询间隔，key为路由器code
+	Intervals map[string]int `json:"intervals"`
+}
+
+const (
+	defaultPollInterval = 30 * 60
+	defaultPollRefresh  = 60 * 60
+	defaultMaxBackoff   = 24 * 60 * 60
+)
+
+//路由器code的轮询间隔
+func (p *Poll) interval(code string) time.Duration {
+	if n, ok := p.Intervals[code]; ok && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if p.Interval > 0 {
+		return time.Duration(p.Interval) * time.Second
+	}
+	return defaultPollInterval * time.Second
+}
+
+func (p *Poll) refresh() time.Duration {
+	if p.Refresh > 0 {
+		return time.Duration(p.Refresh) * time.Second
+	}
+	return defaultPollRefresh * time.Second
+}
+
+//连续失败failures次后的下一次轮询间隔，不包含随机延迟
+func (p *Poll) backoff(code string, failures int) time.Duration {
+	d := p.interval(code)
+	max := time.Duration(p.MaxBackoff) * time.Second
+	if max <= 0 {
+		max = defaultMaxBackoff * time.Second
+	}
+	if max < d {
+		max = d
+	}
+	for i := 0; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (p *Poll) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(p.Jitter) * int64(time.Second)))
+}
+
+//正在轮询的路由器
+type polled struct {
+	router   *Router
+	failures int
+	done     chan struct{}
+}
+
+type poller struct {
+	ctx    context.Context
+	cfg    *Config
+	client *http.Client
+	logger *log.Logger
+	//等待所有路由器的轮询结束
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	routers map[string]*polled
+	//上一次刷新之后的采集结果
+	run *Run
+}
+
+//持续轮询：每个路由器按自己的间隔获取客户端，失败时指数退避
+//ctx取消后等待正在进行的采集结束，保存最后一次采集记录后返回
+func (cfg *Config) RunPoll(ctx context.Context, client *http.Client, logger *log.Logger) {
+	rand.Seed(time.Now().UnixNano())
+	p := &poller{
+		ctx:     ctx,
+		cfg:     cfg,
+		client:  client,
+		logger:  logger,
+		routers: make(map[string]*polled),
+		run:     NewRun("poll"),
+	}
+	for {
+		logger.Println("--------")
+		if err := p.refresh(); err != nil {
+			logger.Println(err)
+		}
+		//刷新路由器列表卡住时不再发送watchdog
+		if !cfg.watchdog.Sleep(ctx, cfg.Poll.refresh()) {
+			p.wg.Wait()
+			p.save()
+			return
+		}
+	}
+}
+
+//保存上一次刷新之后的采集记录，调用时持有p.mu或者所有轮询已经结束
+func (p *poller) save() {
+	if p.run.Total > 0 {
+		p.run.Finish()
+		p.logger.Printf("summary since last refresh: %s\n", &p.run.RunSummary)
+		p.cfg.SaveRun(p.run, p.logger)
+	}
+	p.run = NewRun("poll")
+}
+
+//刷新路由器列表，为新的路由器启动轮询，停止已经不存在的路由器
+func (p *poller) refresh() error {
+	rs, complete, err := p.cfg.RefreshRouters(p.ctx, p.client, p.logger)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.save()
+
+	var seen = make(map[string]bool)
+	for _, r := range rs {
+		seen[r.Code] = true
+		if pr, ok := p.routers[r.Code]; ok {
+			pr.router = r
+			continue
+		}
+		pr := &polled{router: r, done: make(chan struct{})}
+		p.routers[r.Code] = pr
+		p.wg.Add(1)
+		go p.loop(r.Code, pr)
+	}
+	for code, pr := range p.routers {
+		//有airwave失败时不能确定路由器是否已经删除
+		if !complete {
+			break
+		}
+		if !seen[code] {
+			p.logger.Printf("code %s removed from airwave, stop polling\n", code)
+			close(pr.done)
+			delete(p.routers, code)
+			forgetRouter(code)
+		}
+	}
+	p.logger.Printf("polling %d routers\n", len(p.routers))
+	return nil
+}
+
+func (p *poller) loop(code string, pr *polled) {
+	defer p.wg.Done()
+	poll := p.cfg.Poll
+	//第一次轮询在间隔内随机分布，避免同时连接所有路由器
+	delay := time.Duration(rand.Int63n(int64(poll.interval(code))))
+	for {
+		select {
+		case <-pr.done:
+			return
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		p.mu.Lock()
+		router := *pr.router
+		p.mu.Unlock()
+
+		if !router.status {
+			p.mu.Lock()
+			p.run.Add(skipped(&router))
+			p.mu.Unlock()
+			if p.cfg.Debug {
+				p.logger.Printf("%s status is %v, skip\n", code, router.status)
+			}
+			delay = poll.interval(code) + poll.jitter()
+			continue
+		}
+
+		rr, err := p.cfg.CollectRouter(p.ctx, p.client, &router, p.logger)
+		p.mu.Lock()
+		p.run.Add(rr)
+		p.mu.Unlock()
+		if err != nil {
+			pr.failures++
+			delay = poll.backoff(code, pr.failures)
+			p.logger.Printf("code %s failed %d times: %s, next poll in %s\n", code, pr.failures, err, delay)
+		} else {
+			pr.failures = 0
+			delay = poll.interval(code)
+		}
+		delay += poll.jitter()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollBackoff(t *testing.T) {
+	p := &Poll{
+		Interval:   600,
+		MaxBackoff: 3600,
+		Intervals:  map[string]int{"531": 60},
+	}
+	var cases = []struct {
+		code     string
+		failures int
+		want     time.Duration
+	}{
+		{"A01", 0, 10 * time.Minute},
+		{"A01", 1, 20 * time.Minute},
+		{"A01", 2, 40 * time.Minute},
+		{"A01", 3, time.Hour},
+		//一周都连接不上的路由器也不会超过max_backoff
+		{"A01", 7 * 24 * 6, time.Hour},
+		{"531", 0, time.Minute},
+		{"531", 4, 16 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := p.backoff(c.code, c.failures); got != c.want {
+			t.Errorf("backoff(%s, %d) = %s, want %s", c.code, c.failures, got, c.want)
+		}
+	}
+}
+
+func TestPollJitter(t *testing.T) {
+	p := &Poll{Jitter: 5}
+	for i := 0; i < 100; i++ {
+		if d := p.jitter(); d < 0 || d >= 5*time.Second {
+			t.Fatalf("jitter %s out of range", d)
+		}
+	}
+	if d := (&Poll{}).jitter(); d != 0 {
+		t.Fatalf("jitter without config is %s", d)
+	}
+}
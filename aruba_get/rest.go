@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//执行命令的方式
+const (
+	//8.x以上的固件使用REST API，失败时使用swarm.cgi
+	APIAuto = "auto"
+	//Instant 8.x的REST API：/rest/login和/rest/show-cmd
+	APIRest = "rest"
+	//swarm.cgi的opcode=support，用于旧的RAP-3WN
+	APICGI = "cgi"
+	//ssh登录CLI执行命令，用于关闭了web管理的路由器
+	APISSH = "ssh"
+)
+
+//登录路由器的方式
+type transport interface {
+	Name() string
+	//登录路由器，返回的会话可以执行多个命令
+	open(ctx context.Context, client *http.Client, ip string) (session, error)
+}
+
+//登录后的会话，cmd为配置中转义后的命令
+type session interface {
+	show(ctx context.Context, cmd string) ([]byte, error)
+	close()
+}
+
+//swarm.cgi
+func (rap Rap3) Name() string {
+	return APICGI
+}
+
+func (rap Rap3) open(ctx context.Context, client *http.Client, ip string) (session, error) {
+	sid, err := rap.login(ctx, client, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &cgiSession{rap: rap, client: client, ip: ip, sid: sid}, nil
+}
+
+type cgiSession struct {
+	rap    Rap3
+	client *http.Client
+	ip     string
+	sid    string
+}
+
+func (s *cgiSession) show(ctx context.Context, cmd string) ([]byte, error) {
+	return s.rap.show(ctx, s.client, s.ip, s.sid, cmd)
+}
+
+//swarm.cgi没有注销
+func (s *cgiSession) close() {}
+
+//Instant 8.x的REST API，用户名和密码在请求的body中
+type restAPI struct {
+	rap Rap3
+}
+
+func (r restAPI) Name() string {
+	return APIRest
+}
+
+//REST API的返回
+type restResponse struct {
+	Status  string `json:"Status"`
+	SID     string `json:"sid"`
+	Output  string `json:"Command output"`
+	Message string `json:"Error message"`
+}
+
+func (r restAPI) url(ip, path string) string {
+	return fmt.Sprintf("https://%s:%d/rest/%s", ip, r.rap.port(), path)
+}
+
+//发送请求并检查Status
+func (r restAPI) do(ctx context.Context, client *http.Client, req *http.Request) (*restResponse, error) {
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL.Path, res.Status)
+	}
+	var rr restResponse
+	if err = json.Unmarshal(b, &rr); err != nil {
+		return nil, fmt.Errorf("%s: json unmarshal failed: %s", req.URL.Path, err)
+	}
+	if !strings.EqualFold(rr.Status, "Success") {
+		return nil, fmt.Errorf("%s: %s %s", req.URL.Path, rr.Status, rr.Message)
+	}
+	return &rr, nil
+}
+
+func (r restAPI) post(ctx context.Context, client *http.Client, ip, path string, v interface{}) (*restResponse, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", r.url(ip, path), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return r.do(ctx, client, req)
+}
+
+func (r restAPI) open(ctx context.Context, client *http.Client, ip string) (session, error) {
+	sid, err := r.login(ctx, client, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &restSession{api: r, client: client, ip: ip, sid: sid}, nil
+}
+
+type restSession struct {
+	api    restAPI
+	client *http.Client
+	ip     string
+	sid    string
+}
+
+func (s *restSession) show(ctx context.Context, cmd string) ([]byte, error) {
+	return s.api.show(ctx, s.client, s.ip, s.sid, cmd)
+}
+
+//注销失败时只影响路由器上的会话数量，不返回错误
+func (s *restSession) close() {
+	s.api.post(context.Background(), s.client, s.ip, "logout", map[string]string{"sid": s.sid})
+}
+
+func (r restAPI) login(ctx context.Context, client *http.Client, ip string) (string, error) {
+	rr, err := r.post(ctx, client, ip, "login", map[string]string{
+		"user":   r.rap.User,
+		"passwd": r.rap.Passwd,
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("rest login failed: %s", err))
+	}
+	if rr.SID == "" {
+		return "", errors.New(`rest login failed: sid is ""`)
+	}
+	return rr.SID, nil
+}
+
+//cmd与swarm.cgi使用相同的配置，去掉转义和引号后发送
+func (r restAPI) show(ctx context.Context, client *http.Client, ip, sid, cmd string) ([]byte, error) {
+	v := url.Values{}
+	v.Set("iap_ip_addr", ip)
+	v.Set("cmd", unquoteCmd(cmd))
+	v.Set("sid", sid)
+	req, err := http.NewRequest("GET", r.url(ip, "show-cmd")+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := r.do(ctx, client, req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s failed: %s", unquoteCmd(cmd), err))
+	}
+	return []byte(rr.Output), nil
+}
+
+//固件的主版本号，如8.6.0.4_74969为8，未知时为0
+func firmwareMajor(firmware string) int {
+	return leadingInt(strings.TrimSpace(firmware))
+}
+
+func (rap Rap3) transport(api string) transport {
+	switch api {
+	case APIRest:
+		return restAPI{rap}
+	case APISSH:
+		return sshCLI{rap}
+	}
+	return rap
+}
+
+//选择执行命令的方式，按顺序尝试，路由器设置了transport时只使用该方式
+//否则根据api配置和路由器的固件版本选择，auto时8.x以上的固件先使用REST API，
+//失败后使用swarm.cgi，其他固件只使用swarm.cgi
+func (rap Rap3) transports(router *Router) []transport {
+	var firmware string
+	if router != nil {
+		if router.Transport != "" && router.Transport != APIAuto {
+			return []transport{rap.transport(router.Transport)}
+		}
+		firmware = router.Firmware
+	}
+	switch rap.API {
+	case APIRest, APICGI, APISSH:
+		return []transport{rap.transport(rap.API)}
+	}
+	if firmwareMajor(firmware) >= 8 {
+		return []transport{restAPI{rap}, rap}
+	}
+	return []transport{rap}
+}
+
+func (rap Rap3) checkAPI() error {
+	switch rap.API {
+	case "", APIAuto, APIRest, APICGI, APISSH:
+		//检查ssh的私钥和known_hosts，api为ssh时没有ssh配置也需要known_hosts
+		if rap.SSH != nil || rap.API == APISSH {
+			_, err := sshCLI{rap}.conf().clientConfig()
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rap3 api %q, should be auto, rest, cgi or ssh", rap.API)
+}
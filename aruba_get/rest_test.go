@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//模拟Instant的REST API和swarm.cgi，legacy为true时没有REST API
+type fakeIAP struct {
+	legacy  bool
+	output  string
+	rest    int
+	logouts int
+}
+
+func (f *fakeIAP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/rest/") {
+		f.rest++
+		if f.legacy {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	switch r.URL.Path {
+	case "/rest/login":
+		var v map[string]string
+		json.NewDecoder(r.Body).Decode(&v)
+		if r.Method != "POST" || v["user"] != "admin" || v["passwd"] != "p&ss" {
+			fmt.Fprint(w, `{"Status": "Failed", "Error message": "Invalid credentials"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Status": "Success", "sid": "rest-sid"}`)
+	case "/rest/show-cmd":
+		q := r.URL.Query()
+		if q.Get("sid") != "rest-sid" || q.Get("cmd") != "show clients wired" {
+			fmt.Fprint(w, `{"Status": "Failed", "Error message": "Invalid session"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Status": "Success", "Command output": f.output})
+	case "/rest/logout":
+		f.logouts++
+		fmt.Fprint(w, `{"Status": "Success"}`)
+	case "/swarm.cgi":
+		q := r.URL.Query()
+		switch q.Get("opcode") {
+		case "login":
+			if q.Get("passwd") != "p&ss" {
+				fmt.Fprint(w, `<re><data name="status">failed</data></re>`)
+				return
+			}
+			fmt.Fprint(w, `<re><data name="sid">cgi-sid</data></re>`)
+		case "support":
+			if q.Get("sid") != "cgi-sid" || q.Get("cmd") != "'show clients wired'" {
+				http.Error(w, "invalid", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, f.output)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGetClientsTransports(t *testing.T) {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", "show_clients_wired_vlan.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		api       string
+		firmware  string
+		transport string
+		legacy    bool
+		want      string
+		rest      bool
+	}{
+		{"", "8.6.0.4_74969", "", false, APIRest, true},
+		//REST API失败时使用swarm.cgi
+		{"", "8.6.0.4_74969", "", true, APICGI, true},
+		{"auto", "6.5.4.0-6.5.4.0_67890", "", false, APICGI, false},
+		{"", "", "", false, APICGI, false},
+		{"rest", "", "", false, APIRest, true},
+		{"cgi", "8.10.0.1", "", false, APICGI, false},
+		{"rest", "8.6.0.4", "", true, "", true},
+		//路由器的transport优先于api配置和固件版本
+		{"", "8.6.0.4_74969", "cgi", false, APICGI, false},
+		{"cgi", "6.5.4.0", "rest", false, APIRest, true},
+	}
+	for _, c := range cases {
+		iap := &fakeIAP{legacy: c.legacy, output: string(out)}
+		srv := httptest.NewTLSServer(iap)
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+		n, _ := strconv.Atoi(port)
+		rap := Rap3{
+			Path:   "swarm.cgi",
+			User:   "admin",
+			Passwd: "p&ss",
+			Cmd:    `%27show%20clients%20wired%27`,
+			API:    c.api,
+			Port:   n,
+		}
+		cs, _, api, err := rap.GetClients(context.Background(), srv.Client(), host, &Router{Firmware: c.firmware, Transport: c.transport})
+		srv.Close()
+		if c.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "rest:") {
+				t.Errorf("api %q firmware %q: err = %v, want rest error", c.api, c.firmware, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("api %q firmware %q: %s", c.api, c.firmware, err)
+			continue
+		}
+		if api != c.want || len(cs) != 2 {
+			t.Errorf("api %q firmware %q: used %s and got %d clients, want %s and 2", c.api, c.firmware, api, len(cs), c.want)
+		}
+		if (iap.rest > 0) != c.rest {
+			t.Errorf("api %q firmware %q: %d rest requests", c.api, c.firmware, iap.rest)
+		}
+		if api == APIRest && iap.logouts != 1 {
+			t.Errorf("api %q firmware %q: %d logouts, want 1", c.api, c.firmware, iap.logouts)
+		}
+	}
+}
+
+func TestFirmwareMajor(t *testing.T) {
+	var cases = map[string]int{
+		"8.6.0.4_74969":         8,
+		"6.5.4.0-6.5.4.0_67890": 6,
+		"10.4.0.0":              10,
+		"":                      0,
+		"unknown":               0,
+	}
+	for firmware, want := range cases {
+		if got := firmwareMajor(firmware); got != want {
+			t.Errorf("firmwareMajor(%q) = %d, want %d", firmware, got, want)
+		}
+	}
+	if err := (Rap3{API: "ssh2"}).checkAPI(); err == nil {
+		t.Error("checkAPI accepted unknown api")
+	}
+	if err := (Rap3{API: APISSH, SSH: &SSHConfig{Key: "testdata/missing_key"}}).checkAPI(); err == nil {
+		t.Error("checkAPI accepted missing ssh key")
+	}
+	if err := (Rap3{API: APISSH}).checkAPI(); err == nil {
+		t.Error("checkAPI accepted ssh without known_hosts")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//路由器一次采集的状态
+const (
+	RunOK      = "ok"
+	RunGateway = "gateway"
+	RunFailed  = "failed"
+	RunSkipped = "skipped"
+)
+
+//一个路由器在一次采集中的结果，保存在collection_run_routers
+type RouterRun struct {
+	Code    string
+	Wanip   string
+	Gateway string
+	//wan ip失败后使用gateway重试
+	Fallback bool
+	Status   string
+	Error    string
+	Clients  int
+	Start    time.Time
+	Duration time.Duration
+}
+
+//一次采集的统计
+type RunSummary struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	//wan ip失败后通过gateway成功的次数，包含在Succeeded中
+	Gateway int
+	Skipped int
+}
+
+func (sum *RunSummary) String() string {
+	return fmt.Sprintf("total %d, succeeded %d, failed %d, retried via gateway %d, skipped %d",
+		sum.Total, sum.Succeeded, sum.Failed, sum.Gateway, sum.Skipped)
+}
+
+//一次采集，保存在collection_runs；mode为cron或poll
+//轮询模式下一次刷新路由器列表的间隔内的所有采集记录为一次
+type Run struct {
+	ID    int64
+	Mode  string
+	Start time.Time
+	End   time.Time
+	RunSummary
+	Routers []*RouterRun
+
+	mu sync.Mutex
+}
+
+func NewRun(mode string) *Run {
+	return &Run{Mode: mode, Start: time.Now()}
+}
+
+//添加一个路由器的结果，可以在多个goroutine中调用
+func (run *Run) Add(rr *RouterRun) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.Total++
+	switch rr.Status {
+	case RunOK:
+		run.Succeeded++
+	case RunGateway:
+		run.Succeeded++
+		run.Gateway++
+	case RunSkipped:
+		run.Skipped++
+	default:
+		run.Failed++
+	}
+	run.Routers = append(run.Routers, rr)
+}
+
+func (run *Run) Finish() {
+	run.End = time.Now()
+}
+
+func (run *Run) Duration() time.Duration {
+	return run.End.Sub(run.Start)
+}
+
+//状态不是Up而没有采集的路由器
+func skipped(r *Router) *RouterRun {
+	return &RouterRun{
+		Code:    r.Code,
+		Wanip:   r.Wanip,
+		Gateway: r.GateWay,
+		Status:  RunSkipped,
+		Start:   time.Now(),
+	}
+}
+
+//收到退出信号而没有采集的路由器
+func canceled(r *Router, err error) *RouterRun {
+	return &RouterRun{
+		Code:    r.Code,
+		Wanip:   r.Wanip,
+		Gateway: r.GateWay,
+		Status:  RunFailed,
+		Error:   err.Error(),
+		Start:   time.Now(),
+	}
+}
+
+const runTimeFormat = "2006-01-02 15:04:05"
+
+//保存一次采集及每个路由器的结果
+func (s *sqlStore) InsertRun(run *Run) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`insert into collection_runs
+	(mode, started_at, finished_at, total, succeeded, failed, fallback, skipped, duration_ms)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Mode, run.Start.Format(runTimeFormat), run.End.Format(runTimeFormat),
+		run.Total, run.Succeeded, run.Failed, run.Gateway, run.Skipped,
+		int64(run.Duration()/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if run.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`insert into collection_run_routers
+	(run_id, code, wanip, gateway, fallback, status, error_text, clients, started_at, duration_ms)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, rr := range run.Routers {
+		_, err = stmt.Exec(run.ID, rr.Code, rr.Wanip, rr.Gateway, rr.Fallback, rr.Status, rr.Error,
+			rr.Clients, rr.Start.Format(runTimeFormat), int64(rr.Duration/time.Millisecond))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//数据库结构的一个版本，Up和Down按顺序执行
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+	//在Up之前执行，用于调整没有schema_version的旧数据库
+	Before func(db *sql.DB) error
+}
+
+//已执行的版本记录在schema_version
+const schemaVersionTable = `create table if not exists schema_version (
+	version integer not null primary key,
+	name varchar(100) not null,
+	applied_at varchar(19) not null
+)`
+
+var ErrNoMigration = errors.New("no migration to revert")
+
+//程序需要的数据库版本
+func (s *sqlStore) LatestVersion() int {
+	return s.migrations[len(s.migrations)-1].Version
+}
+
+//数据库当前版本，没有执行过迁移时为0
+func (s *sqlStore) SchemaVersion() (int, error) {
+	if _, err := s.db.Exec(schemaVersionTable); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := s.db.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+//执行所有未执行的迁移
+func (s *sqlStore) MigrateUp() ([]Migration, error) {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range s.migrations {
+		if m.Version <= current {
+			continue
+		}
+		if m.Before != nil {
+			if err = m.Before(s.db); err != nil {
+				return applied, fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err)
+			}
+		}
+		for _, query := range m.Up {
+			if _, err = s.db.Exec(query); err != nil {
+				return applied, fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err)
+			}
+		}
+		_, err = s.db.Exec(`insert into schema_version (version, name, applied_at) values (?, ?, ?)`,
+			m.Version, m.Name, time.Now().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+//回退最后一个迁移
+func (s *sqlStore) MigrateDown() (*Migration, error) {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(s.migrations) - 1; i >= 0; i-- {
+		m := s.migrations[i]
+		if m.Version != current {
+			continue
+		}
+		for _, query := range m.Down {
+			if _, err = s.db.Exec(query); err != nil {
+				return nil, fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err)
+			}
+		}
+		if _, err = s.db.Exec(`delete from schema_version where version = ?`, m.Version); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	return nil, ErrNoMigration
+}
+
+//每个迁移的执行时间，未执行的为空
+func (s *sqlStore) MigrationStatus() (map[int]string, error) {
+	if _, err := s.db.Exec(schemaVersionTable); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`select version, applied_at from schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var status = make(map[int]string)
+	for rows.Next() {
+		var (
+			version int
+			at      string
+		)
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		status[version] = at
+	}
+	return status, rows.Err()
+}
+
+func (s *sqlStore) Migrations() []Migration {
+	return s.migrations
+}
+
+//启动时检查数据库版本
+func CheckSchema(s Store) error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if latest := s.LatestVersion(); current != latest {
+		return fmt.Errorf("database schema version is %d, want %d, run -migrate up", current, latest)
+	}
+	return nil
+}
+
+//执行-migrate up|down|status
+func RunMigrate(s Store, op string, w io.Writer) error {
+	switch op {
+	case "up":
+		applied, err := s.MigrateUp()
+		for _, m := range applied {
+			fmt.Fprintf(w, "applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(w, "schema is up to date")
+		}
+	case "down":
+		m, err := s.MigrateDown()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reverted %d %s\n", m.Version, m.Name)
+	case "status":
+		status, err := s.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, m := range s.Migrations() {
+			at, ok := status[m.Version]
+			if !ok {
+				at = "pending"
+			}
+			fmt.Fprintf(w, "%3d  %-30s %s\n", m.Version, m.Name, at)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", op)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateUpDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSqlite(filepath.Join(dir, "schema.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = CheckSchema(s); err == nil {
+		t.Fatal("CheckSchema: empty database should not match")
+	}
+	if err = RunMigrate(s, "up", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckSchema(s); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = RunMigrate(s, "status", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "pending") {
+		t.Fatalf("status after up:\n%s", buf.String())
+	}
+
+	m, err := s.MigrateDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != s.LatestVersion() {
+		t.Fatalf("reverted %d, want %d", m.Version, s.LatestVersion())
+	}
+	if v, _ := s.SchemaVersion(); v != s.LatestVersion()-1 {
+		t.Fatalf("version after down is %d", v)
+	}
+
+	//全部回退后重新执行
+	for {
+		if _, err = s.MigrateDown(); err == ErrNoMigration {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckSchema(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//db/aruba.sql建立的旧数据库，routers没有autoupdate列
+func TestMigrateLegacySchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aruba_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSqlite(filepath.Join(dir, "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, query := range []string{
+		`create table routers (code varchar(10) not null primary key, name varchar(100) not null default '',
+		gateway varchar(15) not null default '', wanip varchar(15) not null default '',
+		area varchar(100) not null default '', sp varchar(100) not null default '')`,
+		`create table template_client (id integer primary key autoincrement, name varchar(100) not null default '')`,
+		`insert into routers (code, name) values ('531', 'jinan')`,
+	} {
+		if _, err = s.db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = RunMigrate(s, "up", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := s.SelectRouters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Name != "jinan" || rs[0].AutoUpdate != 1 {
+		t.Errorf("routers after migrate: %+v", rs)
+	}
+	var n int
+	if err = s.db.QueryRow(`select count(*) from sqlite_master where name = 'template_client'`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("template_client is kept: %d, %v", n, err)
+	}
+}
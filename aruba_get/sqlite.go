@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//sqlite3内嵌存储，适用于没有mysql服务器的分支机构
+type Sqlite struct {
+	sqlStore
+}
+
+//sqlite3数据库版本，与mysqlMigrations一一对应
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Before:  adoptLegacySqlite,
+		Up: []string{
+			`create table if not exists routers (
+				code varchar(10) not null primary key,
+				name varchar(100) not null default '',
+				gateway varchar(15) not null default '',
+				wanip varchar(15) not null default '',
+				area varchar(100) not null default '',
+				sp varchar(100) not null default '',
+				autoupdate integer not null default 1
+			)`,
+			`create table if not exists users (
+				user varchar(100) not null primary key,
+				password varchar(256) not null,
+				admin integer not null default 0
+			)`,
+			//time使用本地时间的文本格式，便于和mysql一样按字符串比较
+			`create table if not exists client_sightings (
+				id integer primary key autoincrement,
+				code varchar(10) not null,
+				name varchar(100) not null default '',
+				ip varchar(15) not null,
+				mac char(17) not null,
+				os varchar(50) not null default '',
+				network varchar(10) not null default 'eth1',
+				ap char(17) not null,
+				role varchar(50) not null,
+				time text not null default (datetime('now', 'localtime'))
+			)`,
+			`create index if not exists client_sightings_code_time on client_sightings (code, time)`,
+			`create index if not exists client_sightings_mac on client_sightings (mac)`,
+		},
+		Down: []string{
+			`drop table if exists client_sightings`,
+			`drop table if exists users`,
+			`drop table if exists routers`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "sightings migration progress",
+		Up: []string{
+			`create table if not exists sightings_migration (
+				code varchar(10) not null primary key,
+				last_id bigint not null default 0
+			)`,
+		},
+		Down: []string{
+			`drop table if exists sightings_migration`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "collection runs",
+		Up: []string{
+			`create table if not exists collection_runs (
+				id integer primary key autoincrement,
+				mode varchar(10) not null default 'cron',
+				started_at text not null,
+				finished_at text not null,
+				total integer not null default 0,
+				succeeded integer not null default 0,
+				failed integer not null default 0,
+				fallback integer not null default 0,
+				skipped integer not null default 0,
+				duration_ms integer not null default 0
+			)`,
+			`create index if not exists collection_runs_started_at on collection_runs (started_at)`,
+			`create table if not exists collection_run_routers (
+				id integer primary key autoincrement,
+				run_id integer not null,
+				code varchar(10) not null,
+				wanip varchar(15) not null default '',
+				gateway varchar(15) not null default '',
+				fallback integer not null default 0,
+				status varchar(10) not null,
+				error_text text,
+				clients integer not null default 0,
+				started_at text not null,
+				duration_ms integer not null default 0
+			)`,
+			`create index if not exists collection_run_routers_run_id on collection_run_routers (run_id)`,
+			`create index if not exists collection_run_routers_code on collection_run_routers (code, started_at)`,
+		},
+		Down: []string{
+			`drop table if exists collection_run_routers`,
+			`drop table if exists collection_runs`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "router inventory",
+		//sqlite3每条alter table只能添加一列
+		Up: []string{
+			`alter table routers add column model varchar(100) not null default ''`,
+			`alter table routers add column serial varchar(50) not null default ''`,
+			`alter table routers add column firmware varchar(50) not null default ''`,
+			`alter table routers add column lan_mac varchar(17) not null default ''`,
+			`alter table routers add column uptime integer not null default 0`,
+			`alter table routers add column last_contact varchar(19) not null default ''`,
+			`alter table routers add column ap_clients integer not null default 0`,
+			`alter table routers add column inventory_at varchar(19) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers drop column model`,
+			`alter table routers drop column serial`,
+			`alter table routers drop column firmware`,
+			`alter table routers drop column lan_mac`,
+			`alter table routers drop column uptime`,
+			`alter table routers drop column last_contact`,
+			`alter table routers drop column ap_clients`,
+			`alter table routers drop column inventory_at`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "client medium",
+		Up: []string{
+			`alter table client_sightings add column medium varchar(10) not null default 'wired'`,
+			`alter table client_sightings add column ssid varchar(64) not null default ''`,
+			`alter table client_sightings add column band varchar(10) not null default ''`,
+			`alter table client_sightings add column channel varchar(10) not null default ''`,
+			`alter table client_sightings add column snr integer not null default 0`,
+			`alter table client_sightings add column speed integer not null default 0`,
+			`alter table client_sightings add column auth varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings drop column medium`,
+			`alter table client_sightings drop column ssid`,
+			`alter table client_sightings drop column band`,
+			`alter table client_sightings drop column channel`,
+			`alter table client_sightings drop column snr`,
+			`alter table client_sightings drop column speed`,
+			`alter table client_sightings drop column auth`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "client class",
+		Up: []string{
+			`alter table client_sightings add column class varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings drop column class`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "client vendor",
+		Up: []string{
+			`alter table client_sightings add column vendor varchar(100) not null default ''`,
+			`alter table client_sightings add column random tinyint(1) not null default 0`,
+		},
+		Down: []string{
+			`alter table client_sightings drop column vendor`,
+			`alter table client_sightings drop column random`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "router transport",
+		Up: []string{
+			`alter table routers add column transport varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers drop column transport`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "user sessions",
+		Up: []string{
+			//id为会话token的sha256，token只保存在浏览器的cookie中
+			`create table if not exists sessions (
+				id char(64) not null primary key,
+				user varchar(100) not null,
+				created_at text not null,
+				expires_at text not null
+			)`,
+			`create index if not exists sessions_user on sessions (user)`,
+			`create index if not exists sessions_expires_at on sessions (expires_at)`,
+		},
+		Down: []string{
+			`drop table if exists sessions`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "session source",
+		Up: []string{
+			//source为local或ldap，ldap用户的角色在登录时确定
+			`alter table sessions add column source varchar(10) not null default 'local'`,
+			`alter table sessions add column role varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table sessions drop column source`,
+			`alter table sessions drop column role`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "user roles",
+		Up: []string{
+			//逗号分隔的角色名称，角色在aruba_query的配置中定义；sqlite不限制sessions.role的长度
+			`alter table users add column roles varchar(255) not null default ''`,
+		},
+		Down: []string{
+			`alter table users drop column roles`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "api tokens",
+		Up: []string{
+			//hash为token的sha256，token只在创建时显示一次；expires_at为null时不过期
+			`create table if not exists api_tokens (
+				id char(16) not null primary key,
+				user varchar(100) not null,
+				name varchar(100) not null default '',
+				hash char(64) not null,
+				scopes varchar(20) not null default 'read',
+				source varchar(10) not null default 'local',
+				role varchar(255) not null default '',
+				created_at text not null,
+				expires_at text null,
+				last_used_at text null
+			)`,
+			`create unique index if not exists api_tokens_hash on api_tokens (hash)`,
+			`create index if not exists api_tokens_user on api_tokens (user)`,
+		},
+		Down: []string{
+			`drop table if exists api_tokens`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "audit log",
+		Up: []string{
+			//路由器和用户的修改记录，actor_type为user、token、collector、system或cli，changes为修改前后的json
+			`create table if not exists audit_log (
+				id integer primary key autoincrement,
+				created_at text not null,
+				actor_type varchar(10) not null,
+				actor varchar(100) not null,
+				token char(16) not null default '',
+				ip varchar(45) not null default '',
+				object varchar(10) not null,
+				target varchar(100) not null,
+				action varchar(10) not null,
+				changes text not null
+			)`,
+			`create index if not exists audit_log_created_at on audit_log (created_at)`,
+			`create index if not exists audit_log_object_target on audit_log (object, target)`,
+		},
+		Down: []string{
+			`drop table if exists audit_log`,
+		},
+	},
+}
+
+//从旧版本mysql导入的数据库，与adoptLegacyMysql相同
+func adoptLegacySqlite(db *sql.DB) error {
+	var columns, autoupdate int
+	err := db.QueryRow(`select count(*), coalesce(sum(name = 'autoupdate'), 0) from pragma_table_info('routers')`).
+		Scan(&columns, &autoupdate)
+	if err != nil {
+		return err
+	}
+	if columns > 0 && autoupdate == 0 {
+		if _, err = db.Exec(`alter table routers add column autoupdate integer not null default 1`); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`drop table if exists template_client`)
+	return err
+}
+
+//打开sqlite3数据库文件，不存在时创建，表结构由-migrate up建立
+func OpenSqlite(path string) (*Sqlite, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", path))
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite3 failed: %s", err)
+	}
+	//sqlite3同一时间只允许一个写入者
+	db.SetMaxOpenConns(1)
+	return &Sqlite{sqlStore{db, sqliteMigrations}}, nil
+}
+
+//sqlite3不支持分区
+func (s *Sqlite) EnsurePartitions(from, to time.Time) error {
+	return nil
+}
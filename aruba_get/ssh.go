@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//ssh登录的配置，user和passwd为空时使用rap3的user和passwd
+type SSHConfig struct {
+	User   string `json:"user,omitempty"`
+	Passwd string `json:"passwd,omitempty"`
+	//私钥文件，设置时先使用密钥登录，失败后使用密码
+	Key string `json:"key,omitempty"`
+	//默认为22
+	Port int `json:"port,omitempty"`
+	//known_hosts文件，使用ssh时必须设置，只连接主机密钥在文件中的路由器
+	KnownHosts string `json:"known_hosts,omitempty"`
+}
+
+const (
+	defaultSSHPort = 22
+	//分页时的提示，按空格显示下一页
+	sshMore = "--More--"
+)
+
+//登录CLI执行命令
+type sshCLI struct {
+	rap Rap3
+}
+
+func (s sshCLI) Name() string {
+	return APISSH
+}
+
+func (s sshCLI) conf() SSHConfig {
+	var c SSHConfig
+	if s.rap.SSH != nil {
+		c = *s.rap.SSH
+	}
+	if c.User == "" {
+		c.User = s.rap.User
+	}
+	if c.Passwd == "" {
+		c.Passwd = s.rap.Passwd
+	}
+	if c.Port <= 0 {
+		c.Port = defaultSSHPort
+	}
+	return c
+}
+
+func (c SSHConfig) clientConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if c.Key != "" {
+		b, err := ioutil.ReadFile(c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read ssh key failed: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse ssh key %s failed: %s", c.Key, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.Passwd != "" {
+		passwd := c.Passwd
+		//部分固件只支持keyboard-interactive
+		auth = append(auth, ssh.Password(passwd), ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = passwd
+				}
+				return answers, nil
+			}))
+	}
+	//不检查主机密钥时可以冒充路由器获取密码
+	if c.KnownHosts == "" {
+		return nil, errors.New("ssh known_hosts is required to verify the host keys of routers")
+	}
+	hostKey, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("read known_hosts failed: %s", err)
+	}
+	return &ssh.ClientConfig{User: c.User, Auth: auth, HostKeyCallback: hostKey}, nil
+}
+
+//登录后打开一个交互式的shell，等待命令提示符
+func (s sshCLI) open(ctx context.Context, client *http.Client, ip string) (session, error) {
+	c := s.conf()
+	cfg, err := c.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(c.Port))
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("ssh connect failed: %s", err))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	cs := &sshSession{out: make(chan []byte, 16), done: make(chan struct{})}
+	//ctx取消时关闭连接，正在读写的操作会返回错误
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-cs.done:
+		}
+	}()
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		cs.close()
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("ssh login failed: %s", err))
+	}
+	cs.client = ssh.NewClient(sc, chans, reqs)
+	if err = cs.shell(ctx); err != nil {
+		cs.close()
+		return nil, errors.New(fmt.Sprintf("ssh shell failed: %s", err))
+	}
+	return cs, nil
+}
+
+type sshSession struct {
+	client *ssh.Client
+	sess   *ssh.Session
+	stdin  io.WriteCloser
+	//shell的输出，读取结束时关闭
+	out  chan []byte
+	err  error
+	done chan struct{}
+	//登录后的命令提示符，如rap-3wn#
+	prompt string
+}
+
+func (s *sshSession) shell(ctx context.Context) error {
+	sess, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	s.sess = sess
+	//足够宽的终端，避免表格换行
+	if err = sess.RequestPty("vt100", 0, 512, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		return err
+	}
+	if s.stdin, err = sess.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = sess.Shell(); err != nil {
+		return err
+	}
+	go s.read(stdout)
+	out, err := s.readPrompt(ctx)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(out, "\n")
+	s.prompt = strings.TrimSpace(lines[len(lines)-1])
+	return nil
+}
+
+func (s *sshSession) read(r io.Reader) {
+	defer close(s.out)
+	for {
+		b := make([]byte, 4096)
+		n, err := r.Read(b)
+		if n > 0 {
+			select {
+			case s.out <- b[:n]:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+	}
+}
+
+//读取输出直到命令提示符，遇到分页提示时发送空格，返回终端上显示的内容
+func (s *sshSession) readPrompt(ctx context.Context) (string, error) {
+	var (
+		buf   []byte
+		pages int
+	)
+	for {
+		select {
+		case b, ok := <-s.out:
+			if !ok {
+				return "", fmt.Errorf("connection closed: %v", s.err)
+			}
+			buf = append(buf, b...)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		//每个分页提示只发送一次空格
+		if n := bytes.Count(buf, []byte(sshMore)); n > pages {
+			pages = n
+			if _, err := s.stdin.Write([]byte(" ")); err != nil {
+				return "", err
+			}
+			continue
+		}
+		out := renderTerminal(buf)
+		last := strings.TrimSpace(out[strings.LastIndex(out, "\n")+1:])
+		if s.prompt == "" && isPrompt(last) || s.prompt != "" && last == s.prompt {
+			return out, nil
+		}
+	}
+}
+
+//命令提示符以#或者>结尾
+func isPrompt(line string) bool {
+	return strings.HasSuffix(line, "#") || strings.HasSuffix(line, ">")
+}
+
+//执行命令，去掉回显的命令和最后的提示符
+func (s *sshSession) show(ctx context.Context, cmd string) ([]byte, error) {
+	cmd = unquoteCmd(cmd)
+	if _, err := io.WriteString(s.stdin, cmd+"\n"); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s failed: %s", cmd, err))
+	}
+	out, err := s.readPrompt(ctx)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s failed: %s", cmd, err))
+	}
+	lines := strings.Split(out, "\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) > 0 && strings.Contains(lines[0], cmd) {
+		lines = lines[1:]
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+func (s *sshSession) close() {
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+	}
+	if s.stdin != nil {
+		io.WriteString(s.stdin, "exit\n")
+	}
+	if s.sess != nil {
+		s.sess.Close()
+	}
+	if s.client != nil {
+		s.client.Close()
+	}
+}
+
+var reANSI = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+//按终端的方式处理回车、退格和控制序列，分页提示被之后的输出覆盖
+func renderTerminal(b []byte) string {
+	var (
+		lines []string
+		line  []rune
+		col   int
+	)
+	for _, r := range reANSI.ReplaceAllString(string(b), "") {
+		switch r {
+		case '\n':
+			lines = append(lines, strings.TrimRight(string(line), " "))
+			line, col = line[:0], 0
+		case '\r':
+			col = 0
+		case '\b':
+			if col > 0 {
+				col--
+			}
+		default:
+			if col < len(line) {
+				line[col] = r
+			} else {
+				line = append(line, r)
+			}
+			col++
+		}
+	}
+	return strings.Join(append(lines, string(line)), "\n")
+}
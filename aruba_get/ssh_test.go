@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//模拟RAP的CLI，每page行输出分页提示，按空格后用退格擦除提示
+type fakeCLI struct {
+	output string
+	page   int
+	//允许登录的公钥
+	key   ssh.PublicKey
+	pages int
+	//listen生成的主机密钥
+	hostKey ssh.PublicKey
+}
+
+const fakePrompt = "rap-3wn# "
+
+func (f *fakeCLI) listen(t *testing.T) net.Listener {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "admin" && string(pass) == "p&ss" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if f.key != nil && string(key.Marshal()) == string(f.key.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", c.User())
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	f.hostKey = hostKey.PublicKey()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, cfg)
+		}
+	}()
+	return l
+}
+
+func (f *fakeCLI) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+				if req.Type == "shell" {
+					go f.shell(ch)
+				}
+			}
+		}()
+	}
+}
+
+func (f *fakeCLI) shell(ch ssh.Channel) {
+	defer ch.Close()
+	r := bufio.NewReader(ch)
+	io.WriteString(ch, "\r\nWelcome to Aruba Instant\r\n\r\n"+fakePrompt)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		io.WriteString(ch, cmd+"\r\n")
+		switch cmd {
+		case "exit":
+			return
+		case "show clients wired":
+			lines := strings.Split(strings.TrimRight(f.output, "\r\n"), "\n")
+			for i, l := range lines {
+				if i > 0 && i%f.page == 0 {
+					more := "\x1b[7m--More--\x1b[m (q) quit (u) pageup (/) search (n) repeat"
+					io.WriteString(ch, more)
+					if b, err := r.ReadByte(); err != nil || b != ' ' {
+						return
+					}
+					f.pages++
+					io.WriteString(ch, strings.Repeat("\b", 60)+strings.Repeat(" ", 60)+strings.Repeat("\b", 60))
+				}
+				io.WriteString(ch, strings.TrimRight(l, "\r")+"\r\n")
+			}
+		default:
+			io.WriteString(ch, "Parse error\r\n")
+		}
+		io.WriteString(ch, fakePrompt)
+	}
+}
+
+func TestGetClientsSSH(t *testing.T) {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", "show_clients_wired_vlan.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &fakeCLI{output: string(out), page: 2, key: signer.PublicKey()}
+	l := cli.listen(t)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, cli.hostKey)
+	if err = ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//其他路由器的主机密钥
+	otherHosts := filepath.Join(dir, "other_hosts")
+	line = knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, signer.PublicKey())
+	if err = ioutil.WriteFile(otherHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		name string
+		conf SSHConfig
+		err  string
+	}{
+		{"password", SSHConfig{Port: n, KnownHosts: knownHosts}, ""},
+		{"key", SSHConfig{User: "admin", Passwd: "wrong", Key: keyFile, Port: n, KnownHosts: knownHosts}, ""},
+		{"wrong password", SSHConfig{Passwd: "wrong", Port: n, KnownHosts: knownHosts}, "ssh:"},
+		{"no known_hosts", SSHConfig{Port: n}, "known_hosts is required"},
+		{"host key mismatch", SSHConfig{Port: n, KnownHosts: otherHosts}, "key mismatch"},
+	}
+	for _, c := range cases {
+		conf := c.conf
+		rap := Rap3{
+			User:   "admin",
+			Passwd: "p&ss",
+			Cmd:    `%27show%20clients%20wired%27`,
+			API:    APISSH,
+			SSH:    &conf,
+		}
+		cli.pages = 0
+		cs, warnings, api, err := rap.GetClients(context.Background(), nil, host, nil)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: err = %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if api != APISSH || len(cs) != 2 || len(warnings) != 0 {
+			t.Errorf("%s: used %s and got %d clients, warnings %q", c.name, api, len(cs), warnings)
+		}
+		if cli.pages == 0 {
+			t.Errorf("%s: output was not paged", c.name)
+		}
+		want, _ := rap.parseClients(out, MediumWired)
+		for i := range cs {
+			if i < len(want) && *cs[i] != *want[i] {
+				t.Errorf("%s: client %d = %+v, want %+v", c.name, i, cs[i], want[i])
+			}
+		}
+	}
+}
+
+func TestRenderTerminal(t *testing.T) {
+	var cases = map[string]string{
+		"a\r\nb":                   "a\nb",
+		"--More--\r        \rline": "line    ",
+		"ab\b\bxy":                 "xy",
+		"\x1b[7m--More--\x1b[m\b\b\b\b\b\b\b\bnext    ": "next    ",
+	}
+	for in, want := range cases {
+		if got := renderTerminal([]byte(in)); got != want {
+			t.Errorf("renderTerminal(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//存储接口：路由器、客户端记录和用户，mysql和sqlite3各有一个实现
+type Store interface {
+	InsertRouters(rs []*Router) error
+	UpdateRouter(r *Router) error
+	UpdateRouterSP(r *Router) error
+	DeleteRouter(r *Router) error
+	SelectRouters() ([]*Router, error)
+	//更新airwave中的ap资产信息
+	UpdateInventory(rs []*Router) error
+
+	//客户端记录保存在client_sightings，按路由器code和时间索引
+	InsertClients(code string, cs []*Client) error
+	SelectClientsByTime(code, begin, end string) ([]*Client, error)
+	//确保client_sightings中from到to之间每个月的分区存在
+	EnsurePartitions(from, to time.Time) error
+
+	//每次采集的结果保存在collection_runs和collection_run_routers
+	InsertRun(run *Run) error
+
+	//从旧版本的每个路由器一张表迁移到client_sightings
+	LegacyTables() ([]string, error)
+	OldestSighting(tab string) (time.Time, error)
+	MigrateTable(tab string, batch int) (n int64, done bool, err error)
+
+	//数据库版本
+	LatestVersion() int
+	SchemaVersion() (int, error)
+	MigrateUp() ([]Migration, error)
+	MigrateDown() (*Migration, error)
+	MigrationStatus() (map[int]string, error)
+	Migrations() []Migration
+
+	//路由器的修改记录
+	InsertAudit(e *AuditEntry) error
+
+	InsertUser(user *UserPassword) error
+	DeleteUser(username string) error
+	UpdateUser(user *UserPassword) error
+	SelectUser(username string) (*UserPassword, error)
+
+	Close() error
+}
+
+//根据driver打开对应的存储，driver为空时使用mysql
+func OpenStore(d *DBConfig) (Store, error) {
+	switch d.Driver {
+	case "", "mysql":
+		return OpenMysql(d.Host, d.Port, d.User, d.Password, d.DB)
+	case "sqlite3":
+		return OpenSqlite(d.Path)
+	}
+	return nil, fmt.Errorf("unsupported database driver: %s", d.Driver)
+}
+
+func Diff(s Store, rs []*Router) ([]*Router, error) {
+	dbrouters, err := s.SelectRouters()
+	if err != nil {
+		return nil, err
+	}
+
+	var routers = make([]*Router, 0)
+DIFF:
+	for _, r := range rs {
+		for _, dbr := range dbrouters {
+			if r.Code == dbr.Code {
+				r.Name = dbr.Name
+				r.GateWay = dbr.GateWay
+				if dbr.Area != "" {
+					r.Area = dbr.Area
+				}
+				r.AutoUpdate = dbr.AutoUpdate
+				r.Transport = dbr.Transport
+				continue DIFF
+			}
+		}
+		routers = append(routers, r)
+	}
+	return routers, nil
+}
+
+func SyncRouters(s Store, rs []*Router) error {
+	return s.InsertRouters(rs)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+路由器CLI输出的表格，列的位置由表头下面的----行确定，例如：
+Client List
+-----------
+Name  IP Address   MAC Address        OS      Network  Access Point       Role           Speed (mbps)
+----  ----------   -----------        --      -------  ------------       ----           ------------
+*/
+type Table struct {
+	//表头上面只有一列的标题，如Client List
+	Title  string
+	Header []string
+	Rows   []*Row
+	//无法解析的行
+	Warnings []string
+
+	//每一列的开始位置
+	starts []int
+}
+
+//表格的一行，Line为在输出中的行号，从1开始
+type Row struct {
+	Line  int
+	Cells []string
+}
+
+//表格结束后的统计行，如Number of Clients   :2
+var reTrailer = regexp.MustCompile(`^[A-Za-z][\w ()/-]*?\s+:`)
+
+//解析输出中所有的表格，没有表格时返回nil
+func ParseTables(out string) []*Table {
+	lines := strings.Split(strings.Replace(out, "\r", "", -1), "\n")
+	var (
+		tables []*Table
+		t      *Table
+		title  string
+	)
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		//下一行是----时当前行是新的表头
+		if line != "" && i+1 < len(lines) && isDashes(lines[i+1]) {
+			if t != nil {
+				tables = append(tables, t)
+			}
+			t = newTable(line, strings.TrimRight(lines[i+1], " \t"))
+			//只有一列并且没有数据的表格是下一个表格的标题
+			if len(t.Header) == 1 && i+3 < len(lines) && strings.TrimSpace(lines[i+2]) != "" && isDashes(lines[i+3]) {
+				title = t.Header[0]
+				t = nil
+			} else {
+				t.Title, title = title, ""
+			}
+			i++
+			continue
+		}
+		if t == nil {
+			continue
+		}
+		if line == "" || reTrailer.MatchString(line) {
+			tables = append(tables, t)
+			t = nil
+			continue
+		}
+		t.add(i+1, line)
+	}
+	if t != nil {
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+//只包含-和空格，并且至少有一个-
+func isDashes(line string) bool {
+	line = strings.TrimRight(line, " \t\r")
+	return line != "" && strings.Trim(line, "- ") == ""
+}
+
+func newTable(header, dashes string) *Table {
+	t := new(Table)
+	for i := 0; i < len(dashes); i++ {
+		if dashes[i] == '-' && (i == 0 || dashes[i-1] == ' ') {
+			t.starts = append(t.starts, i)
+		}
+	}
+	t.Header = t.split(header)
+	return t
+}
+
+//按列的位置切分一行
+func (t *Table) split(line string) []string {
+	var cells = make([]string, len(t.starts))
+	for i, start := range t.starts {
+		if start >= len(line) {
+			break
+		}
+		end := len(line)
+		if i+1 < len(t.starts) && t.starts[i+1] < end {
+			end = t.starts[i+1]
+		}
+		cells[i] = strings.TrimSpace(line[start:end])
+	}
+	return cells
+}
+
+//添加一行数据，内容跨越列的边界时记为警告
+func (t *Table) add(n int, line string) {
+	for _, start := range t.starts[1:] {
+		if start < len(line) && line[start-1] != ' ' && line[start] != ' ' {
+			t.Warnings = append(t.Warnings, fmt.Sprintf("line %d: not aligned with header: %q", n, line))
+			return
+		}
+	}
+	t.Rows = append(t.Rows, &Row{Line: n, Cells: t.split(line)})
+}
+
+//列的序号，names为同一列在不同固件中的名称，不区分大小写，不存在时返回-1
+func (t *Table) Index(names ...string) int {
+	for _, name := range names {
+		for i, h := range t.Header {
+			if strings.EqualFold(h, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+//获取一行中列names的值，不存在时返回空
+func (t *Table) Get(row *Row, names ...string) string {
+	if i := t.Index(names...); i >= 0 && i < len(row.Cells) {
+		return row.Cells[i]
+	}
+	return ""
+}
+
+//包含所有列columns的第一个表格，用于在输出中找到客户端列表
+func FindTable(tables []*Table, columns ...string) *Table {
+TABLES:
+	for _, t := range tables {
+		for _, c := range columns {
+			if t.Index(c) < 0 {
+				continue TABLES
+			}
+		}
+		return t
+	}
+	return nil
+}
+
+//解析key:value形式的输出，如show ap-env，没有:的非空行记为警告
+func ParseKeyValues(out string) (map[string]string, []string) {
+	var (
+		kvs      = make(map[string]string)
+		warnings []string
+	)
+	for i, line := range strings.Split(strings.Replace(out, "\r", "", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || isDashes(line) {
+			continue
+		}
+		j := strings.Index(line, ":")
+		if j <= 0 {
+			warnings = append(warnings, fmt.Sprintf("line %d: no key: %q", i+1, line))
+			continue
+		}
+		kvs[strings.TrimSpace(line[:j])] = strings.TrimSpace(line[j+1:])
+	}
+	return kvs, warnings
+}
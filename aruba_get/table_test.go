@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+//go test -run Golden -update 重新生成testdata中的.golden文件
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+//与testdata/name.golden比较，-update时写入
+func checkGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestParseClientsGolden(t *testing.T) {
+	var cases = []struct {
+		name   string
+		medium string
+	}{
+		{"show_clients_wired", MediumWired},
+		{"show_clients_wired_vlan", MediumWired},
+		{"show_clients", MediumWireless},
+		{"show_clients_auth", MediumWireless},
+	}
+	for _, c := range cases {
+		bs, err := ioutil.ReadFile(filepath.Join("testdata", c.name+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs, warnings := Rap3{}.parseClients(bs, c.medium)
+		got, err := json.MarshalIndent(struct {
+			Clients  []*Client
+			Warnings []string
+		}{cs, warnings}, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, c.name, append(got, '\n'))
+	}
+}
+
+func TestParseKeyValuesGolden(t *testing.T) {
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", "show_ap_env.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, warnings := ParseKeyValues(string(bs))
+	got, err := json.MarshalIndent(struct {
+		Values   map[string]string
+		Warnings []string
+	}{kvs, warnings}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "show_ap_env", append(got, '\n'))
+}
+
+func TestParseTables(t *testing.T) {
+	out := `Client List
+-----------
+Name  IP Address
+----  ----------
+a     10.0.0.1
+
+AP List
+-------
+Name  Uptime
+----  ------
+ap1   1d
+`
+	tables := ParseTables(out)
+	if len(tables) != 2 {
+		t.Fatalf("parsed %d tables, want 2", len(tables))
+	}
+	if tables[0].Title != "Client List" || tables[1].Title != "AP List" {
+		t.Errorf("titles = %q, %q", tables[0].Title, tables[1].Title)
+	}
+	if tb := FindTable(tables, "uptime"); tb != tables[1] || tb.Get(tb.Rows[0], "Uptime") != "1d" {
+		t.Errorf("FindTable(uptime) = %+v", tb)
+	}
+	if FindTable(tables, "VLAN") != nil {
+		t.Error("FindTable(VLAN) found a table")
+	}
+	//没有表格的输出
+	if _, warnings := (Rap3{}).parseClients([]byte("Invalid command\n"), MediumWired); len(warnings) != 1 {
+		t.Errorf("warnings = %q, want 1", warnings)
+	}
+}
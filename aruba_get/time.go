@@ -2,27 +2,240 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
-//基础定时器为每小时，匹配hour触发动作
-func Cron(h, m int) (<-chan time.Time, error) {
-	//因为只监控凌晨的时段，所以限定过滤器为0-5时
-	if h < 0 || h > 23 {
-		return nil, errors.New("hour must between 0 and 23")
+//5个字段的cron表达式：分 时 日 月 周
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	//日和周都指定时，满足其中一个即可
+	domStar, dowStar bool
+	loc              *time.Location
+	expr             string
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	//0和7都是周日
+	dowField = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//解析cron表达式，loc为nil时使用本地时区
+func ParseCron(expr string, loc *time.Location) (*Schedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	s := &Schedule{loc: loc, expr: expr}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("cron %q minute: %s", expr, err)
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, fmt.Errorf("cron %q hour: %s", expr, err)
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, fmt.Errorf("cron %q day of month: %s", expr, err)
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, fmt.Errorf("cron %q month: %s", expr, err)
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, fmt.Errorf("cron %q day of week: %s", expr, err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+//解析一个字段：*、*/n、a、a-b、a-b/n，以逗号分隔
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		var lo, hi int
+		switch {
+		case part == "*" || part == "?":
+			lo, hi = f.min, f.max
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			if lo, err = f.value(part[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(part[i+1:]); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			//a/n表示从a开始到最大值
+			if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domOK := s.dom&(1<<uint(t.Day())) != 0
+	dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+//t之后(不包括t所在的分钟)第一个匹配的时间，5年内没有匹配时返回零值
+func (s *Schedule) Next(t time.Time) time.Time {
+	from := t
+	t = t.In(s.loc)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, s.loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+			continue
+		}
+		//按墙上时间递增，夏令时结束时重复的一小时不会再次匹配
+		if s.minute&(1<<uint(t.Minute())) == 0 || !t.After(from) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, s.loc)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+//多个表达式中最早的下一次时间
+func nextOf(scheds []*Schedule, t time.Time) time.Time {
+	var next time.Time
+	for _, s := range scheds {
+		n := s.Next(t)
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
 	}
-	if m < 0 || m > 59 {
-		return nil, errors.New("miniute mutst between 0 and 59")
+	return next
+}
+
+//按cron表达式列表触发动作
+//按墙上时间计算下一次触发，每分钟最多等待一次后重新检查，
+//时钟向前跳过触发点时补发一次，向后回拨时同一时间点不会重复触发
+func Cron(specs []string, loc *time.Location) (<-chan time.Time, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("schedule is empty")
+	}
+	var scheds = make([]*Schedule, 0, len(specs))
+	for _, spec := range specs {
+		s, err := ParseCron(spec, loc)
+		if err != nil {
+			return nil, err
+		}
+		scheds = append(scheds, s)
 	}
-	var tick = time.Tick(1 * time.Minute)
+	next := nextOf(scheds, time.Now())
+	if next.IsZero() {
+		return nil, errors.New("schedule never fires")
+	}
+
 	var cron = make(chan time.Time)
 	go func() {
-		for now := range tick {
-			//send time to cron, when h, m matched
-			hour, min, _ := now.Clock()
-			if hour == h && m == min {
-				cron <- now
+		var last string
+		for !next.IsZero() {
+			if d := next.Sub(time.Now()); d > 0 {
+				if d > time.Minute {
+					d = time.Minute
+				}
+				time.Sleep(d)
+				continue
+			}
+			//已经触发过的时间点不再触发
+			if key := next.Format("2006-01-02 15:04"); key > last {
+				last = key
+				cron <- next
 			}
+			next = nextOf(scheds, time.Now())
 		}
 	}()
 	return cron, nil
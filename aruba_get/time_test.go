@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Errorf("ParseCron(%q): expected error", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	var cases = []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"20 10 * * *", "2017-02-15 10:19:30", "2017-02-15 10:20"},
+		{"20 10 * * *", "2017-02-15 10:20:00", "2017-02-16 10:20"},
+		{"*/30 0-4 * * *", "2017-02-15 23:59:00", "2017-02-16 00:00"},
+		{"*/30 0-4 * * *", "2017-02-16 00:00:10", "2017-02-16 00:30"},
+		{"*/30 0-4 * * *", "2017-02-16 04:30:00", "2017-02-17 00:00"},
+		{"0 5 * * *", "2017-02-16 04:30:00", "2017-02-16 05:00"},
+		{"15 2 29 2 *", "2017-01-01 00:00:00", "2020-02-29 02:15"},
+		{"0 9 * * mon-fri", "2017-02-17 09:00:00", "2017-02-20 09:00"},
+		{"0 0 * * 7", "2017-02-15 00:00:00", "2017-02-19 00:00"},
+		{"0 0 1 jan *", "2017-02-15 00:00:00", "2018-01-01 00:00"},
+		//日和周都指定时满足其一
+		{"0 0 13 * fri", "2017-02-15 00:00:00", "2017-02-17 00:00"},
+		{"@hourly", "2017-02-15 10:59:59", "2017-02-15 11:00"},
+		{"5/20 * * * *", "2017-02-15 10:26:00", "2017-02-15 10:45"},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr, time.UTC)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %s", c.expr, err)
+		}
+		from, _ := time.ParseInLocation("2006-01-02 15:04:05", c.from, time.UTC)
+		if got := s.Next(from).Format("2006-01-02 15:04"); got != c.want {
+			t.Errorf("%q.Next(%s) = %s, want %s", c.expr, c.from, got, c.want)
+		}
+	}
+}
+
+func TestScheduleNextTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := ParseCron("0 2 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//UTC 17:00为北京时间次日01:00
+	from := time.Date(2017, 2, 15, 17, 0, 0, 0, time.UTC)
+	want := time.Date(2017, 2, 15, 18, 0, 0, 0, time.UTC)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got.UTC(), want)
+	}
+}
+
+func TestScheduleNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := ParseCron("30 1 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//2017-11-05 01:30出现两次，墙上时间相同
+	first := s.Next(time.Date(2017, 11, 5, 0, 0, 0, 0, loc))
+	second := s.Next(first)
+	if first.Format("2006-01-02 15:04") == second.Format("2006-01-02 15:04") {
+		t.Errorf("Next returned the same wall clock twice: %s, %s", first, second)
+	}
+	//从第二次出现的01:10开始，不会返回已经过去的时间
+	from := time.Date(2017, 11, 5, 6, 10, 0, 0, time.UTC)
+	if next := s.Next(from); !next.After(from) {
+		t.Errorf("Next(%s) = %s, not after from", from.In(loc), next)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//获取无线客户端失败，有线客户端仍然保存
+type WirelessError struct {
+	Err error
+}
+
+func (e *WirelessError) Error() string {
+	return fmt.Sprintf("wireless clients: %s", strings.TrimSpace(e.Err.Error()))
+}
+
+func (rap Rap3) clientsWireless(ctx context.Context, s session) ([]*Client, []string, error) {
+	cmd := rap.WirelessCmd
+	if cmd == "" {
+		cmd = defaultWirelessCmd
+	}
+	bs, err := s.show(ctx, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs, warnings := rap.parseClients(bs, MediumWireless)
+	return cs, warnings, nil
+}
+
+//根据信道判断频段，信道后面可能有E、+、-等后缀
+func band(channel string) string {
+	i := 0
+	for i < len(channel) && channel[i] >= '0' && channel[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(channel[:i])
+	switch {
+	case err != nil:
+		return ""
+	case n <= 14:
+		return "2.4GHz"
+	default:
+		return "5GHz"
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBand(t *testing.T) {
+	var cases = map[string]string{
+		"1":    "2.4GHz",
+		"11+":  "2.4GHz",
+		"36E":  "5GHz",
+		"149-": "5GHz",
+		"":     "",
+	}
+	for channel, want := range cases {
+		if got := band(channel); got != want {
+			t.Errorf("band(%q) = %q, want %q", channel, got, want)
+		}
+	}
+}
+
+func TestInsertWireless(t *testing.T) {
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", "show_clients.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, _ := Rap3{}.parseClients(bs, MediumWireless)
+	cs = append(cs, csTest[0])
+	if err := dbTest.InsertClients("W01", cs); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	got, err := dbTest.SelectClientsByTime("W01", now.Format("2006-01-02"), now.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var media = make(map[string]int)
+	for _, c := range got {
+		media[c.Medium]++
+		if c.Medium == MediumWireless && c.SSID == "" {
+			t.Errorf("wireless client %s without ssid", c.MAC)
+		}
+	}
+	//没有设置medium的客户端保存为有线客户端
+	if media[MediumWireless] != 3 || media[MediumWired] != 1 {
+		t.Errorf("media = %v, want 3 wireless and 1 wired", media)
+	}
+}
+
+//show clients失败时返回已经获取的有线客户端
+func TestGetClientsWirelessError(t *testing.T) {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", "show_clients_wired_vlan.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iap := &fakeIAP{legacy: true, output: string(out)}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//执行show clients时断开连接
+		if r.URL.Query().Get("cmd") == "'show clients'" {
+			panic(http.ErrAbortHandler)
+		}
+		iap.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	n, _ := strconv.Atoi(port)
+	rap := Rap3{
+		Path:     "swarm.cgi",
+		User:     "admin",
+		Passwd:   "p&ss",
+		Cmd:      `%27show%20clients%20wired%27`,
+		Wireless: true,
+		Port:     n,
+	}
+	cs, _, api, err := rap.GetClients(context.Background(), srv.Client(), host, nil)
+	if _, ok := err.(*WirelessError); !ok {
+		t.Fatalf("err = %v, want wireless error", err)
+	}
+	if api != APICGI || len(cs) != 2 || cs[0].Medium != MediumWired {
+		t.Errorf("used %s and got %d clients, want cgi and 2 wired clients", api, len(cs))
+	}
+}
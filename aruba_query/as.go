@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -108,7 +107,7 @@ type Link struct {
 type Remark struct {
 	Title       string   `json:"title,omitempty"`
 	Type        string   `json:"type,omitempty"`
-	Description []string `json:description,omitempty"`
+	Description []string `json:"description,omitempty"`
 	Links       []*Link  `json:"links,omitempty"`
 }
 
@@ -131,7 +130,8 @@ type IPAddr struct {
 	Country string `json:"country"`
 }
 
-func GetJSON(rawUrl, ip string) (*AS, error) {
+//查询ip的rdap信息，ctx取消时停止请求
+func GetJSON(ctx context.Context, client *http.Client, rawUrl, ip string) (*AS, error) {
 	n := strings.Index(ip, "/")
 	if n > 0 {
 		_, _, err := net.ParseCIDR(ip)
@@ -143,7 +143,11 @@ func GetJSON(rawUrl, ip string) (*AS, error) {
 		return nil, errors.New("ip invalid")
 	}
 
-	resp, err := http.Get(fmt.Sprintf("%s/ip/%s", rawUrl, ip))
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/ip/%s", rawUrl, ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -176,50 +180,55 @@ func GetAddr(as *AS, ip string) (*IPAddr, error) {
 	return &IPAddr{IP: ip, Country: as.Country, Addr: addr}, nil
 }
 
-func UpdateSP(ctx context.Context, db *sql.DB, ch chan<- error, done chan<- bool, addr string) {
+//根据wan ip的rdap信息更新路由器的运营商，运营商变化时记录修改
+func UpdateSP(ctx context.Context, s Store, wd *Watchdog, ch chan<- error, done chan<- bool) {
 	client := &http.Client{Timeout: time.Second * 10}
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/admin/r/g", addr), nil)
-	if err != nil {
-		ch <- err
-		return
-	}
-	r, err := client.Do(req)
+	//直接读取数据库，/admin/r/g需要登录
+	routers, err := s.SelectRouters()
 	if err != nil {
 		ch <- err
 		return
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		ch <- err
-		return
-	}
-	var routers = make([]*Router, 0)
-	if err = json.Unmarshal(b, &routers); err != nil {
-		ch <- err
-		return
-	}
 
 	for i := 0; i < len(routers); i++ {
+		//ctx取消后不再查询剩余的路由器
+		if ctx.Err() != nil {
+			ch <- ctx.Err()
+			return
+		}
 		router := routers[i]
 		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
-		defer cancel()
-		as, err := GetJSON(rdapAddr, router.Wanip)
+		as, err := GetJSON(ctx, client, rdapAddr, router.Wanip)
 		if err != nil {
+			rdapFailures.Inc()
 			select {
 			case <-ctx.Done():
 				err = ctx.Err()
 			default:
 			}
 		} else {
+			before := *router
 			router.SP = FindSP(as.Name)
-			if err = UpdateRouterSP(db, router); err != nil {
+			if err = s.UpdateRouterSP(router); err != nil {
 				select {
 				case <-ctx.Done():
 					err = ctx.Err()
 				default:
 				}
+			} else if before.SP != router.SP {
+				err = s.InsertAudit(&AuditEntry{
+					ActorType: ActorSystem,
+					Actor:     "aruba_query",
+					Object:    ObjectRouter,
+					Target:    router.Code,
+					Action:    ActionUpdate,
+					Changes:   routerChanges(&before, router),
+				})
 			}
 		}
+		cancel()
+		//每个路由器最多30秒，卡住时不再发送watchdog
+		wd.Ping()
 		if err != nil {
 			ch <- errors.New(fmt.Sprintf("update sp of %s: %s\n", router.Code, err))
 		}
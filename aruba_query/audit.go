@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+//修改的来源，与aruba_get保持一致
+const (
+	ActorUser      = "user"
+	ActorToken     = "token"
+	ActorCollector = "collector"
+	ActorSystem    = "system"
+	ActorCLI       = "cli"
+)
+
+//修改的对象和动作
+const (
+	ObjectRouter = "router"
+	ObjectUser   = "user"
+	ObjectToken  = "token"
+
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+//不记录密码的hash，只记录密码被修改
+const maskedPassword = "******"
+
+//字段修改前后的值，创建时Before为nil，删除时After为nil
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+//一条修改记录，Target为路由器代码、用户名或者token ID
+type AuditEntry struct {
+	ID        int64              `json:"id"`
+	Time      string             `json:"time"`
+	ActorType string             `json:"actor_type"`
+	Actor     string             `json:"actor"`
+	Token     string             `json:"token"`
+	IP        string             `json:"ip"`
+	Object    string             `json:"object"`
+	Target    string             `json:"target"`
+	Action    string             `json:"action"`
+	Changes   map[string]*Change `json:"changes"`
+}
+
+//查询修改记录的条件，为空的条件不使用；Codes不为nil时只返回这些路由器的记录
+type AuditFilter struct {
+	Object string
+	Target string
+	Actor  string
+	Codes  []string
+	Limit  int
+	Offset int
+}
+
+func (s *sqlStore) InsertAudit(e *AuditEntry) error {
+	b, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	if e.Time == "" {
+		e.Time = time.Now().Format(timeFormat)
+	}
+	_, err = s.db.Exec(`insert into audit_log (created_at, actor_type, actor, token, ip, object, target, action, changes)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?)`, e.Time, e.ActorType, e.Actor, e.Token, e.IP, e.Object, e.Target, e.Action, string(b))
+	return err
+}
+
+//按时间倒序返回修改记录
+func (s *sqlStore) SelectAudit(f *AuditFilter) ([]*AuditEntry, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if f.Object != "" {
+		conds = append(conds, `object = ?`)
+		args = append(args, f.Object)
+	}
+	if f.Target != "" {
+		conds = append(conds, `target = ?`)
+		args = append(args, f.Target)
+	}
+	if f.Actor != "" {
+		conds = append(conds, `actor = ?`)
+		args = append(args, f.Actor)
+	}
+	if f.Codes != nil {
+		if len(f.Codes) == 0 {
+			return make([]*AuditEntry, 0), nil
+		}
+		conds = append(conds, `object = ? and target in (?`+strings.Repeat(`, ?`, len(f.Codes)-1)+`)`)
+		args = append(args, ObjectRouter)
+		for _, c := range f.Codes {
+			args = append(args, c)
+		}
+	}
+	query := `select id, created_at, actor_type, actor, token, ip, object, target, action, changes from audit_log`
+	if len(conds) > 0 {
+		query += ` where ` + strings.Join(conds, ` and `)
+	}
+	rows, err := s.db.Query(query+` order by id desc limit ? offset ?`, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var es = make([]*AuditEntry, 0)
+	for rows.Next() {
+		var (
+			e       = new(AuditEntry)
+			changes string
+		)
+		if err = rows.Scan(&e.ID, &e.Time, &e.ActorType, &e.Actor, &e.Token, &e.IP, &e.Object, &e.Target,
+			&e.Action, &changes); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, fmt.Errorf("audit %d: %s", e.ID, err)
+		}
+		es = append(es, e)
+	}
+	return es, rows.Err()
+}
+
+//before和after不同时记录
+func addChange(cs map[string]*Change, field string, before, after interface{}) {
+	if before != after {
+		cs[field] = &Change{Before: before, After: after}
+	}
+}
+
+//路由器修改的字段，before为nil时是新的路由器
+func routerChanges(before, after *Router) map[string]*Change {
+	var cs = make(map[string]*Change)
+	create := before == nil
+	if create {
+		before = new(Router)
+	}
+	addChange(cs, "name", before.Name, after.Name)
+	addChange(cs, "gateway", before.GateWay, after.GateWay)
+	addChange(cs, "wanip", before.Wanip, after.Wanip)
+	addChange(cs, "area", before.Area, after.Area)
+	addChange(cs, "sp", before.SP, after.SP)
+	addChange(cs, "autoupdate", before.AutoUpdate, after.AutoUpdate)
+	addChange(cs, "transport", before.Transport, after.Transport)
+	//新的路由器只记录不为空的字段
+	if create {
+		for _, c := range cs {
+			c.Before = nil
+		}
+	}
+	return cs
+}
+
+//用户修改的字段，创建时before为nil，删除时after为nil
+func userChanges(before, after *UserPassword) map[string]*Change {
+	var cs = make(map[string]*Change)
+	switch {
+	case before == nil:
+		cs["admin"] = &Change{After: after.Admin}
+		cs["roles"] = &Change{After: after.Roles}
+		cs["password"] = &Change{After: maskedPassword}
+	case after == nil:
+		cs["admin"] = &Change{Before: before.Admin}
+		cs["roles"] = &Change{Before: before.Roles}
+		cs["password"] = &Change{Before: maskedPassword}
+	default:
+		addChange(cs, "admin", before.Admin, after.Admin)
+		addChange(cs, "roles", before.Roles, after.Roles)
+		if before.Password != after.Password {
+			cs["password"] = &Change{Before: maskedPassword, After: maskedPassword}
+		}
+	}
+	return cs
+}
+
+//记录已登录用户或者token的修改，失败时只记录日志，修改已经完成
+func (cfg *Config) audit(r *http.Request, lg *log.Logger, object, target, action string, changes map[string]*Change) {
+	a := requestAccess(r)
+	ip := cfg.remoteAddr(r)
+	e := &AuditEntry{
+		ActorType: ActorUser,
+		Actor:     a.User,
+		Token:     a.Token,
+		IP:        ip,
+		Object:    object,
+		Target:    target,
+		Action:    action,
+		Changes:   changes,
+	}
+	if a.Token != "" {
+		e.ActorType = ActorToken
+	}
+	if err := cfg.store.InsertAudit(e); err != nil {
+		lg.Printf("[Error] client %s: audit %s %s %s: %s\n", ip, action, object, target, err)
+	}
+}
+
+//命令行的修改记录为执行命令的系统用户
+func cliAudit(s Store, object, target, action string, changes map[string]*Change) error {
+	actor := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+	return s.InsertAudit(&AuditEntry{
+		ActorType: ActorCLI,
+		Actor:     actor,
+		Object:    object,
+		Target:    target,
+		Action:    action,
+		Changes:   changes,
+	})
+}
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 1000
+)
+
+//按时间倒序列出修改记录，支持limit和offset分页，以及object、target和actor条件
+//不能修改所有路由器的用户只能看到自己可以修改的路由器的记录
+func (cfg *Config) ListAudit(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if err := r.ParseForm(); err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, err := intValue(r, "limit", defaultAuditLimit)
+	if err == nil && (limit == 0 || limit > maxAuditLimit) {
+		err = fmt.Errorf("limit must be between 1 and %d", maxAuditLimit)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	offset, err := intValue(r, "offset", 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	f := &AuditFilter{
+		Object: r.FormValue("object"),
+		Target: r.FormValue("target"),
+		Actor:  r.FormValue("actor"),
+		Limit:  limit,
+		Offset: offset,
+	}
+	if f.Object == ObjectRouter {
+		f.Target = strings.ToUpper(f.Target)
+	}
+	if a := requestAccess(r); !a.AdminAll() {
+		rs, err := cfg.store.SelectRouters()
+		if err != nil {
+			lg.Printf("select audit error: %s\n", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		f.Codes = make([]string, 0)
+		for _, router := range a.administrable(rs) {
+			f.Codes = append(f.Codes, router.Code)
+		}
+	}
+
+	es, err := cfg.store.SelectAudit(f)
+	if err != nil {
+		lg.Printf("select audit error: %s\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err = writeJSON(w, es); err != nil {
+		lg.Printf("select audit error: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.db.Exec(`insert into routers (code, name, area, wanip) values ('531', 'jinan', '华东', '203.0.113.5'), ('028', 'chengdu', '西南', '')`); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{store: s, Roles: map[string]*Role{
+		"east": {Admin: Scope{Areas: []string{"华东"}}},
+	}}
+	lg := log.New(ioutil.Discard, "", 0)
+
+	//命令行添加的用户
+	in, err := ioutil.TempFile(dir, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.WriteString("manager-pw\nmanager-pw\n")
+	for _, u := range []struct{ user, roles string }{{"root", ""}, {"east", "east"}} {
+		in.Seek(0, 0)
+		if err = RunUserCmd(s, u.user, "", "", "", u.roles == "", u.roles, in, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in.Close()
+
+	login := func(user string) *http.Cookie {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {user}, "password": {"manager-pw"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		cfg.Login(w, r, lg)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login %s got %d", user, w.Code)
+		}
+		return w.Result().Cookies()[0]
+	}
+	call := func(c *http.Cookie, h func(http.ResponseWriter, *http.Request, *log.Logger), method, target string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target+"?"+form.Encode(), nil)
+		r.RemoteAddr = "192.0.2.10:50000"
+		r.AddCookie(c)
+		cfg.auth(true, lg, func(w http.ResponseWriter, r *http.Request) { h(w, r, lg) })(w, r)
+		return w
+	}
+	root, east := login("root"), login("east")
+
+	//与admin.html的update()发送相同的字段，没有wanip
+	form := url.Values{"code": {"531"}, "name": {"jinan-2"}, "gateway": {""}, "area": {"华东"}, "service_provider": {""}, "transport": {""}, "auto_update": {"yes"}}
+	if w := call(east, cfg.UpdateRouter, "POST", "/admin/r/u", form); w.Code != http.StatusOK {
+		t.Fatalf("update 531 got %d", w.Code)
+	}
+	if w := call(root, cfg.UpdateRouter, "POST", "/admin/r/u", url.Values{"code": {"028"}, "name": {"chengdu"}, "gateway": {"10.0.0.1"}}); w.Code != http.StatusOK {
+		t.Fatalf("update 028 got %d", w.Code)
+	}
+
+	list := func(c *http.Cookie, form url.Values) []*AuditEntry {
+		var es []*AuditEntry
+		w := call(c, cfg.ListAudit, "GET", "/admin/audit", form)
+		if err := json.Unmarshal(w.Body.Bytes(), &es); err != nil {
+			t.Fatalf("audit: %s: %s", err, w.Body)
+		}
+		return es
+	}
+	es := list(root, nil)
+	if len(es) != 4 {
+		t.Fatalf("audit has %d entries, want 4", len(es))
+	}
+	//按时间倒序
+	e := es[1]
+	if e.Object != ObjectRouter || e.Target != "531" || e.ActorType != ActorUser || e.Actor != "east" || e.IP != "192.0.2.10" {
+		t.Errorf("audit of 531: %+v", e)
+	}
+	if c := e.Changes["name"]; c == nil || c.Before != "jinan" || c.After != "jinan-2" || len(e.Changes) != 1 {
+		t.Errorf("changes of 531: %v", e.Changes)
+	}
+	if r, err := s.SelectRouter("531"); err != nil || r.Wanip != "203.0.113.5" {
+		t.Errorf("wanip of 531 after update: %v, %v", r, err)
+	}
+	if e = es[3]; e.Object != ObjectUser || e.Target != "root" || e.ActorType != ActorCLI || e.Changes["password"].After != maskedPassword {
+		t.Errorf("audit of useradd: %+v", e)
+	}
+	if es = list(root, url.Values{"limit": {"1"}, "offset": {"1"}}); len(es) != 1 || es[0].Target != "531" {
+		t.Errorf("second page: %+v", es)
+	}
+	if es = list(root, url.Values{"object": {"user"}}); len(es) != 2 {
+		t.Errorf("user entries: %d", len(es))
+	}
+
+	//只能看到自己可以修改的路由器的记录
+	es = list(east, nil)
+	if len(es) != 1 || es[0].Target != "531" {
+		t.Errorf("east sees %d entries", len(es))
+	}
+}
+
+//只有来自可信代理的请求使用X-Forwarded-For，whitelist和审计使用相同的地址
+func TestClientIP(t *testing.T) {
+	cfg := &Config{TrustedProxies: []string{"127.0.0.1", "10.1.0.0/16"}}
+	if err := cfg.ParseProxies(); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		remote, header, forwarded, want string
+	}{
+		{"192.0.2.10:50000", "", "", "192.0.2.10"},
+		//不是代理时忽略客户端伪造的头
+		{"192.0.2.10:50000", "X-Forwarded-For", "10.0.0.5", "192.0.2.10"},
+		{"192.0.2.10:50000", "X-Forward-For", "10.0.0.5", "192.0.2.10"},
+		{"127.0.0.1:50000", "X-Forwarded-For", "10.0.0.5", "10.0.0.5"},
+		{"127.0.0.1:50000", "X-Forward-For", "10.0.0.5", "10.0.0.5"},
+		//客户端添加在最左边的地址不使用，跳过多层代理
+		{"127.0.0.1:50000", "X-Forwarded-For", "10.0.0.5, 198.51.100.7, 10.1.2.3", "198.51.100.7"},
+		{"127.0.0.1:50000", "X-Forwarded-For", "bogus, 10.1.2.3", "10.1.2.3"},
+		{"[::1]:50000", "X-Forwarded-For", "10.0.0.5", "::1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set(c.header, c.forwarded)
+		}
+		if ip := clientIP(r, cfg.proxies); ip.String() != c.want {
+			t.Errorf("%s %s: %s, clientIP = %s, want %s", c.remote, c.header, c.forwarded, ip, c.want)
+		}
+	}
+
+	if err := (&Config{TrustedProxies: []string{"10.1.0.0/33"}}).ParseProxies(); err == nil {
+		t.Error("invalid trusted_proxies accepted")
+	}
+
+	srv := &Server{ServeMux: http.NewServeMux(), IPS: []net.IP{net.ParseIP("10.0.0.5")}, Proxies: cfg.proxies, Logger: log.New(ioutil.Discard, "", 0)}
+	srv.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range []struct {
+		remote string
+		status int
+	}{
+		{"192.0.2.10:50000", http.StatusForbidden},
+		{"127.0.0.1:50000", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		r.Header.Set("X-Forward-For", "10.0.0.5")
+		srv.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("whitelist from %s got %d, want %d", c.remote, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	//保存会话token的cookie
+	sessionCookie = "aruba_session"
+	//会话默认有效期(小时)
+	defaultSessionHours = 12
+)
+
+//登录会话，ID为token的sha256，数据库泄露时不能直接使用
+//Source为local时每次请求读取users表，为ldap时使用登录时的Role(逗号分隔的角色名称)
+type Session struct {
+	ID      string
+	User    string
+	Created string
+	Expires string
+	Source  string
+	Role    string
+}
+
+func (s *sqlStore) InsertSession(sess *Session) error {
+	_, err := s.db.Exec(`insert into sessions (id, user, created_at, expires_at, source, role) values (?, ?, ?, ?, ?, ?)`,
+		sess.ID, sess.User, sess.Created, sess.Expires, sess.Source, sess.Role)
+	return err
+}
+
+func (s *sqlStore) SelectSession(id string) (*Session, error) {
+	var sess = new(Session)
+	err := s.db.QueryRow(`select id, user, created_at, expires_at, source, role from sessions where id = ?`, id).
+		Scan(&sess.ID, &sess.User, &sess.Created, &sess.Expires, &sess.Source, &sess.Role)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *sqlStore) DeleteSession(id string) error {
+	_, err := s.db.Exec(`delete from sessions where id = ?`, id)
+	return err
+}
+
+//删除users表中用户的所有会话，修改密码和删除用户时使用，不影响同名的ldap用户
+func (s *sqlStore) DeleteUserSessions(user string) error {
+	_, err := s.db.Exec(`delete from sessions where user = ? and source = ?`, user, SourceLocal)
+	return err
+}
+
+//删除在before之前过期的会话
+func (s *sqlStore) DeleteExpiredSessions(before string) error {
+	_, err := s.db.Exec(`delete from sessions where expires_at < ?`, before)
+	return err
+}
+
+//bcrypt保存密码
+func HashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+var (
+	errLogin = errors.New("invalid user or password")
+	//用户不存在时也比较一次密码，避免通过响应时间判断用户是否存在
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+//检查用户名和密码，成功时返回用户
+func (cfg *Config) checkPassword(user, password string) (*UserPassword, error) {
+	u, err := cfg.store.SelectUser(user)
+	if err == sql.ErrNoRows {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("aruba_query"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, errLogin
+	}
+	return u, nil
+}
+
+//配置了ldap时先使用ldap登录，失败时使用users表，返回用户的权限
+func (cfg *Config) checkLogin(user, password string, lg *log.Logger) (*Access, error) {
+	if cfg.LDAP != nil {
+		roles, err := cfg.LDAP.Authenticate(user, password)
+		if err == nil {
+			return cfg.newAccess(user, SourceLDAP, roles), nil
+		}
+		lg.Printf("ldap login %q failed: %s, try local users\n", user, err)
+	}
+	u, err := cfg.checkPassword(user, password)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.userAccess(u), nil
+}
+
+//32字节的随机token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (cfg *Config) sessionHours() int {
+	if cfg.Session > 0 {
+		return cfg.Session
+	}
+	return defaultSessionHours
+}
+
+type ctxKey int
+
+const userKey ctxKey = 0
+
+//auth放入请求中的已登录用户的权限
+func requestAccess(r *http.Request) *Access {
+	a, _ := r.Context().Value(userKey).(*Access)
+	return a
+}
+
+var errNoSession = errors.New("login required")
+
+//根据Authorization头中的API token或者cookie中的会话token查找用户，用户被删除或者会话过期时返回errNoSession
+func (cfg *Config) authenticate(r *http.Request) (*Access, error) {
+	if token := bearerToken(r); token != "" {
+		return cfg.tokenAccess(token)
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, errNoSession
+	}
+	sess, err := cfg.store.SelectSession(hashToken(c.Value))
+	if err == sql.ErrNoRows {
+		return nil, errNoSession
+	} else if err != nil {
+		return nil, err
+	}
+	if sess.Expires < time.Now().Format(timeFormat) {
+		cfg.store.DeleteSession(sess.ID)
+		return nil, errNoSession
+	}
+	if sess.Source == SourceLDAP {
+		return cfg.newAccess(sess.User, SourceLDAP, splitRoles(sess.Role)), nil
+	}
+	//每次都读取用户，修改角色后立即生效
+	u, err := cfg.store.SelectUser(sess.User)
+	if err == sql.ErrNoRows {
+		return nil, errNoSession
+	} else if err != nil {
+		return nil, err
+	}
+	return cfg.userAccess(u), nil
+}
+
+//需要登录的接口，admin为true时只允许可以修改路由器的用户访问，具体的路由器由接口检查
+func (cfg *Config) auth(admin bool, lg *log.Logger, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, err := cfg.authenticate(r)
+		if err == errNoSession {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			lg.Printf("[Error] client %s: check session: %s\n", cfg.remoteAddr(r), err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if a.Token != "" {
+			lg.Printf("client %s: token %s of user %s: %s %s\n", cfg.remoteAddr(r), a.Token, a.User, r.Method, r.URL.Path)
+			if err = cfg.store.TouchToken(a.Token, time.Now().Format(timeFormat)); err != nil {
+				lg.Printf("update token %s error: %s\n", a.Token, err)
+			}
+			scope := ScopeRead
+			if admin {
+				scope = ScopeAdmin
+			}
+			if !a.HasScope(scope) {
+				lg.Printf("[Error] client %s: token %s has no %s scope: %s\n", cfg.remoteAddr(r), a.Token, scope, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "token scope %s required", scope)
+				return
+			}
+		}
+		if admin && !a.IsAdmin() {
+			lg.Printf("[Error] client %s: user %s is not admin: %s\n", cfg.remoteAddr(r), a.User, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "admin required")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey, a)))
+	}
+}
+
+//当前用户，返回给页面显示，Admin为true时显示管理页面
+type loginUser struct {
+	User  string   `json:"user"`
+	Admin bool     `json:"admin"`
+	Roles []string `json:"roles"`
+}
+
+func newLoginUser(a *Access) *loginUser {
+	return &loginUser{User: a.User, Admin: a.IsAdmin(), Roles: a.Roles}
+}
+
+//会话cookie是否只通过https发送
+//在反向代理后运行时TLS由代理处理，只相信trusted_proxies中的代理设置的X-Forwarded-Proto
+func (cfg *Config) secure(r *http.Request) bool {
+	if cfg.SecureCookie || r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(ip, cfg.proxies) {
+		return false
+	}
+	//经过多个代理时第一个值是客户端使用的协议
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+//POST user和password，成功时设置会话cookie
+func (cfg *Config) Login(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		lg.Printf("[Error] client %s: %s\n", cfg.remoteAddr(r), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := r.PostFormValue("user")
+	a, err := cfg.checkLogin(user, r.PostFormValue("password"), lg)
+	if err == errLogin {
+		lg.Printf("[Error] client %s: login %q failed: %s\n", cfg.remoteAddr(r), user, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err)
+		return
+	} else if err != nil {
+		lg.Printf("[Error] client %s: login %q: %s\n", cfg.remoteAddr(r), user, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		lg.Printf("create session error: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(cfg.sessionHours()) * time.Hour)
+	//登录时清理过期的会话
+	if err = cfg.store.DeleteExpiredSessions(now.Format(timeFormat)); err != nil {
+		lg.Printf("delete expired sessions error: %s\n", err)
+	}
+	sess := &Session{
+		ID:      hashToken(token),
+		User:    a.User,
+		Created: now.Format(timeFormat),
+		Expires: expires.Format(timeFormat),
+		Source:  a.Source,
+	}
+	if a.Source == SourceLDAP {
+		sess.Role = strings.Join(a.Roles, ",")
+	}
+	if err = cfg.store.InsertSession(sess); err != nil {
+		lg.Printf("insert session error: %s\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   cfg.secure(r),
+		//其他站点的请求不带cookie
+		SameSite: http.SameSiteStrictMode,
+	})
+	lg.Printf("client %s: user %s login via %s, roles: %s\n", cfg.remoteAddr(r), a.User, a.Source, strings.Join(a.Roles, ","))
+	if err = writeJSON(w, newLoginUser(a)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//删除会话和cookie
+func (cfg *Config) Logout(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		if err = cfg.store.DeleteSession(hashToken(c.Value)); err != nil {
+			lg.Printf("[Error] client %s: delete session: %s\n", cfg.remoteAddr(r), err)
+		} else {
+			lg.Printf("client %s: logout\n", cfg.remoteAddr(r))
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: cfg.secure(r), SameSite: http.SameSiteStrictMode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//已登录的用户
+func (cfg *Config) Me(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if err := writeJSON(w, newLoginUser(requestAccess(r))); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
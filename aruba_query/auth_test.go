@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoginSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*UserPassword{{User: "root", Admin: true}, {User: "viewer"}} {
+		if u.Password, err = HashPassword("password"); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{store: s, TrustedProxies: []string{"10.0.0.2"}}
+	if err = cfg.ParseProxies(); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	lg := log.New(&logs, "", 0)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	login := func(user, password string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {user}, "password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "198.51.100.7:40000"
+		if prepare != nil {
+			prepare(r)
+		}
+		cfg.Login(w, r, lg)
+		return w
+	}
+	call := func(admin bool, cookie *http.Cookie) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/me", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		cfg.auth(admin, lg, ok)(w, r)
+		return w.Code
+	}
+	session := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookie {
+				return c
+			}
+		}
+		t.Fatalf("no session cookie: %v", w.Header())
+		return nil
+	}
+
+	//失败的登录记录代理转发的客户端地址
+	w := login("root", "wrong", func(r *http.Request) {
+		r.RemoteAddr = "10.0.0.2:40000"
+		r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password got %d", w.Code)
+	}
+	if !strings.Contains(logs.String(), `client 203.0.113.9: login "root" failed`) {
+		t.Errorf("failed login not logged:\n%s", logs.String())
+	}
+	if w = login("nobody", "password", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown user got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	cfg.Login(w, httptest.NewRequest("GET", "/login?user=root&password=password", nil), lg)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /login got %d", w.Code)
+	}
+
+	//只有https请求或者可信的代理转发的https请求设置Secure
+	var secures = []struct {
+		name    string
+		prepare func(r *http.Request)
+		secure  bool
+	}{
+		{"http", nil, false},
+		{"tls", func(r *http.Request) { r.TLS = &tls.ConnectionState{} }, true},
+		{"trusted proxy", func(r *http.Request) {
+			r.RemoteAddr = "10.0.0.2:40000"
+			r.Header.Set("X-Forwarded-Proto", "https")
+		}, true},
+		{"untrusted proxy", func(r *http.Request) { r.Header.Set("X-Forwarded-Proto", "https") }, false},
+		{"trusted proxy http", func(r *http.Request) {
+			r.RemoteAddr = "10.0.0.2:40000"
+			r.Header.Set("X-Forwarded-Proto", "http")
+		}, false},
+	}
+	for _, c := range secures {
+		w = login("viewer", "password", c.prepare)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: login got %d", c.name, w.Code)
+		}
+		if cookie := session(w); cookie.Secure != c.secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+			t.Errorf("%s: cookie = %+v", c.name, cookie)
+		}
+	}
+	cfg.SecureCookie = true
+	if cookie := session(login("viewer", "password", nil)); !cookie.Secure {
+		t.Error("secure_cookie: cookie not secure")
+	}
+	cfg.SecureCookie = false
+
+	viewer := session(login("viewer", "password", nil))
+	root := session(login("root", "password", nil))
+	var cases = []struct {
+		name   string
+		admin  bool
+		cookie *http.Cookie
+		status int
+	}{
+		{"no cookie", false, nil, http.StatusUnauthorized},
+		{"unknown session", false, &http.Cookie{Name: sessionCookie, Value: "forged"}, http.StatusUnauthorized},
+		{"viewer", false, viewer, http.StatusOK},
+		{"viewer on admin", true, viewer, http.StatusForbidden},
+		{"admin", true, root, http.StatusOK},
+	}
+	for _, c := range cases {
+		if code := call(c.admin, c.cookie); code != c.status {
+			t.Errorf("%s: got %d, want %d", c.name, code, c.status)
+		}
+	}
+
+	//过期的会话返回401并被删除
+	if _, err = s.db.Exec(`update sessions set expires_at = '2017-01-01 00:00:00' where id = ?`, hashToken(viewer.Value)); err != nil {
+		t.Fatal(err)
+	}
+	if code := call(false, viewer); code != http.StatusUnauthorized {
+		t.Errorf("expired session got %d", code)
+	}
+	if _, err = s.SelectSession(hashToken(viewer.Value)); err == nil {
+		t.Error("expired session not deleted")
+	}
+
+	//退出后删除会话和cookie
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(root)
+	cfg.Logout(w, r, lg)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("logout got %d", w.Code)
+	}
+	if cookie := session(w); cookie.MaxAge >= 0 || cookie.Value != "" {
+		t.Errorf("logout cookie = %+v", cookie)
+	}
+	if code := call(true, root); code != http.StatusUnauthorized {
+		t.Errorf("session after logout got %d", code)
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -16,6 +16,26 @@ type Data struct {
 	MAC  string
 	OS   string
 	TIME string
+	//wired或wireless，无线客户端有SSID、信噪比和速率
+	MEDIUM string
+	SSID   string
+	SIGNAL int
+	SPEED  int
+	//aruba_get分类的设备类型
+	CLASS string
+	//mac地址的厂商，RANDOM为true时是本地管理的随机mac
+	VENDOR string
+	RANDOM bool
+}
+
+//查询客户端的条件，为空的条件不使用
+type ClientFilter struct {
+	MAC    string
+	Medium string
+	Class  string
+	//厂商名称包含Vendor，不区分大小写
+	Vendor string
+	Random *bool
 }
 
 type byTime []*Data
@@ -35,27 +55,73 @@ type Clients struct {
 	Data []*Data `json:"data"`
 }
 
-//mysql database configure
-type MysqlDB struct {
+//database configure, driver为mysql(默认)或者sqlite3
+type DBConfig struct {
+	Driver   string `json:"driver"`
 	Host     string `json:"host"`
 	Port     string `json:"port"`
 	User     string `json:"user"`
 	Password string `json:"password"`
 	DB       string `json:"db"`
+	//sqlite3数据库文件, 相对路径基于程序目录
+	Path string `json:"path,omitempty"`
 }
 
 //配置文件
 type Config struct {
-	Addr     string  `json:"addr"`
-	Duration int     `json:'duration"`
-	Database MysqlDB `json:"database"`
-	cache    string
-	db       *sql.DB
+	Addr     string   `json:"addr"`
+	Duration int      `json:"duration"`
+	Database DBConfig `json:"database"`
+	//登录会话的有效期(小时)，默认为12
+	Session int `json:"session,omitempty"`
+	//会话cookie总是设置Secure，只通过https发送；为false时只在https请求或者可信的代理转发的https请求中设置
+	SecureCookie bool `json:"secure_cookie,omitempty"`
+	//ldap或者Active Directory登录
+	LDAP *LDAPConfig `json:"ldap,omitempty"`
+	//角色名称到可以查询和修改的路由器，viewer和admin是内置的角色
+	Roles map[string]*Role `json:"roles,omitempty"`
+	//反向代理的ip或者CIDR，只有来自这些地址的请求使用X-Forwarded-For中的客户端ip
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	cache          string
+	store          Store
+	proxies        []*net.IPNet
 }
 
-func (cfg *Config) OpenMysql() {
-	db := OpenMysql(cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.Password, cfg.Database.DB)
-	cfg.db = db
+//解析trusted_proxies，单个ip作为只包含该ip的网段
+func (cfg *Config) ParseProxies() error {
+	cfg.proxies = nil
+	for _, p := range cfg.TrustedProxies {
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			cfg.proxies = append(cfg.proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("trusted_proxies: invalid ip or cidr %q", p)
+		}
+		cfg.proxies = append(cfg.proxies, n)
+	}
+	return nil
+}
+
+//打开配置的数据库
+func (cfg *Config) OpenStore() error {
+	if cfg.Database.Driver == "sqlite3" && !filepath.IsAbs(cfg.Database.Path) {
+		cfg.Database.Path = filepath.Join(Basedir(), cfg.Database.Path)
+	}
+	if cfg.Database.Driver == "sqlite3" {
+		Mkdir(filepath.Dir(cfg.Database.Path))
+	}
+	s, err := OpenStore(&cfg.Database)
+	if err != nil {
+		return err
+	}
+	cfg.store = s
+	return nil
 }
 
 //生成配置文件到file
@@ -105,7 +171,8 @@ func Mkdir(dir string) {
 }
 
 func NewLogger(f string) *log.Logger {
-	file, err := os.Create(f)
+	//追加到原有日志，重启时不清空
+	file, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		log.Fatalln(err)
 	}
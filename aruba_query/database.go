@@ -3,20 +3,342 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+//mysql和sqlite3共用的sql实现
+type sqlStore struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func (s *sqlStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+//mysql存储
+type Mysql struct {
+	sqlStore
+}
+
 //连接数据库
-func OpenMysql(host, port, user, password, database string) *sql.DB {
+func OpenMysql(host, port, user, password, database string) (*Mysql, error) {
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
 		user, password, host, port, database))
 	if err != nil {
-		log.Fatalf("open mysql failed: %s", err)
+		return nil, fmt.Errorf("open mysql failed: %s", err)
+	}
+	return &Mysql{sqlStore{db, mysqlMigrations}}, nil
+}
+
+//mysql数据库版本，与aruba_get保持一致
+var mysqlMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Before:  adoptLegacyMysql,
+		Up: []string{
+			`create table if not exists routers (
+				code varchar(10) not null,
+				name varchar(100) not null default '',
+				gateway varchar(15) not null default '',
+				wanip varchar(15) not null default '',
+				area varchar(100) not null default '',
+				sp varchar(100) not null default '',
+				autoupdate tinyint(1) not null default 1,
+				primary key (code)
+			) engine=InnoDB default charset=utf8`,
+			`create table if not exists users (
+				user varchar(100) not null,
+				password varchar(256) not null,
+				admin tinyint(1) not null default 0,
+				primary key (user)
+			) engine=InnoDB default charset=utf8`,
+			//client_sightings按月分区，pmax保存尚未建立分区的数据
+			`create table if not exists client_sightings (
+				id bigint unsigned not null auto_increment,
+				code varchar(10) not null,
+				name varchar(100) not null default '',
+				ip varchar(15) not null,
+				mac char(17) not null,
+				os varchar(50) not null default '',
+				network varchar(10) not null default 'eth1',
+				ap char(17) not null,
+				role varchar(50) not null,
+				time timestamp not null default current_timestamp,
+				primary key (code, time, id),
+				key id (id),
+				key mac (mac)
+			) engine=InnoDB default charset=utf8
+			partition by range (unix_timestamp(time)) (
+				partition pmax values less than maxvalue
+			)`,
+		},
+		Down: []string{
+			`drop table if exists client_sightings`,
+			`drop table if exists users`,
+			`drop table if exists routers`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "sightings migration progress",
+		Up: []string{
+			`create table if not exists sightings_migration (
+				code varchar(10) not null,
+				last_id bigint not null default 0,
+				primary key (code)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists sightings_migration`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "collection runs",
+		Up: []string{
+			`create table if not exists collection_runs (
+				id bigint unsigned not null auto_increment,
+				mode varchar(10) not null default 'cron',
+				started_at datetime not null,
+				finished_at datetime not null,
+				total int not null default 0,
+				succeeded int not null default 0,
+				failed int not null default 0,
+				fallback int not null default 0,
+				skipped int not null default 0,
+				duration_ms bigint not null default 0,
+				primary key (id),
+				key started_at (started_at)
+			) engine=InnoDB default charset=utf8`,
+			`create table if not exists collection_run_routers (
+				id bigint unsigned not null auto_increment,
+				run_id bigint unsigned not null,
+				code varchar(10) not null,
+				wanip varchar(15) not null default '',
+				gateway varchar(15) not null default '',
+				fallback tinyint(1) not null default 0,
+				status varchar(10) not null,
+				error_text text,
+				clients int not null default 0,
+				started_at datetime not null,
+				duration_ms bigint not null default 0,
+				primary key (id),
+				key run_id (run_id),
+				key code_started_at (code, started_at)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists collection_run_routers`,
+			`drop table if exists collection_runs`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "router inventory",
+		Up: []string{
+			`alter table routers
+				add column model varchar(100) not null default '',
+				add column serial varchar(50) not null default '',
+				add column firmware varchar(50) not null default '',
+				add column lan_mac varchar(17) not null default '',
+				add column uptime bigint not null default 0,
+				add column last_contact varchar(19) not null default '',
+				add column ap_clients int not null default 0,
+				add column inventory_at varchar(19) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers
+				drop column model,
+				drop column serial,
+				drop column firmware,
+				drop column lan_mac,
+				drop column uptime,
+				drop column last_contact,
+				drop column ap_clients,
+				drop column inventory_at`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "client medium",
+		Up: []string{
+			`alter table client_sightings
+				add column medium varchar(10) not null default 'wired',
+				add column ssid varchar(64) not null default '',
+				add column band varchar(10) not null default '',
+				add column channel varchar(10) not null default '',
+				add column snr int not null default 0,
+				add column speed int not null default 0,
+				add column auth varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings
+				drop column medium,
+				drop column ssid,
+				drop column band,
+				drop column channel,
+				drop column snr,
+				drop column speed,
+				drop column auth`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "client class",
+		Up: []string{
+			`alter table client_sightings add column class varchar(20) not null default ''`,
+		},
+		Down: []string{
+			`alter table client_sightings drop column class`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "client vendor",
+		Up: []string{
+			`alter table client_sightings
+				add column vendor varchar(100) not null default '',
+				add column random tinyint(1) not null default 0`,
+		},
+		Down: []string{
+			`alter table client_sightings
+				drop column vendor,
+				drop column random`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "router transport",
+		Up: []string{
+			`alter table routers add column transport varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table routers drop column transport`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "user sessions",
+		Up: []string{
+			//id为会话token的sha256，token只保存在浏览器的cookie中
+			`create table if not exists sessions (
+				id char(64) not null,
+				user varchar(100) not null,
+				created_at datetime not null,
+				expires_at datetime not null,
+				primary key (id),
+				key user (user),
+				key expires_at (expires_at)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists sessions`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "session source",
+		Up: []string{
+			//source为local或ldap，ldap用户的角色在登录时确定
+			`alter table sessions
+				add column source varchar(10) not null default 'local',
+				add column role varchar(10) not null default ''`,
+		},
+		Down: []string{
+			`alter table sessions
+				drop column source,
+				drop column role`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "user roles",
+		Up: []string{
+			//逗号分隔的角色名称，角色在aruba_query的配置中定义
+			`alter table users add column roles varchar(255) not null default ''`,
+			`alter table sessions modify column role varchar(255) not null default ''`,
+		},
+		Down: []string{
+			`alter table users drop column roles`,
+			`alter table sessions modify column role varchar(10) not null default ''`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "api tokens",
+		Up: []string{
+			//hash为token的sha256，token只在创建时显示一次；expires_at为null时不过期
+			`create table if not exists api_tokens (
+				id char(16) not null,
+				user varchar(100) not null,
+				name varchar(100) not null default '',
+				hash char(64) not null,
+				scopes varchar(20) not null default 'read',
+				source varchar(10) not null default 'local',
+				role varchar(255) not null default '',
+				created_at datetime not null,
+				expires_at datetime null,
+				last_used_at datetime null,
+				primary key (id),
+				unique key hash (hash),
+				key user (user)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists api_tokens`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "audit log",
+		Up: []string{
+			//路由器和用户的修改记录，actor_type为user、token、collector、system或cli，changes为修改前后的json
+			`create table if not exists audit_log (
+				id bigint not null auto_increment,
+				created_at datetime not null,
+				actor_type varchar(10) not null,
+				actor varchar(100) not null,
+				token char(16) not null default '',
+				ip varchar(45) not null default '',
+				object varchar(10) not null,
+				target varchar(100) not null,
+				action varchar(10) not null,
+				changes text not null,
+				primary key (id),
+				key created_at (created_at),
+				key object_target (object, target)
+			) engine=InnoDB default charset=utf8`,
+		},
+		Down: []string{
+			`drop table if exists audit_log`,
+		},
+	},
+}
+
+//旧版本由db/aruba.sql建立的数据库没有schema_version，routers缺少autoupdate列，
+//template_client只是每个路由器客户端表的模板，使用client_sightings后不再需要
+func adoptLegacyMysql(db *sql.DB) error {
+	var columns, autoupdate int
+	err := db.QueryRow(`select count(*), coalesce(sum(column_name = 'autoupdate'), 0) from information_schema.columns
+	where table_schema = database() and table_name = 'routers'`).Scan(&columns, &autoupdate)
+	if err != nil {
+		return err
+	}
+	if columns > 0 && autoupdate == 0 {
+		if _, err = db.Exec(`alter table routers add column autoupdate tinyint(1) not null default 1`); err != nil {
+			return err
+		}
 	}
-	return db
+	_, err = db.Exec(`drop table if exists template_client`)
+	return err
 }
 
 //用于初始化数据库和连接路由器
@@ -28,11 +350,23 @@ type Router struct {
 	Area       string `json:"area"`
 	SP         string `json:"service_provider"`
 	AutoUpdate int    `json:"auto_update"`
+	//采集时执行命令的方式：rest、cgi或者ssh，为空时根据aruba_get的配置选择
+	Transport string `json:"transport"`
+
+	//airwave中的ap资产信息，每次刷新路由器列表时更新
+	Model       string `json:"model"`
+	Serial      string `json:"serial"`
+	Firmware    string `json:"firmware"`
+	LanMAC      string `json:"lan_mac"`
+	Uptime      int64  `json:"uptime"`
+	LastContact string `json:"last_contact"`
+	APClients   int    `json:"ap_clients"`
+	InventoryAt string `json:"inventory_at"`
 }
 
-func UpdateRouterSP(db *sql.DB, r *Router) error {
+func (s *sqlStore) UpdateRouterSP(r *Router) error {
 	r = ToUpper(r)
-	_, err := db.Exec(`update routers set sp=? where code = ?`, r.SP, r.Code)
+	_, err := s.db.Exec(`update routers set sp=? where code = ?`, r.SP, r.Code)
 	return err
 }
 
@@ -42,15 +376,16 @@ func ToUpper(r *Router) *Router {
 	return r
 }
 
-func UpdateRouter(db *sql.DB, r *Router) error {
+func (s *sqlStore) UpdateRouter(r *Router) error {
 	r = ToUpper(r)
-	_, err := db.Exec(`update routers set name=?, gateway=?, area=?, sp=?, autoupdate=? where code = ?`, r.Name, r.GateWay, r.Area, r.SP, r.AutoUpdate, r.Code)
+	_, err := s.db.Exec(`update routers set name=?, gateway=?, area=?, sp=?, autoupdate=?, transport=? where code = ?`, r.Name, r.GateWay, r.Area, r.SP, r.AutoUpdate, r.Transport, r.Code)
 	return err
 }
 
-func DeleteRouter(db *sql.DB, r *Router) error {
+//删除路由器及其客户端记录
+func (s *sqlStore) DeleteRouter(r *Router) error {
 	r = ToUpper(r)
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
@@ -58,34 +393,44 @@ func DeleteRouter(db *sql.DB, r *Router) error {
 	if _, err = tx.Exec(`delete from routers where code = ?`, r.Code); err != nil {
 		return err
 	}
-	if _, err = tx.Exec(`drop table IF EXITS ?`, r.Code); err != nil {
+	if _, err = tx.Exec(`delete from client_sightings where code = ?`, r.Code); err != nil {
 		return err
 	}
 	return tx.Commit()
-
 }
 
-func SelectRouter(db *sql.DB, code string) (*Router, error) {
-	code = strings.ToUpper(code)
-	row := db.QueryRow(`select code, name, gateway, wanip, area, sp, autoupdate from routers where code = ?`, code)
-	var router = new(Router)
-	if err := row.Scan(&router.Code, &router.Name, &router.GateWay, &router.Wanip, &router.Area, &router.SP, &router.AutoUpdate); err != nil {
+const routerColumns = `code, name, gateway, wanip, area, sp, autoupdate, transport,
+	model, serial, firmware, lan_mac, uptime, last_contact, ap_clients, inventory_at`
+
+func scanRouter(row interface {
+	Scan(dest ...interface{}) error
+}) (*Router, error) {
+	var r = new(Router)
+	err := row.Scan(&r.Code, &r.Name, &r.GateWay, &r.Wanip, &r.Area, &r.SP, &r.AutoUpdate, &r.Transport,
+		&r.Model, &r.Serial, &r.Firmware, &r.LanMAC, &r.Uptime, &r.LastContact, &r.APClients, &r.InventoryAt)
+	if err != nil {
 		return nil, err
 	}
-	return router, nil
+	return r, nil
+}
+
+func (s *sqlStore) SelectRouter(code string) (*Router, error) {
+	code = strings.ToUpper(code)
+	row := s.db.QueryRow(`select `+routerColumns+` from routers where code = ?`, code)
+	return scanRouter(row)
 }
 
 //从tab表获取router列表
-func SelectRouters(db *sql.DB) ([]*Router, error) {
+func (s *sqlStore) SelectRouters() ([]*Router, error) {
 	var rs = make([]*Router, 0)
-	rows, err := db.Query(`select code, name, gateway, wanip, area, sp, autoupdate from routers`)
+	rows, err := s.db.Query(`select ` + routerColumns + ` from routers`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var r = new(Router)
-		if err = rows.Scan(&r.Code, &r.Name, &r.GateWay, &r.Wanip, &r.Area, &r.SP, &r.AutoUpdate); err != nil {
+		r, err := scanRouter(rows)
+		if err != nil {
 			return nil, err
 		}
 		rs = append(rs, r)
@@ -96,28 +441,29 @@ func SelectRouters(db *sql.DB) ([]*Router, error) {
 	return rs, nil
 }
 
-//使用month(timestamp)
-func SelectClientsByTime(db *sql.DB, tab, begin, end, mac string) ([]*Data, error) {
+//查询路由器code在begin和end之间的client
+func (s *sqlStore) SelectClientsByTime(code, begin, end string, f *ClientFilter) ([]*Data, error) {
 	var (
-		rows *sql.Rows
-		err  error
+		query = `select ip, mac, os, time, medium, ssid, snr, speed, class, vendor, random from client_sightings
+		where code = ? and time between ? and ?`
+		args = []interface{}{strings.ToUpper(code), begin, end}
 	)
-
-	if mac != "" {
-		query := fmt.Sprintf(`select ip, mac, os, time from %s where time between ? and ? and mac = ?`, tab)
-		rows, err = db.Query(query, begin, end, mac)
-	} else {
-		query := fmt.Sprintf(`select ip, mac, os, time from %s where time between ? and ?`, tab)
-		rows, err = db.Query(query, begin, end)
+	if f != nil && f.MAC != "" {
+		query += ` and mac = ?`
+		args = append(args, f.MAC)
 	}
+	cond, cargs := f.where()
+	rows, err := s.db.Query(query+cond, append(args, cargs...)...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var ds = make([]*Data, 0)
 	for rows.Next() {
 		var d = new(Data)
-		if err = rows.Scan(&d.IP, &d.MAC, &d.OS, &d.TIME); err != nil {
+		if err = rows.Scan(&d.IP, &d.MAC, &d.OS, &d.TIME, &d.MEDIUM, &d.SSID, &d.SIGNAL, &d.SPEED, &d.CLASS,
+			&d.VENDOR, &d.RANDOM); err != nil {
 			return nil, err
 		}
 		ds = append(ds, d)
@@ -128,32 +474,90 @@ func SelectClientsByTime(db *sql.DB, tab, begin, end, mac string) ([]*Data, erro
 	return ds, nil
 }
 
+//medium、class、vendor和random对应的查询条件
+func (f *ClientFilter) where() (string, []interface{}) {
+	var (
+		cond string
+		args []interface{}
+	)
+	if f == nil {
+		return cond, args
+	}
+	if f.Medium != "" {
+		cond += ` and medium = ?`
+		args = append(args, f.Medium)
+	}
+	if f.Class != "" {
+		cond += ` and class = ?`
+		args = append(args, f.Class)
+	}
+	if f.Vendor != "" {
+		cond += ` and lower(vendor) like ?`
+		args = append(args, "%"+strings.ToLower(f.Vendor)+"%")
+	}
+	if f.Random != nil {
+		cond += ` and random = ?`
+		args = append(args, *f.Random)
+	}
+	return cond, args
+}
+
+//统计begin和end之间每个路由器的client记录数
+func (s *sqlStore) CountClientsByTime(begin, end string, f *ClientFilter) (map[string]int, error) {
+	cond, args := f.where()
+	rows, err := s.db.Query(`select code, count(*) from client_sightings
+	where time between ? and ?`+cond+` group by code`, append([]interface{}{begin, end}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts = make(map[string]int)
+	for rows.Next() {
+		var (
+			code  string
+			count int
+		)
+		if err = rows.Scan(&code, &count); err != nil {
+			return nil, err
+		}
+		counts[code] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
 type UserPassword struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Admin    bool   `json:"admin"`
+	//逗号分隔的角色名称，为空时admin为false的用户是viewer
+	Roles string `json:"roles"`
 }
 
-func InsertUser(db *sql.DB, user *UserPassword) error {
-	_, err := db.Exec(`insert into users (user, password, admin) values (?, ?, ?)`, user.User, user.Password, user.Admin)
+func (s *sqlStore) InsertUser(user *UserPassword) error {
+	_, err := s.db.Exec(`insert into users (user, password, admin, roles) values (?, ?, ?, ?)`,
+		user.User, user.Password, user.Admin, user.Roles)
 	return err
 }
 
-func DeleteUser(db *sql.DB, username string) error {
-	_, err := db.Exec(`delete from users where user = ?`, username)
+func (s *sqlStore) DeleteUser(username string) error {
+	_, err := s.db.Exec(`delete from users where user = ?`, username)
 	return err
 }
 
-func UpdateUser(db *sql.DB, user *UserPassword) error {
-	_, err := db.Exec(`update users set user=?, password=?, admin=?`,
-		user.User, user.Password, user.Admin)
+func (s *sqlStore) UpdateUser(user *UserPassword) error {
+	_, err := s.db.Exec(`update users set password=?, admin=?, roles=? where user = ?`,
+		user.Password, user.Admin, user.Roles, user.User)
 	return err
 }
 
-func SelectUser(db *sql.DB, username string) (*UserPassword, error) {
-	row := db.QueryRow(`select user, password, admin from users where user = ?`, username)
+func (s *sqlStore) SelectUser(username string) (*UserPassword, error) {
+	row := s.db.QueryRow(`select user, password, admin, roles from users where user = ?`, username)
 	var up = new(UserPassword)
-	if err := row.Scan(&up.User, &up.Password, &up.Admin); err != nil {
+	if err := row.Scan(&up.User, &up.Password, &up.Admin, &up.Roles); err != nil {
 		return nil, err
 	}
 	return up, nil
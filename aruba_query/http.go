@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,15 +10,18 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Server struct {
 	*http.ServeMux
-	IPS    []net.IP
-	IPNET  []*net.IPNet
-	Logger *log.Logger
+	IPS   []net.IP
+	IPNET []*net.IPNet
+	//可信的反向代理，来自这些地址的请求按X-Forwarded-For检查whitelist
+	Proxies []*net.IPNet
+	Logger  *log.Logger
 }
 
 func NewServer(wl string, l *log.Logger) (*Server, error) {
@@ -67,29 +71,68 @@ func (srv *Server) Allowed(ip net.IP) bool {
 
 //实现ServeHTTP: 并检查IP地址是否允许访问
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var ip string
-	if xforwarfor := r.Header.Get("X-Forward-For"); xforwarfor != "" {
-		ip = xforwarfor
-		if srv.Allowed(net.ParseIP(xforwarfor)) {
-			srv.ServeMux.ServeHTTP(w, r)
-		}
-	} else if tcpAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr); srv.Allowed(tcpAddr.IP) {
-		ip = tcpAddr.IP.String()
+	//带API token的接口请求不检查whitelist，由auth检查token
+	if bearerToken(r) != "" && tokenPath(r.URL.Path) {
 		srv.ServeMux.ServeHTTP(w, r)
-	} else {
-		srv.Logger.Printf("client %s connect not allowed\n", ip)
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintf(w, "ip no allowed: %s", ip)
+		return
+	}
+	ip := clientIP(r, srv.Proxies)
+	if ip != nil && srv.Allowed(ip) {
+		srv.ServeMux.ServeHTTP(w, r)
+		return
 	}
+	srv.Logger.Printf("client %s(%s) connect not allowed\n", ip, r.RemoteAddr)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "ip no allowed: %s", ip)
 }
 
-func (cfg *Config) UpdateRouter(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
-	/*
-		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+//请求的来源ip，地址无效时返回nil
+//直接连接的地址是可信的代理时，从右向左取X-Forwarded-For中第一个不是代理的地址，客户端自己添加的地址不会被使用
+func clientIP(r *http.Request, proxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	//兼容旧版本代理设置的X-Forward-For
+	hops := r.Header["X-Forwarded-For"]
+	if len(hops) == 0 {
+		hops = r.Header["X-Forward-For"]
+	}
+	hops = strings.Split(strings.Join(hops, ","), ",")
+	for i := len(hops) - 1; i >= 0 && ip != nil && trusted(ip, proxies); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+//日志和审计中记录的客户端地址，与whitelist的检查使用相同的来源ip
+func (cfg *Config) remoteAddr(r *http.Request) string {
+	if ip := clientIP(r, cfg.proxies); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+func trusted(ip net.IP, proxies []*net.IPNet) bool {
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
 		}
-	*/
+	}
+	return false
+}
+
+func (cfg *Config) UpdateRouter(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	//只接受POST，避免通过链接修改路由器
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -104,21 +147,35 @@ func (cfg *Config) UpdateRouter(w http.ResponseWriter, r *http.Request, lg *log.
 		return
 	}
 	code := strings.ToUpper(codeValue)
-	router, err := SelectRouter(cfg.db, code)
+	router, err := cfg.store.SelectRouter(code)
 	if err != nil {
 		lg.Printf("[Error] client %s: select code %s %s\n", r.RemoteAddr, code, err)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "code %s not found in data", codeValue)
 		return
 	}
+	a := requestAccess(r)
+	if !a.CanAdmin(router) {
+		lg.Printf("[Error] client %s: user %s can not update router %s\n", r.RemoteAddr, a.User, code)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied for router %s", code)
+		return
+	}
+	before := *router
 
 	router.Name = r.FormValue("name")
 	router.GateWay = r.FormValue("gateway")
-	router.Wanip = r.FormValue("wanip")
 	area := r.FormValue("area")
 	if area != "" {
 		router.Area = area
 	}
+	//不能把路由器移到自己不能管理的区域
+	if !a.CanAdmin(router) {
+		lg.Printf("[Error] client %s: user %s can not move router %s to area %s\n", r.RemoteAddr, a.User, code, area)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "permission denied for area %s", area)
+		return
+	}
 	router.SP = r.FormValue("service_provider")
 	autoupdate := r.FormValue("auto_update")
 	if autoupdate == "yes" {
@@ -126,47 +183,55 @@ func (cfg *Config) UpdateRouter(w http.ResponseWriter, r *http.Request, lg *log.
 	} else {
 		router.AutoUpdate = 0
 	}
+	//没有transport参数时保持原来的设置
+	if _, ok := r.Form["transport"]; ok {
+		transport := r.FormValue("transport")
+		if !validTransport(transport) {
+			lg.Printf("[Error] client %s: invalid transport %q\n", r.RemoteAddr, transport)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid transport %q, should be empty, rest, cgi or ssh", transport)
+			return
+		}
+		router.Transport = transport
+	}
 
-	if err := UpdateRouter(cfg.db, router); err != nil {
+	if err := cfg.store.UpdateRouter(router); err != nil {
 		lg.Printf("update router error: %s\n", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintln(w, err)
 		return
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	//按保存后的记录比较，wanip等不能在这里修改的字段不会记为修改
+	after, err := cfg.store.SelectRouter(code)
+	if err != nil {
+		lg.Printf("[Error] client %s: select code %s %s\n", r.RemoteAddr, code, err)
+		after = router
+	}
+	if cs := routerChanges(&before, after); len(cs) > 0 {
+		cfg.audit(r, lg, ObjectRouter, router.Code, ActionUpdate, cs)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	fmt.Fprint(w, `{"status": "update router success"}`)
 }
 
+//管理页面的路由器，只返回当前用户可以修改的
 func (cfg *Config) GetRouters(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
-	routers, err := SelectRouters(cfg.db)
+	routers, err := cfg.store.SelectRouters()
 	if err != nil {
 		lg.Printf("[Error] client %s: select routers %s\n", r.RemoteAddr, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	routers = requestAccess(r).administrable(routers)
 
-	b, err := json.MarshalIndent(routers, "", "  ")
-	if err != nil {
+	if err = writeJSON(w, routers); err != nil {
 		lg.Println("json", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, "print json error")
 		return
 	}
-	callback := r.FormValue("callback")
-	var s string
-	if callback != "" {
-		s = fmt.Sprintf("%s(%s)", callback, b)
-	} else {
-		s = string(b)
-	}
 	lg.Printf("client %s get routers success\n", r.RemoteAddr)
-
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	fmt.Fprintf(w, "%s", s)
 }
 
 type analysis struct {
@@ -183,7 +248,7 @@ func (a byCount) Len() int           { return len(a) }
 func (a byCount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byCount) Less(i, j int) bool { return a[i].Count < a[j].Count }
 
-//分析所有路由器上指定月份（如：2016-04）的在线客户端次数
+//分析当前用户可以查询的路由器上指定月份（如：2016-04）的在线客户端次数
 func (cfg *Config) AnalysisOfCounts(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
 	if err := r.ParseForm(); err != nil {
 		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
@@ -205,6 +270,13 @@ func (cfg *Config) AnalysisOfCounts(w http.ResponseWriter, r *http.Request, lg *
 		fmt.Fprint(w, "month is empty")
 		return
 	}
+	f, err := clientFilter(r)
+	if err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
 	//开始时间为每月的第一天
 	begin := fmt.Sprintf("%s-%s-01", year, month)
 	const queryFormat = `2006-01-02`
@@ -219,62 +291,48 @@ func (cfg *Config) AnalysisOfCounts(w http.ResponseWriter, r *http.Request, lg *
 	//结束时间为下一个月的第一天
 	end := t.AddDate(0, 1, 0).Format(queryFormat)
 
-	var res string
 	// 执行查询操作
-	rs, err := SelectRouters(cfg.db)
+	rs, err := cfg.store.SelectRouters()
 	if err != nil {
 		lg.Printf("analysis of month %s error: %s\n", begin, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintln(w, err)
 		return
 	}
+	//一次查询所有路由器的记录数
+	counts, err := cfg.store.CountClientsByTime(begin, end, f)
+	if err != nil {
+		lg.Printf("analysis of month %s error: %s\n", begin, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if len(rs) == 0 {
+		lg.Print("analysis of month error: the length of result is 0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "the length of result is 0")
+		return
+	}
+	//没有权限的路由器不显示，结果可以为空
+	rs = requestAccess(r).readable(rs)
 	var as = make([]*analysis, 0)
 	for i := 0; i < len(rs); i++ {
-		cs, err := SelectClientsByTime(cfg.db, rs[i].Code, begin, end, "")
-		a := &analysis{
+		as = append(as, &analysis{
 			Code:    rs[i].Code,
 			Name:    rs[i].Name,
 			Gateway: rs[i].GateWay,
-		}
-		if err != nil {
-			lg.Printf("analysis of month %s error: %s %s\n", begin, rs[i].Code, err)
-			a.Count = -1
-		} else {
-			a.Count = len(cs)
-		}
-		as = append(as, a)
-		if len(as) == 0 {
-			lg.Print("analysis of month error: the length of result is 0")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			fmt.Fprintln(w, "the length of result is 0")
-			return
-		}
-
-		//反向排序，count值大的在前
-		sort.Sort(sort.Reverse(byCount(as)))
-
-		b, err := json.MarshalIndent(as, "", "  ")
-		if err != nil {
-			lg.Printf("analysis of month error: %s\n", err)
-			w.WriteHeader(http.StatusServiceUnavailable)
-			fmt.Fprintln(w, err)
-			return
-		}
-		res = string(b)
+			Count:   counts[rs[i].Code],
+		})
 	}
 
-	//jquery AJAX callback随机函数名
-	callback := r.FormValue("callback")
-	var s string
-	if callback != "" {
-		s = fmt.Sprintf("%s(%s)", callback, res)
-	} else {
-		s = res
+	//反向排序，count值大的在前
+	sort.Sort(sort.Reverse(byCount(as)))
+
+	if err = writeJSON(w, as); err != nil {
+		lg.Printf("analysis of month error: %s\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
-	w.Header().Set("Content-Type", "text/json; charset=utf-8")
-	fmt.Fprintf(w, "%s", s)
 }
 
 //获取单台路由器的指定月份统计信息
@@ -307,6 +365,13 @@ func (cfg *Config) AnalysisOfRouter(w http.ResponseWriter, r *http.Request, lg *
 		fmt.Fprint(w, "month is empty")
 		return
 	}
+	f, err := clientFilter(r)
+	if err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
 	begin := fmt.Sprintf("%s-%s-01", year, month)
 
 	const queryFormat = `2006-01-02`
@@ -320,7 +385,7 @@ func (cfg *Config) AnalysisOfRouter(w http.ResponseWriter, r *http.Request, lg *
 
 	end := t.AddDate(0, 1, 0).Format(queryFormat)
 
-	ds, err := SelectClientsByTime(cfg.db, code, begin, end, "")
+	ds, err := cfg.selectClients(r, lg, code, begin, end, f)
 	if err != nil {
 		lg.Printf("analysis of %s error: %s\n", code, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -329,25 +394,11 @@ func (cfg *Config) AnalysisOfRouter(w http.ResponseWriter, r *http.Request, lg *
 	}
 	sort.Sort(byTime(ds))
 	cs := &Clients{Code: code, Data: ds}
-	b, err := json.MarshalIndent(cs, "", "  ")
-	if err != nil {
+	if err = writeJSON(w, cs); err != nil {
 		lg.Printf("analysis of %s error: %s\n", code, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintln(w, err)
-		return
-	}
-
-	callback := r.FormValue("callback")
-	var s string
-	if callback != "" {
-		s = fmt.Sprintf("%s(%s)", callback, b)
-	} else {
-		s = string(b)
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
-	w.Header().Set("Content-Type", "text/json; charset=utf-8")
-	fmt.Fprintf(w, "%s", s)
 }
 
 //查询指定设备在目标月份在线明细
@@ -388,6 +439,13 @@ func (cfg *Config) AnalysisOfClient(w http.ResponseWriter, r *http.Request, lg *
 		fmt.Fprint(w, "month is empty")
 		return
 	}
+	f, err := clientFilter(r)
+	if err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
 	begin := fmt.Sprintf("%s-%s-01", year, month)
 
 	const queryFormat = `2006-01-02`
@@ -401,7 +459,8 @@ func (cfg *Config) AnalysisOfClient(w http.ResponseWriter, r *http.Request, lg *
 
 	end := t.AddDate(0, 1, 0).Format(queryFormat)
 
-	ds, err := SelectClientsByTime(cfg.db, code, begin, end, mac)
+	f.MAC = mac
+	ds, err := cfg.selectClients(r, lg, code, begin, end, f)
 	if err != nil {
 		lg.Printf("analysis of %s error: %s\n", code, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -409,47 +468,332 @@ func (cfg *Config) AnalysisOfClient(w http.ResponseWriter, r *http.Request, lg *
 		return
 	}
 	sort.Sort(byTime(ds))
-	b, err := json.MarshalIndent(ds, "", "  ")
-	if err != nil {
+	if err = writeJSON(w, ds); err != nil {
 		lg.Printf("analysis of %s error: %s\n", code, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintln(w, err)
+	}
+}
+
+//查询路由器上的客户端，没有权限时返回空的结果，与没有数据的路由器相同
+func (cfg *Config) selectClients(r *http.Request, lg *log.Logger, code, begin, end string, f *ClientFilter) ([]*Data, error) {
+	a := requestAccess(r)
+	err := cfg.canReadCode(a, code)
+	if err == errForbidden {
+		lg.Printf("client %s: user %s can not read router %s\n", r.RemoteAddr, a.User, code)
+		return make([]*Data, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cfg.store.SelectClientsByTime(code, begin, end, f)
+}
+
+//输出json，所有接口都需要登录，不提供jsonp和跨域访问，防止其他网站使用用户的cookie读取数据
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(b)
+	return nil
+}
+
+//aruba_get的设备类型
+var deviceClasses = []string{"pc", "phone", "printer", "pos-terminal", "iot"}
+
+//读取medium、class、vendor和random参数，为空时不过滤
+//medium为wired或wireless，class为设备类型，vendor为厂商名称的一部分，random为true或false
+func clientFilter(r *http.Request) (*ClientFilter, error) {
+	f := &ClientFilter{
+		Medium: r.FormValue("medium"),
+		Class:  r.FormValue("class"),
+		Vendor: r.FormValue("vendor"),
+	}
+	switch f.Medium {
+	case "", "wired", "wireless":
+	default:
+		return nil, fmt.Errorf("invalid medium: %s", f.Medium)
+	}
+	if v := r.FormValue("random"); v != "" {
+		random, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid random: %s", v)
+		}
+		f.Random = &random
+	}
+	if f.Class == "" {
+		return f, nil
+	}
+	for _, c := range deviceClasses {
+		if f.Class == c {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid class: %s", f.Class)
+}
+
+//aruba_get执行命令的方式，为空时使用aruba_get的rap3配置
+func validTransport(t string) bool {
+	switch t {
+	case "", "rest", "cgi", "ssh":
+		return true
+	}
+	return false
+}
+
+//读取正整数参数，为空时返回def
+func intValue(r *http.Request, key string, def int) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, v)
+	}
+	return n, nil
+}
+
+const (
+	defaultRunsLimit = 50
+	maxRunsLimit     = 1000
+)
+
+//列出aruba_get的采集记录，按时间倒序，支持limit和offset分页
+func (cfg *Config) ListRuns(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if err := r.ParseForm(); err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, err := intValue(r, "limit", defaultRunsLimit)
+	if err == nil && (limit == 0 || limit > maxRunsLimit) {
+		err = fmt.Errorf("limit must be between 1 and %d", maxRunsLimit)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	offset, err := intValue(r, "offset", 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	runs, err := cfg.store.SelectRuns(limit, offset)
+	if err == nil {
+		err = cfg.scopeRuns(requestAccess(r), runs)
+	}
+	if err != nil {
+		lg.Printf("select runs error: %s\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
 		return
 	}
+	if err = writeJSON(w, runs); err != nil {
+		lg.Printf("select runs error: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
 
-	callback := r.FormValue("callback")
-	var s string
-	if callback != "" {
-		s = fmt.Sprintf("%s(%s)", callback, b)
-	} else {
-		s = string(b)
+//可以查询的路由器code
+func (cfg *Config) readableCodes(a *Access) (map[string]bool, error) {
+	rs, err := cfg.store.SelectRouters()
+	if err != nil {
+		return nil, err
+	}
+	var readable = make(map[string]bool)
+	for _, router := range a.readable(rs) {
+		readable[router.Code] = true
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
-	w.Header().Set("Content-Type", "text/json; charset=utf-8")
-	fmt.Fprintf(w, "%s", s)
+	return readable, nil
 }
 
-func (srv *Server) Listen(addr string, cfg *Config, logger *log.Logger) {
-	srv.HandleFunc("/admin/r/g", func(w http.ResponseWriter, r *http.Request) {
+//不能查询所有路由器时，每次采集的数量只统计可以查询的路由器
+func (cfg *Config) scopeRuns(a *Access, runs []*Run) error {
+	if a.ReadAll() || len(runs) == 0 {
+		return nil
+	}
+	readable, err := cfg.readableCodes(a)
+	if err != nil {
+		return err
+	}
+	//runs按id倒序
+	rrs, err := cfg.store.SelectRunsRouters(runs[len(runs)-1].ID, runs[0].ID)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		run.recount(rrs, readable)
+	}
+	return nil
+}
+
+//查看一次采集中每个路由器的结果，指定code时只返回该路由器
+func (cfg *Config) GetRun(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if err := r.ParseForm(); err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		lg.Printf("[Error] client %s: invalid run id %q\n", r.RemoteAddr, r.FormValue("id"))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id is invalid")
+		return
+	}
+
+	run, err := cfg.store.SelectRun(id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "run %d not found", id)
+		return
+	} else if err != nil {
+		lg.Printf("select run %d error: %s\n", id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	//只返回可以查询的路由器
+	readable, err := cfg.readableCodes(requestAccess(r))
+	if err != nil {
+		lg.Printf("select run %d error: %s\n", id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	code := strings.ToUpper(r.FormValue("code"))
+	var rrs = make([]*RouterRun, 0)
+	for _, rr := range run.Routers {
+		if readable[rr.Code] && (code == "" || rr.Code == code) {
+			rrs = append(rrs, rr)
+		}
+	}
+	run.Routers = rrs
+	if err = writeJSON(w, run); err != nil {
+		lg.Printf("select run %d error: %s\n", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//单台路由器最近的采集结果，用于排查路由器没有数据的原因
+func (cfg *Config) RouterRuns(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if err := r.ParseForm(); err != nil {
+		lg.Printf("[Error] client %s: %s\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		lg.Printf("[Error] client %s: code is empty\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "code is empty")
+		return
+	}
+	limit, err := intValue(r, "limit", defaultRunsLimit)
+	if err == nil && (limit == 0 || limit > maxRunsLimit) {
+		err = fmt.Errorf("limit must be between 1 and %d", maxRunsLimit)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	var rrs = make([]*RouterRun, 0)
+	a := requestAccess(r)
+	err = cfg.canReadCode(a, strings.ToUpper(code))
+	if err == errForbidden {
+		lg.Printf("client %s: user %s can not read router %s\n", r.RemoteAddr, a.User, code)
+	} else if err == nil {
+		rrs, err = cfg.store.SelectRouterRuns(code, limit)
+	}
+	if err != nil {
+		lg.Printf("select runs of %s error: %s\n", code, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err = writeJSON(w, rrs); err != nil {
+		lg.Printf("select runs of %s error: %s\n", code, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//监听addr并在后台处理请求，返回的*http.Server用于退出时关闭
+func (srv *Server) Listen(addr string, cfg *Config, logger *log.Logger) (*http.Server, error) {
+	srv.HandleFunc("/login", instrument("/login", func(w http.ResponseWriter, r *http.Request) {
+		cfg.Login(w, r, logger)
+	}))
+	srv.HandleFunc("/logout", instrument("/logout", func(w http.ResponseWriter, r *http.Request) {
+		cfg.Logout(w, r, logger)
+	}))
+	srv.HandleFunc("/me", instrument("/me", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.Me(w, r, logger)
+	})))
+
+	//API token的管理，只能使用登录会话
+	srv.HandleFunc("/tokens", instrument("/tokens", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.ListTokens(w, r, logger)
+	})))
+	srv.HandleFunc("/tokens/new", instrument("/tokens/new", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.CreateToken(w, r, logger)
+	})))
+	srv.HandleFunc("/tokens/revoke", instrument("/tokens/revoke", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.RevokeToken(w, r, logger)
+	})))
+
+	//管理接口只允许管理员访问
+	srv.HandleFunc("/admin/r/g", instrument("/admin/r/g", cfg.auth(true, logger, func(w http.ResponseWriter, r *http.Request) {
 		cfg.GetRouters(w, r, logger)
-	})
-	srv.HandleFunc("/admin/r/u", func(w http.ResponseWriter, r *http.Request) {
+	})))
+	srv.HandleFunc("/admin/r/u", instrument("/admin/r/u", cfg.auth(true, logger, func(w http.ResponseWriter, r *http.Request) {
 		cfg.UpdateRouter(w, r, logger)
-	})
+	})))
+
+	srv.HandleFunc("/admin/audit", instrument("/admin/audit", cfg.auth(true, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.ListAudit(w, r, logger)
+	})))
 
-	srv.HandleFunc("/a/counts", func(w http.ResponseWriter, r *http.Request) {
+	srv.HandleFunc("/a/counts", instrument("/a/counts", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
 		cfg.AnalysisOfCounts(w, r, logger)
-	})
-	srv.HandleFunc("/a/router", func(w http.ResponseWriter, r *http.Request) {
+	})))
+	srv.HandleFunc("/a/router", instrument("/a/router", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
 		cfg.AnalysisOfRouter(w, r, logger)
-	})
-	srv.HandleFunc("/a/client", func(w http.ResponseWriter, r *http.Request) {
+	})))
+	srv.HandleFunc("/a/client", instrument("/a/client", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
 		cfg.AnalysisOfClient(w, r, logger)
-	})
+	})))
+
+	srv.HandleFunc("/a/runs", instrument("/a/runs", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.ListRuns(w, r, logger)
+	})))
+	srv.HandleFunc("/a/run", instrument("/a/run", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.GetRun(w, r, logger)
+	})))
+	srv.HandleFunc("/a/router/runs", instrument("/a/router/runs", cfg.auth(false, logger, func(w http.ResponseWriter, r *http.Request) {
+		cfg.RouterRuns(w, r, logger)
+	})))
+
+	srv.Handle("/metrics", metricsHandler())
 
 	ui := Basedir() + "/ui"
 	srv.Handle("/", http.FileServer(http.Dir(ui)))
 
-	log.Fatalln(http.ListenAndServe(addr, srv))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := &http.Server{Addr: addr, Handler: srv}
+	go func() {
+		if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+	return hs, nil
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+//内置的角色，其他角色在配置的roles中定义
+const (
+	RoleViewer = "viewer"
+	RoleAdmin  = "admin"
+)
+
+//会话的来源
+const (
+	SourceLocal = "local"
+	SourceLDAP  = "ldap"
+)
+
+const (
+	defaultUserFilter  = "(sAMAccountName=%s)"
+	defaultGroupAttr   = "memberOf"
+	defaultLDAPTimeout = 10
+	//token请求使用的ldap角色的缓存时间(秒)
+	defaultLDAPRoleCache = 300
+)
+
+//LDAP或者Active Directory登录，users表中的用户在LDAP登录失败时仍然可以登录
+type LDAPConfig struct {
+	//ldap://dc1.example.com:389或者ldaps://dc1.example.com:636
+	URL string `json:"url"`
+	//ldap://连接后使用StartTLS，密码不以明文发送
+	StartTLS bool `json:"start_tls"`
+	//验证服务器证书的CA文件，为空时使用系统的CA
+	CA                 string `json:"ca,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	//查找用户使用的账号，为空时匿名查找
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	BaseDN       string `json:"base_dn"`
+	//查找用户的条件，%s为转义后的用户名，默认为(sAMAccountName=%s)
+	UserFilter string `json:"user_filter,omitempty"`
+	//用户所属组的属性，默认为memberOf
+	GroupAttr string `json:"group_attr,omitempty"`
+	//组的DN到角色(viewer、admin或roles中定义的角色)，属于多个组时合并所有角色的权限
+	Groups map[string]string `json:"groups"`
+	//不属于groups中任何组的用户的角色，为空时不能登录
+	DefaultRole string `json:"default_role,omitempty"`
+	//连接和每个操作的超时(秒)，默认为10
+	Timeout int `json:"timeout,omitempty"`
+	//API token请求时查询的用户角色缓存的时间(秒)，默认为300
+	RoleCache int `json:"role_cache,omitempty"`
+
+	mu    sync.Mutex
+	roles map[string]*ldapRoles
+}
+
+type ldapRoles struct {
+	roles   []string
+	expires time.Time
+}
+
+//用户不存在或者不属于任何配置的组
+var errLDAPNoRole = errors.New("ldap user not found or not a member of any configured group")
+
+//检查url和角色，validRole检查角色是否已定义
+func (c *LDAPConfig) Check(validRole func(string) bool) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("ldap: invalid url %q", c.URL)
+	}
+	if c.StartTLS && u.Scheme == "ldaps" {
+		return errors.New("ldap: start_tls can not be used with ldaps://")
+	}
+	if c.BaseDN == "" {
+		return errors.New("ldap: base_dn is empty")
+	}
+	for group, role := range c.Groups {
+		if !validRole(role) {
+			return fmt.Errorf("ldap: role %q of group %s is not defined", role, group)
+		}
+	}
+	if c.DefaultRole != "" && !validRole(c.DefaultRole) {
+		return fmt.Errorf("ldap: invalid default_role %q", c.DefaultRole)
+	}
+	if _, err = c.tlsConfig(u.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *LDAPConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return defaultLDAPTimeout * time.Second
+}
+
+func (c *LDAPConfig) tlsConfig(host string) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: host, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		b, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: read ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("ldap: no certificate found in %s", c.CA)
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
+
+//连接服务器，需要时使用StartTLS
+func (c *LDAPConfig) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := c.tlsConfig(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: c.timeout()}
+	conn, err := ldap.DialURL(c.URL, ldap.DialWithDialer(d), ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.timeout())
+	if c.StartTLS {
+		if err = conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start tls: %s", err)
+		}
+	}
+	return conn, nil
+}
+
+//查找用户后使用用户的DN和password绑定，返回用户所属组对应的角色，按名称排序
+func (c *LDAPConfig) Authenticate(user, password string) ([]string, error) {
+	//空密码在部分服务器上是匿名绑定，会被当作成功
+	if user == "" || password == "" {
+		return nil, errLogin
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, attr, err := c.search(conn, user)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLogin
+		}
+		return nil, fmt.Errorf("bind %s: %s", entry.DN, err)
+	}
+	roles := c.entryRoles(entry, attr)
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("%s is not a member of any configured group", entry.DN)
+	}
+	return roles, nil
+}
+
+//使用bind_dn查找用户当前的角色，不需要用户的密码，用于ldap用户的API token
+//结果缓存role_cache秒；用户不存在或者没有角色时返回errLDAPNoRole
+func (c *LDAPConfig) Roles(user string) ([]string, error) {
+	c.mu.Lock()
+	cached, ok := c.roles[user]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.roles, nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, attr, err := c.search(conn, user)
+	if err != nil && err != errLDAPNoRole {
+		return nil, err
+	}
+	//不存在和没有角色的用户也缓存，避免每次请求都查询ldap
+	var roles []string
+	if err == nil {
+		roles = c.entryRoles(entry, attr)
+	}
+
+	ttl := time.Duration(c.RoleCache) * time.Second
+	if c.RoleCache <= 0 {
+		ttl = defaultLDAPRoleCache * time.Second
+	}
+	c.mu.Lock()
+	if c.roles == nil {
+		c.roles = make(map[string]*ldapRoles)
+	}
+	c.roles[user] = &ldapRoles{roles: roles, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	if len(roles) == 0 {
+		return nil, errLDAPNoRole
+	}
+	return roles, nil
+}
+
+//使用bind_dn绑定后查找user，返回用户的条目和组的属性名
+func (c *LDAPConfig) search(conn *ldap.Conn, user string) (*ldap.Entry, string, error) {
+	if c.BindDN != "" {
+		if err := conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			return nil, "", fmt.Errorf("bind %s: %s", c.BindDN, err)
+		}
+	}
+	filter, attr := c.UserFilter, c.GroupAttr
+	if filter == "" {
+		filter = defaultUserFilter
+	}
+	if attr == "" {
+		attr = defaultGroupAttr
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(c.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(c.timeout().Seconds()), false, fmt.Sprintf(filter, ldap.EscapeFilter(user)), []string{attr}, nil))
+	if err != nil {
+		return nil, "", fmt.Errorf("search %s: %s", user, err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, "", errLDAPNoRole
+	}
+	if len(res.Entries) != 1 {
+		return nil, "", fmt.Errorf("search %s: %d entries found", user, len(res.Entries))
+	}
+	return res.Entries[0], attr, nil
+}
+
+//用户所属组对应的角色，按名称排序，不属于任何组时使用default_role
+func (c *LDAPConfig) entryRoles(entry *ldap.Entry, attr string) []string {
+	var roles = make(map[string]bool)
+	for _, g := range entry.GetAttributeValues(attr) {
+		for group, r := range c.Groups {
+			if strings.EqualFold(g, group) {
+				roles[r] = true
+			}
+		}
+	}
+	if len(roles) == 0 && c.DefaultRole != "" {
+		roles[c.DefaultRole] = true
+	}
+	return splitRoles(joinRoles(roles))
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+//进程内的LDAP服务器，只支持simple bind、search、StartTLS和unbind
+type fakeLDAP struct {
+	tls *tls.Config
+	//DN到密码和memberOf
+	entries map[string]fakeEntry
+	bindDN  string
+	bindPW  string
+
+	mu sync.Mutex
+	//每次bind的DN，没有使用TLS时记录为plain:DN
+	binds []string
+}
+
+type fakeEntry struct {
+	uid      string
+	password string
+	groups   []string
+}
+
+func (f *fakeLDAP) listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return l
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	var secure bool
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, pw := op.Children[1].Data.String(), op.Children[2].Data.String()
+			f.mu.Lock()
+			if secure {
+				f.binds = append(f.binds, dn)
+			} else {
+				f.binds = append(f.binds, "plain:"+dn)
+			}
+			f.mu.Unlock()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if e, ok := f.entries[dn]; (ok && pw == e.password) || (dn == f.bindDN && pw == f.bindPW) {
+				code = ldap.LDAPResultSuccess
+			}
+			ldapWrite(conn, id, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				ldapWrite(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultFilterError))
+				continue
+			}
+			for dn, e := range f.entries {
+				if filter == fmt.Sprintf("(sAMAccountName=%s)", e.uid) {
+					ldapWrite(conn, id, ldapEntry(dn, "memberOf", e.groups))
+				}
+			}
+			ldapWrite(conn, id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationExtendedRequest:
+			//StartTLS，回复后在同一个连接上握手
+			ldapWrite(conn, id, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			conn = tls.Server(conn, f.tls)
+			secure = true
+		default:
+			return
+		}
+	}
+}
+
+func ldapWrite(conn net.Conn, id int64, op *ber.Packet) {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	conn.Write(p.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return r
+}
+
+func ldapEntry(dn, attr string, values []string) *ber.Packet {
+	e := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	e.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr, ""))
+	vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+	for _, v := range values {
+		vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+	}
+	a.AppendChild(vals)
+	attrs.AppendChild(a)
+	e.AppendChild(attrs)
+	return e
+}
+
+const (
+	adminsGroup   = "CN=Aruba Admins,OU=Groups,DC=example,DC=com"
+	helpdeskGroup = "CN=Helpdesk,OU=Groups,DC=example,DC=com"
+)
+
+//启动fakeLDAP，返回使用StartTLS的配置
+func newFakeLDAP(t *testing.T, dir string) (*fakeLDAP, *LDAPConfig, func()) {
+	//使用httptest的证书，对127.0.0.1有效
+	hs := httptest.NewUnstartedServer(nil)
+	hs.StartTLS()
+	ca := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hs.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{
+		tls:    &tls.Config{Certificates: hs.TLS.Certificates},
+		bindDN: "CN=svc-aruba,OU=Service,DC=example,DC=com",
+		bindPW: "svc-secret",
+		entries: map[string]fakeEntry{
+			"CN=Alice,OU=Staff,DC=example,DC=com": {"alice", "alice-pw", []string{helpdeskGroup, strings.ToLower(adminsGroup)}},
+			"CN=Bob,OU=Staff,DC=example,DC=com":   {"bob", "bob-pw", []string{helpdeskGroup}},
+			"CN=Carol,OU=Staff,DC=example,DC=com": {"carol", "carol-pw", []string{"CN=Sales,OU=Groups,DC=example,DC=com"}},
+		},
+	}
+	l := f.listen(t)
+	c := &LDAPConfig{
+		URL:          "ldap://" + l.Addr().String(),
+		StartTLS:     true,
+		CA:           ca,
+		BindDN:       f.bindDN,
+		BindPassword: f.bindPW,
+		BaseDN:       "DC=example,DC=com",
+		Groups: map[string]string{
+			adminsGroup:   RoleAdmin,
+			helpdeskGroup: RoleViewer,
+		},
+		Timeout: 5,
+	}
+	var once sync.Once
+	return f, c, func() {
+		once.Do(func() {
+			l.Close()
+			hs.Close()
+		})
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, c, stop := newFakeLDAP(t, dir)
+	defer stop()
+	if err = c.Check((&Config{}).validRole); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		user, password string
+		role           string
+		err            error
+	}{
+		//属于两个组时合并角色
+		{"alice", "alice-pw", "admin,viewer", nil},
+		{"bob", "bob-pw", RoleViewer, nil},
+		{"bob", "wrong", "", errLogin},
+		//空密码不能作为匿名绑定
+		{"bob", "", "", errLogin},
+		//不属于任何配置的组
+		{"carol", "carol-pw", "", nil},
+		{"dave", "dave-pw", "", nil},
+		{"*", "bob-pw", "", nil},
+	}
+	for _, cs := range cases {
+		roles, err := c.Authenticate(cs.user, cs.password)
+		role := strings.Join(roles, ",")
+		if cs.role != "" {
+			if err != nil || role != cs.role {
+				t.Errorf("Authenticate(%s) = %q, %v, want %q", cs.user, role, err, cs.role)
+			}
+			continue
+		}
+		if err == nil || (cs.err != nil && err != cs.err) {
+			t.Errorf("Authenticate(%s) = %q, %v, want error %v", cs.user, role, err, cs.err)
+		}
+	}
+	//所有bind都在StartTLS之后
+	for _, b := range f.binds {
+		if strings.HasPrefix(b, "plain:") {
+			t.Errorf("bind without tls: %s", b)
+		}
+	}
+
+	c.DefaultRole = RoleViewer
+	if roles, err := c.Authenticate("carol", "carol-pw"); err != nil || strings.Join(roles, ",") != RoleViewer {
+		t.Errorf("Authenticate(carol) with default_role = %q, %v", roles, err)
+	}
+}
+
+func TestLDAPCheck(t *testing.T) {
+	var cases = []*LDAPConfig{
+		{URL: "http://dc1", BaseDN: "DC=example"},
+		{URL: "ldaps://dc1:636", StartTLS: true, BaseDN: "DC=example"},
+		{URL: "ldap://dc1", BaseDN: ""},
+		{URL: "ldap://dc1", BaseDN: "DC=example", Groups: map[string]string{"CN=x": "root"}},
+		{URL: "ldap://dc1", BaseDN: "DC=example", DefaultRole: "guest"},
+		{URL: "ldap://dc1", BaseDN: "DC=example", CA: "testdata/missing.pem"},
+	}
+	for _, c := range cases {
+		if err := c.Check((&Config{}).validRole); err == nil {
+			t.Errorf("Check(%+v) succeeded", c)
+		}
+	}
+}
+
+//ldap用户登录后的会话，以及ldap不可用时使用users表登录
+func TestLDAPLoginFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, c, stop := newFakeLDAP(t, dir)
+	defer stop()
+
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPassword("break-glass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InsertUser(&UserPassword{User: "root", Password: hash, Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{store: s, LDAP: c}
+	lg := log.New(ioutil.Discard, "", 0)
+
+	login := func(user, password string) *http.Cookie {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {user}, "password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		cfg.Login(w, r, lg)
+		if w.Code != http.StatusOK {
+			return nil
+		}
+		return w.Result().Cookies()[0]
+	}
+	admin := func(c *http.Cookie) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/admin/r/g", nil)
+		r.AddCookie(c)
+		cfg.auth(true, lg, func(w http.ResponseWriter, r *http.Request) {})(w, r)
+		return w.Code
+	}
+
+	alice, bob := login("alice", "alice-pw"), login("bob", "bob-pw")
+	if alice == nil || bob == nil {
+		t.Fatal("ldap login failed")
+	}
+	if code := admin(alice); code != http.StatusOK {
+		t.Errorf("ldap admin got %d", code)
+	}
+	if code := admin(bob); code != http.StatusForbidden {
+		t.Errorf("ldap viewer got %d", code)
+	}
+	if root := login("root", "break-glass"); root == nil || admin(root) != http.StatusOK {
+		t.Error("local user can not login with ldap configured")
+	}
+
+	//ldap不可用时仍然可以使用users表登录
+	stop()
+	if login("bob", "bob-pw") != nil {
+		t.Error("ldap user logged in while ldap is down")
+	}
+	if root := login("root", "break-glass"); root == nil {
+		t.Error("break-glass login failed while ldap is down")
+	}
+	//已有的ldap会话在过期前仍然有效
+	if code := admin(alice); code != http.StatusOK {
+		t.Errorf("ldap session after ldap down got %d", code)
+	}
+}
+
+//ldap用户的token按用户当前所属的组确定权限
+func TestLDAPToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, c, stop := newFakeLDAP(t, dir)
+	defer stop()
+
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{store: s, LDAP: c}
+	alice, _, err := cfg.createToken(cfg.newAccess("alice", SourceLDAP, []string{RoleAdmin, RoleViewer}), "", "read,admin", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := cfg.createToken(cfg.newAccess("bob", SourceLDAP, []string{RoleViewer}), "", "read", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, err := cfg.tokenAccess(alice); err != nil || !a.IsAdmin() {
+		t.Fatalf("alice token: %v", err)
+	}
+
+	//移出管理员组后不再有admin权限，缓存过期前仍然使用原来的角色
+	dn := "CN=Alice,OU=Staff,DC=example,DC=com"
+	f.entries[dn] = fakeEntry{"alice", "alice-pw", []string{helpdeskGroup}}
+	if a, err := cfg.tokenAccess(alice); err != nil || !a.IsAdmin() {
+		t.Errorf("alice token before cache expires: %v", err)
+	}
+	c.roles = nil
+	if a, err := cfg.tokenAccess(alice); err != nil || a.IsAdmin() || strings.Join(a.Roles, ",") != RoleViewer {
+		t.Errorf("alice token after leaving admins: %+v, %v", a, err)
+	}
+	//不属于任何配置的组时token失效
+	f.entries[dn] = fakeEntry{"alice", "alice-pw", nil}
+	c.roles = nil
+	if _, err = cfg.tokenAccess(alice); err != errNoSession {
+		t.Errorf("alice token without groups: %v", err)
+	}
+
+	//ldap不可用时不使用token中保存的角色
+	stop()
+	if _, err = cfg.tokenAccess(bob); err == nil || err == errNoSession {
+		t.Errorf("bob token while ldap is down: %v", err)
+	}
+	cfg.LDAP = nil
+	if _, err = cfg.tokenAccess(bob); err != errNoSession {
+		t.Errorf("bob token without ldap config: %v", err)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
@@ -21,13 +23,31 @@ var (
 	//版本信息
 	VERSION = flag.Bool("version", false, "打印版本信息")
 	TEST    = flag.Bool("test", false, "测试配置文件")
+	//数据库版本迁移
+	MIGRATE = flag.String("migrate", "", "数据库版本迁移: up|down|status")
+	//用户管理，密码从终端读取
+	USERADD = flag.String("useradd", "", "添加用户")
+	PASSWD  = flag.String("passwd", "", "修改用户密码")
+	USERDEL = flag.String("userdel", "", "删除用户")
+	USERMOD = flag.String("usermod", "", "按-admin和-roles修改用户的权限")
+	ADMIN   = flag.Bool("admin", false, "与-useradd或-usermod一起使用，管理员可以修改所有路由器")
+	ROLES   = flag.String("roles", "", "与-useradd或-usermod一起使用，逗号分隔的角色")
+	//API token管理，token只在创建时显示
+	TOKENADD = flag.String("tokenadd", "", "为用户创建API token")
+	TOKENS   = flag.String("tokens", "", "列出用户的API token，*为所有用户")
+	TOKENDEL = flag.String("tokendel", "", "按ID吊销API token")
+	NAME     = flag.String("name", "", "与-tokenadd一起使用，token的用途")
+	SCOPES   = flag.String("scopes", ScopeRead, "与-tokenadd一起使用，read和/或admin")
+	DAYS     = flag.Int("days", 0, "与-tokenadd一起使用，有效期(天)，0为不过期")
 )
 
 //配置JSON模板
 var cfgT = &Config{
 	Addr:     "127.0.0.1:50053",
 	Duration: 10,
-	Database: MysqlDB{
+	Session:  12,
+	Database: DBConfig{
+		Driver:   "mysql",
 		Host:     "127.0.0.1",
 		Port:     "3306",
 		User:     "root",
@@ -65,38 +85,122 @@ func main() {
 	if err != nil {
 		log.Fatalln("read config file error: ", err)
 	}
+	if err = cfg.CheckRoles(); err != nil {
+		log.Fatalln(err)
+	}
+	if err = cfg.ParseProxies(); err != nil {
+		log.Fatalln(err)
+	}
 
 	if *TEST {
 		fmt.Printf("%s is ok\n", CONF)
 		return
 	}
 
+	if *MIGRATE != "" {
+		if err = cfg.OpenStore(); err != nil {
+			log.Fatalln("open database error: ", err)
+		}
+		defer cfg.store.Close()
+		if err = RunMigrate(cfg.store, *MIGRATE, os.Stdout); err != nil {
+			log.Fatalln("migrate error: ", err)
+		}
+		return
+	}
+
+	if *USERADD != "" || *PASSWD != "" || *USERDEL != "" || *USERMOD != "" {
+		roles, err := cfg.parseRoles(*ROLES)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err = cfg.OpenStore(); err != nil {
+			log.Fatalln("open database error: ", err)
+		}
+		defer cfg.store.Close()
+		if err = CheckSchema(cfg.store); err != nil {
+			log.Fatalln(err)
+		}
+		if err = RunUserCmd(cfg.store, *USERADD, *PASSWD, *USERDEL, *USERMOD, *ADMIN, roles, os.Stdin, os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *TOKENADD != "" || *TOKENS != "" || *TOKENDEL != "" {
+		if err = cfg.OpenStore(); err != nil {
+			log.Fatalln("open database error: ", err)
+		}
+		defer cfg.store.Close()
+		if err = CheckSchema(cfg.store); err != nil {
+			log.Fatalln(err)
+		}
+		if err = cfg.RunTokenCmd(*TOKENADD, *TOKENS, *TOKENDEL, *NAME, *SCOPES, *DAYS, os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	var logger = NewLogger(filepath.Join(tmpDir, "aruba.log"))
 	logger.Println("aruba_query started")
 	logger.Printf("version: %s\n", version)
 
-	pid, pidFile := os.Getpid(), filepath.Join(tmpDir, "aruba.pid")
-	logger.Printf("pid: %d, path: %s\n", pid, pidFile)
-	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d", pid)), 0666); err != nil {
-		logger.Printf("write pid: %s\n", err)
-		return
+	//log.Fatalln不执行defer，run返回后pid文件已经删除
+	if err = run(cfg, logger, filepath.Join(tmpDir, "aruba.pid"), filepath.Join(baseDir, "etc", "whitelist")); err != nil {
+		logger.Println(err)
+		log.Fatalln(err)
+	}
+}
+
+//监听http请求并定时更新sp，返回错误前删除pid文件并关闭数据库
+func run(cfg *Config, logger *log.Logger, pidFile, wf string) error {
+	logger.Printf("pid: %d, path: %s\n", os.Getpid(), pidFile)
+	//pid文件加锁，同一时间只能运行一个实例
+	pf, err := LockPidFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("lock pid file: %s", err)
 	}
+	defer pf.Remove()
 
-	wf := filepath.Join(baseDir, "etc", "whitelist")
 	srv, err := NewServer(wf, logger)
 	if err != nil {
-		log.Fatalln("read whitelist error: ", err)
+		return fmt.Errorf("read whitelist error: %s", err)
 	}
+	srv.Proxies = cfg.proxies
 
 	//设置数据库连接
-	cfg.OpenMysql()
-	if err = cfg.db.Ping(); err != nil {
+	if err = cfg.OpenStore(); err != nil {
+		return fmt.Errorf("open database error: %s", err)
+	}
+	defer cfg.store.Close()
+	if err = cfg.store.Ping(); err != nil {
 		logger.Printf("connect to mysql %s:%s failed: %s\n", cfg.Database.Host, cfg.Database.Port, err)
 	}
 	logger.Printf("connect to mysql %s:%s success\n", cfg.Database.Host, cfg.Database.Port)
-	go srv.Listen(cfg.Addr, cfg, logger)
+	//数据库版本必须与程序一致
+	if err = CheckSchema(cfg.store); err != nil {
+		return err
+	}
+	hs, err := srv.Listen(cfg.Addr, cfg, logger)
+	if err != nil {
+		return err
+	}
+	logger.Printf("listen on %s\n", cfg.Addr)
 
-	time.Sleep(5 * time.Second)
+	//收到SIGINT或SIGTERM时取消正在进行的更新，处理完已有的请求后退出
+	root := notifyContext(logger)
+	//以systemd Type=notify运行时通知启动完成并启动watchdog
+	if ok, err := Notify("READY=1"); err != nil {
+		logger.Printf("notify systemd: %s\n", err)
+	} else if ok {
+		logger.Println("notify systemd ready")
+	}
+	wd := NewWatchdog(logger)
+	defer wd.Stop()
+
+	if !wd.Sleep(root, 5*time.Second) {
+		shutdown(hs, logger)
+		return nil
+	}
 	ech, done := make(chan error), make(chan bool)
 	go func() {
 		for {
@@ -114,16 +218,47 @@ func main() {
 
 	for {
 		//5分钟后更新没有完成, 取消任务
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-		defer cancel()
+		ctx, cancel := context.WithTimeout(root, time.Minute*5)
 
-		UpdateSP(ctx, cfg.db, ech, done, cfg.Addr)
+		UpdateSP(ctx, cfg.store, wd, ech, done)
 
 		select {
 		case <-ctx.Done():
 			logger.Printf("when update sp error: %s\n", ctx.Err())
 		default:
 		}
-		time.Sleep(d)
+		cancel()
+
+		if !wd.Sleep(root, d) {
+			shutdown(hs, logger)
+			return nil
+		}
+	}
+}
+
+//收到SIGINT或SIGTERM时取消ctx，再次收到时立即退出
+func notifyContext(logger *log.Logger) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logger.Printf("received %s, stopping\n", s)
+		Notify("STOPPING=1")
+		cancel()
+		s = <-sig
+		logger.Printf("received %s again, exit now\n", s)
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+//最多等待10秒处理完正在进行的请求
+func shutdown(hs *http.Server, logger *log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		logger.Printf("shutdown http server: %s\n", err)
 	}
+	logger.Println("aruba_query stopped")
 }
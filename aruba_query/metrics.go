@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//aruba_query自己的指标，不包括go运行时的指标
+var metrics = prometheus.NewRegistry()
+
+//默认的耗时区间，单位秒
+var defaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//aruba_query的指标
+var (
+	factory = promauto.With(metrics)
+
+	rdapFailures = factory.NewCounter(prometheus.CounterOpts{
+		Name: "aruba_query_rdap_failures_total", Help: "Failed RDAP lookups when updating service providers."})
+	httpDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "aruba_query_http_request_duration_seconds", Help: "HTTP handler latency by route.", Buckets: defaultBuckets}, []string{"route"})
+	httpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "aruba_query_http_requests_total", Help: "HTTP requests by route and status code."}, []string{"route", "code"})
+)
+
+//记录响应的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+//记录route的请求数和耗时
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+//prometheus文本格式的/metrics
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Areas和Codes中表示全部路由器
+const scopeAll = "*"
+
+//一组路由器，Areas为routers.area，Codes为路由器代码，满足其中一个即可
+type Scope struct {
+	Areas []string `json:"areas,omitempty"`
+	Codes []string `json:"codes,omitempty"`
+}
+
+//角色在Read中的路由器上可以查询客户端，在Admin中的路由器上还可以修改路由器
+type Role struct {
+	Read  Scope `json:"read"`
+	Admin Scope `json:"admin"`
+}
+
+//内置的角色，配置中不能重新定义
+var builtinRoles = map[string]*Role{
+	RoleViewer: {Read: Scope{Areas: []string{scopeAll}}},
+	RoleAdmin:  {Admin: Scope{Areas: []string{scopeAll}}},
+}
+
+func (cfg *Config) role(name string) *Role {
+	if r, ok := builtinRoles[name]; ok {
+		return r
+	}
+	return cfg.Roles[name]
+}
+
+func (cfg *Config) validRole(name string) bool {
+	return cfg.role(name) != nil
+}
+
+//检查角色的定义和ldap中使用的角色，-test和启动时使用
+func (cfg *Config) CheckRoles() error {
+	for name, r := range cfg.Roles {
+		if _, ok := builtinRoles[name]; ok {
+			return fmt.Errorf("role %s is builtin and can not be redefined", name)
+		}
+		if name == "" || strings.ContainsAny(name, ", \t") {
+			return fmt.Errorf("invalid role name %q", name)
+		}
+		if r == nil {
+			return fmt.Errorf("role %s is empty", name)
+		}
+	}
+	if cfg.LDAP != nil {
+		return cfg.LDAP.Check(cfg.validRole)
+	}
+	return nil
+}
+
+//逗号分隔的角色名称
+func splitRoles(s string) []string {
+	var roles []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+//检查-roles参数中的角色都已定义，返回去重排序后的结果
+func (cfg *Config) parseRoles(s string) (string, error) {
+	var set = make(map[string]bool)
+	for _, r := range splitRoles(s) {
+		if !cfg.validRole(r) {
+			return "", fmt.Errorf("role %s is not defined", r)
+		}
+		set[r] = true
+	}
+	return joinRoles(set), nil
+}
+
+func joinRoles(set map[string]bool) string {
+	var roles = make([]string, 0, len(set))
+	for r := range set {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return strings.Join(roles, ",")
+}
+
+//合并后的路由器集合
+type scopeSet struct {
+	all   bool
+	areas map[string]bool
+	codes map[string]bool
+}
+
+func (s *scopeSet) add(sc Scope) {
+	if s.areas == nil {
+		s.areas, s.codes = make(map[string]bool), make(map[string]bool)
+	}
+	for _, a := range sc.Areas {
+		if a == scopeAll {
+			s.all = true
+		}
+		s.areas[a] = true
+	}
+	for _, c := range sc.Codes {
+		if c == scopeAll {
+			s.all = true
+		}
+		s.codes[strings.ToUpper(c)] = true
+	}
+}
+
+func (s *scopeSet) merge(o scopeSet) {
+	if s.areas == nil {
+		s.areas, s.codes = make(map[string]bool), make(map[string]bool)
+	}
+	s.all = s.all || o.all
+	for a := range o.areas {
+		s.areas[a] = true
+	}
+	for c := range o.codes {
+		s.codes[c] = true
+	}
+}
+
+func (s *scopeSet) contains(r *Router) bool {
+	return s.all || s.areas[r.Area] || s.codes[strings.ToUpper(r.Code)]
+}
+
+func (s *scopeSet) empty() bool {
+	return !s.all && len(s.areas) == 0 && len(s.codes) == 0
+}
+
+//已登录用户的权限，由用户的所有角色合并得到
+type Access struct {
+	User   string
+	Source string
+	Roles  []string
+	//使用API token时为token的ID和scopes
+	Token  string
+	scopes string
+	read   scopeSet
+	admin  scopeSet
+}
+
+//未定义的角色(例如从配置中删除)没有任何权限
+func (cfg *Config) newAccess(user, source string, roles []string) *Access {
+	a := &Access{User: user, Source: source, Roles: roles}
+	for _, name := range roles {
+		if r := cfg.role(name); r != nil {
+			a.read.add(r.Read)
+			a.admin.add(r.Admin)
+		}
+	}
+	return a
+}
+
+//users表中的用户，admin为true时有admin角色，没有角色时为viewer
+func (cfg *Config) userAccess(u *UserPassword) *Access {
+	roles := splitRoles(u.Roles)
+	if u.Admin {
+		roles = append([]string{RoleAdmin}, roles...)
+	}
+	if len(roles) == 0 {
+		roles = []string{RoleViewer}
+	}
+	return cfg.newAccess(u.User, SourceLocal, roles)
+}
+
+//token没有admin scope时只保留查询权限
+func (a *Access) restrict(token, scopes string) {
+	a.Token, a.scopes = token, scopes
+	if !a.HasScope(ScopeAdmin) {
+		a.read.merge(a.admin)
+		a.admin = scopeSet{}
+	}
+}
+
+//登录会话有所有的scope
+func (a *Access) HasScope(scope string) bool {
+	if a.Token == "" {
+		return true
+	}
+	for _, sc := range splitRoles(a.scopes) {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//可以查询路由器上的客户端，修改权限包括查询
+func (a *Access) CanRead(r *Router) bool {
+	return a.read.contains(r) || a.admin.contains(r)
+}
+
+func (a *Access) CanAdmin(r *Router) bool {
+	return a.admin.contains(r)
+}
+
+//可以修改所有路由器，用户和token的修改记录只有这样的用户可以查看
+func (a *Access) AdminAll() bool {
+	return a.admin.all
+}
+
+//可以查询所有路由器，采集记录的汇总不需要按路由器重新统计
+func (a *Access) ReadAll() bool {
+	return a.read.all || a.admin.all
+}
+
+//可以修改至少一部分路由器，用于/admin/接口和显示管理页面
+func (a *Access) IsAdmin() bool {
+	return !a.admin.empty()
+}
+
+var errForbidden = errors.New("permission denied")
+
+//只保留可以查询的路由器
+func (a *Access) readable(rs []*Router) []*Router {
+	var res = make([]*Router, 0, len(rs))
+	for _, r := range rs {
+		if a.CanRead(r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+//只保留可以修改的路由器
+func (a *Access) administrable(rs []*Router) []*Router {
+	var res = make([]*Router, 0, len(rs))
+	for _, r := range rs {
+		if a.CanAdmin(r) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+//检查用户能否查询code的路由器，路由器不存在时也返回errForbidden，不暴露路由器是否存在
+func (cfg *Config) canReadCode(a *Access, code string) error {
+	r, err := cfg.store.SelectRouter(code)
+	if err == sql.ErrNoRows {
+		return errForbidden
+	} else if err != nil {
+		return err
+	}
+	if !a.CanRead(r) {
+		return errForbidden
+	}
+	return nil
+}
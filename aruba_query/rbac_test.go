@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAccess(t *testing.T) {
+	cfg := &Config{Roles: map[string]*Role{
+		"east": {Read: Scope{Areas: []string{"华东"}}, Admin: Scope{Codes: []string{"531"}}},
+		"west": {Read: Scope{Areas: []string{"西南"}}},
+	}}
+	r531 := &Router{Code: "531", Area: "华东"}
+	r532 := &Router{Code: "532", Area: "华东"}
+	r028 := &Router{Code: "028", Area: "西南"}
+
+	var cases = []struct {
+		name  string
+		a     *Access
+		read  []*Router
+		admin []*Router
+	}{
+		{"east", cfg.newAccess("alice", SourceLocal, []string{"east"}), []*Router{r531, r532}, []*Router{r531}},
+		{"east,west", cfg.newAccess("bob", SourceLDAP, []string{"east", "west"}), []*Router{r531, r532, r028}, []*Router{r531}},
+		{"viewer", cfg.userAccess(&UserPassword{User: "carol"}), []*Router{r531, r532, r028}, nil},
+		{"admin", cfg.userAccess(&UserPassword{User: "root", Admin: true}), []*Router{r531, r532, r028}, []*Router{r531, r532, r028}},
+		//配置中删除的角色没有权限
+		{"removed", cfg.newAccess("dave", SourceLDAP, []string{"north"}), nil, nil},
+	}
+	all := []*Router{r531, r532, r028}
+	for _, c := range cases {
+		if got := c.a.readable(all); len(got) != len(c.read) {
+			t.Errorf("%s: readable %d routers, want %d", c.name, len(got), len(c.read))
+		}
+		if got := c.a.administrable(all); len(got) != len(c.admin) {
+			t.Errorf("%s: administrable %d routers, want %d", c.name, len(got), len(c.admin))
+		}
+		if c.a.IsAdmin() != (len(c.admin) > 0) {
+			t.Errorf("%s: IsAdmin() = %v", c.name, c.a.IsAdmin())
+		}
+	}
+
+	if err := (&Config{Roles: map[string]*Role{RoleAdmin: {}}}).CheckRoles(); err == nil {
+		t.Error("builtin role redefined")
+	}
+	if _, err := cfg.parseRoles("east,north"); err == nil {
+		t.Error("undefined role accepted")
+	}
+	if roles, err := cfg.parseRoles(" west,east,west"); err != nil || roles != "east,west" {
+		t.Errorf("parseRoles = %q, %v", roles, err)
+	}
+}
+
+//每个接口只返回用户有权限的路由器
+func TestScopedHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`insert into routers (code, name, area) values ('531', 'jinan', '华东'), ('532', 'qingdao', '华东'), ('028', 'chengdu', '西南')`,
+		`insert into client_sightings (code, ip, mac, ap, role, time) values
+			('531', '10.0.0.1', 'aa:bb:cc:00:00:01', '', '', '2017-02-01 10:00:00'),
+			('028', '10.0.1.1', 'aa:bb:cc:00:00:02', '', '', '2017-02-01 10:00:00')`,
+		`insert into collection_runs (started_at, finished_at, total, succeeded, failed) values ('2017-02-01 10:00:00', '2017-02-01 10:01:00', 3, 1, 2)`,
+		`insert into collection_run_routers (run_id, code, status, started_at) values
+			(1, '531', 'ok', '2017-02-01 10:00:00'), (1, '532', 'failed', '2017-02-01 10:00:00'), (1, '028', 'failed', '2017-02-01 10:00:00')`,
+	} {
+		if _, err = s.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := HashPassword("manager-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InsertUser(&UserPassword{User: "east", Password: hash, Roles: "east"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{store: s, Roles: map[string]*Role{
+		"east": {Read: Scope{Areas: []string{"华东"}}, Admin: Scope{Codes: []string{"531"}}},
+	}}
+	lg := log.New(ioutil.Discard, "", 0)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {"east"}, "password": {"manager-pw"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cfg.Login(w, r, lg)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login got %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+	call := func(admin bool, h func(http.ResponseWriter, *http.Request, *log.Logger), method, target string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target+"?"+form.Encode(), nil)
+		r.AddCookie(cookie)
+		cfg.auth(admin, lg, func(w http.ResponseWriter, r *http.Request) { h(w, r, lg) })(w, r)
+		return w
+	}
+
+	var as []*analysis
+	//callback参数不再返回jsonp，也不允许跨域读取
+	w = call(false, cfg.AnalysisOfCounts, "GET", "/a/counts", url.Values{"year": {"2017"}, "month": {"02"}, "callback": {"alert(1)//"}})
+	if err = json.Unmarshal(w.Body.Bytes(), &as); err != nil {
+		t.Fatalf("counts: %s: %s", err, w.Body)
+	}
+	h := w.Header()
+	if h.Get("Access-Control-Allow-Origin") != "" || h.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		t.Errorf("counts headers = %v", h)
+	}
+	var codes []string
+	for _, a := range as {
+		codes = append(codes, a.Code)
+	}
+	sort.Strings(codes)
+	if strings.Join(codes, ",") != "531,532" {
+		t.Errorf("counts returned %v", codes)
+	}
+
+	//没有权限和不存在的路由器都返回空的结果
+	var reads = []struct {
+		code, mac string
+		want      int
+	}{
+		{"531", "aa:bb:cc:00:00:01", 1},
+		{"028", "aa:bb:cc:00:00:02", 0},
+		{"999", "aa:bb:cc:00:00:03", 0},
+	}
+	for _, c := range reads {
+		var cs Clients
+		w = call(false, cfg.AnalysisOfRouter, "GET", "/a/router", url.Values{"code": {c.code}, "year": {"2017"}, "month": {"02"}})
+		if err = json.Unmarshal(w.Body.Bytes(), &cs); err != nil || len(cs.Data) != c.want {
+			t.Errorf("router %s: %d clients, %v, want %d", c.code, len(cs.Data), err, c.want)
+		}
+		var ds []*Data
+		w = call(false, cfg.AnalysisOfClient, "GET", "/a/client",
+			url.Values{"code": {c.code}, "mac": {c.mac}, "year": {"2017"}, "month": {"02"}})
+		if err = json.Unmarshal(w.Body.Bytes(), &ds); err != nil || len(ds) != c.want {
+			t.Errorf("client on %s: %d records, %v, want %d", c.code, len(ds), err, c.want)
+		}
+	}
+
+	var rs []*Router
+	w = call(true, cfg.GetRouters, "GET", "/admin/r/g", nil)
+	if err = json.Unmarshal(w.Body.Bytes(), &rs); err != nil || len(rs) != 1 || rs[0].Code != "531" {
+		t.Errorf("routers: %d, %v: %s", len(rs), err, w.Body)
+	}
+
+	//采集记录的数量不包括没有权限的028
+	var runs []*Run
+	w = call(false, cfg.ListRuns, "GET", "/a/runs", nil)
+	if err = json.Unmarshal(w.Body.Bytes(), &runs); err != nil || len(runs) != 1 {
+		t.Fatalf("runs: %v: %s", err, w.Body)
+	}
+	if run := runs[0]; run.Total != 2 || run.Succeeded != 1 || run.Failed != 1 {
+		t.Errorf("run = %+v, want 2 routers", run)
+	}
+
+	var updates = []struct {
+		code, area string
+		status     int
+	}{
+		{"531", "华东", http.StatusOK},
+		{"532", "华东", http.StatusForbidden},
+		//codes中的路由器移到其他区域后仍然可以管理
+		{"531", "西南", http.StatusOK},
+		{"028", "华东", http.StatusForbidden},
+	}
+	for _, u := range updates {
+		w = call(true, cfg.UpdateRouter, "POST", "/admin/r/u", url.Values{"code": {u.code}, "area": {u.area}})
+		if w.Code != u.status {
+			t.Errorf("update %s to %s got %d, want %d", u.code, u.area, w.Code, u.status)
+		}
+	}
+	if r, _ := s.SelectRouter("028"); r.Area != "西南" {
+		t.Errorf("router 028 moved to %s", r.Area)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+//一个路由器在一次采集中的结果，status为ok、gateway、failed或skipped
+type RouterRun struct {
+	RunID    int64  `json:"run_id"`
+	Code     string `json:"code"`
+	Wanip    string `json:"wanip"`
+	Gateway  string `json:"gateway"`
+	Fallback bool   `json:"fallback"`
+	Status   string `json:"status"`
+	Error    string `json:"error"`
+	Clients  int    `json:"clients"`
+	Start    string `json:"started_at"`
+	Duration int64  `json:"duration_ms"`
+}
+
+//aruba_get的一次采集
+type Run struct {
+	ID        int64        `json:"id"`
+	Mode      string       `json:"mode"`
+	Start     string       `json:"started_at"`
+	End       string       `json:"finished_at"`
+	Total     int          `json:"total"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Fallback  int          `json:"fallback"`
+	Skipped   int          `json:"skipped"`
+	Duration  int64        `json:"duration_ms"`
+	Routers   []*RouterRun `json:"routers,omitempty"`
+}
+
+const runColumns = `id, mode, started_at, finished_at, total, succeeded, failed, fallback, skipped, duration_ms`
+
+func scanRun(row interface {
+	Scan(dest ...interface{}) error
+}) (*Run, error) {
+	var run = new(Run)
+	err := row.Scan(&run.ID, &run.Mode, &run.Start, &run.End, &run.Total,
+		&run.Succeeded, &run.Failed, &run.Fallback, &run.Skipped, &run.Duration)
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+//按时间倒序列出采集记录，不包含每个路由器的结果
+func (s *sqlStore) SelectRuns(limit, offset int) ([]*Run, error) {
+	rows, err := s.db.Query(`select `+runColumns+` from collection_runs
+	order by id desc limit ? offset ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs = make([]*Run, 0)
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+//一次采集及其中每个路由器的结果
+func (s *sqlStore) SelectRun(id int64) (*Run, error) {
+	run, err := scanRun(s.db.QueryRow(`select `+runColumns+` from collection_runs where id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`select `+routerRunColumns+` from collection_run_routers
+	where run_id = ? order by code`, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Routers, err = scanRouterRuns(rows); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+//id在from和to之间的采集中每个路由器的结果，用于按权限重新统计一页采集记录
+func (s *sqlStore) SelectRunsRouters(from, to int64) ([]*RouterRun, error) {
+	rows, err := s.db.Query(`select `+routerRunColumns+` from collection_run_routers
+	where run_id between ? and ?`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanRouterRuns(rows)
+}
+
+//只统计readable中的路由器，与aruba_get保存汇总时的规则相同
+func (run *Run) recount(rrs []*RouterRun, readable map[string]bool) {
+	run.Total, run.Succeeded, run.Failed, run.Fallback, run.Skipped = 0, 0, 0, 0, 0
+	for _, rr := range rrs {
+		if rr.RunID != run.ID || !readable[rr.Code] {
+			continue
+		}
+		run.Total++
+		switch rr.Status {
+		case "ok":
+			run.Succeeded++
+		case "gateway":
+			run.Succeeded++
+			run.Fallback++
+		case "skipped":
+			run.Skipped++
+		default:
+			run.Failed++
+		}
+	}
+}
+
+//路由器code最近limit次采集的结果
+func (s *sqlStore) SelectRouterRuns(code string, limit int) ([]*RouterRun, error) {
+	rows, err := s.db.Query(`select `+routerRunColumns+` from collection_run_routers
+	where code = ? order by started_at desc limit ?`, strings.ToUpper(code), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanRouterRuns(rows)
+}
+
+const routerRunColumns = `run_id, code, wanip, gateway, fallback, status, error_text, clients, started_at, duration_ms`
+
+func scanRouterRuns(rows *sql.Rows) ([]*RouterRun, error) {
+	defer rows.Close()
+	var rrs = make([]*RouterRun, 0)
+	for rows.Next() {
+		var (
+			rr  = new(RouterRun)
+			msg sql.NullString
+		)
+		err := rows.Scan(&rr.RunID, &rr.Code, &rr.Wanip, &rr.Gateway, &rr.Fallback, &rr.Status,
+			&msg, &rr.Clients, &rr.Start, &rr.Duration)
+		if err != nil {
+			return nil, err
+		}
+		rr.Error = msg.String
+		rrs = append(rrs, rr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
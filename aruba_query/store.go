@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+)
+
+//存储接口：路由器、客户端记录和用户，mysql和sqlite3各有一个实现
+type Store interface {
+	UpdateRouter(r *Router) error
+	UpdateRouterSP(r *Router) error
+	DeleteRouter(r *Router) error
+	SelectRouter(code string) (*Router, error)
+	SelectRouters() ([]*Router, error)
+
+	//f为nil时返回全部客户端
+	SelectClientsByTime(code, begin, end string, f *ClientFilter) ([]*Data, error)
+	//每个路由器的客户端记录数，f.MAC不使用
+	CountClientsByTime(begin, end string, f *ClientFilter) (map[string]int, error)
+
+	//aruba_get的采集记录
+	SelectRuns(limit, offset int) ([]*Run, error)
+	SelectRun(id int64) (*Run, error)
+	SelectRouterRuns(code string, limit int) ([]*RouterRun, error)
+	SelectRunsRouters(from, to int64) ([]*RouterRun, error)
+
+	//数据库版本
+	LatestVersion() int
+	SchemaVersion() (int, error)
+	MigrateUp() ([]Migration, error)
+	MigrateDown() (*Migration, error)
+	MigrationStatus() (map[int]string, error)
+	Migrations() []Migration
+
+	InsertUser(user *UserPassword) error
+	DeleteUser(username string) error
+	UpdateUser(user *UserPassword) error
+	SelectUser(username string) (*UserPassword, error)
+
+	//登录会话
+	InsertSession(sess *Session) error
+	SelectSession(id string) (*Session, error)
+	DeleteSession(id string) error
+	DeleteUserSessions(user string) error
+	DeleteExpiredSessions(before string) error
+
+	//API token
+	InsertToken(t *APIToken) error
+	SelectTokenByHash(hash string) (*APIToken, error)
+	SelectTokens(user string) ([]*APIToken, error)
+	DeleteToken(id, user string) (*APIToken, error)
+	DeleteUserTokens(user string) error
+	TouchToken(id, at string) error
+
+	//路由器和用户的修改记录
+	InsertAudit(e *AuditEntry) error
+	SelectAudit(f *AuditFilter) ([]*AuditEntry, error)
+
+	Ping() error
+	Close() error
+}
+
+//根据driver打开对应的存储，driver为空时使用mysql
+func OpenStore(d *DBConfig) (Store, error) {
+	switch d.Driver {
+	case "", "mysql":
+		return OpenMysql(d.Host, d.Port, d.User, d.Password, d.DB)
+	case "sqlite3":
+		return OpenSqlite(d.Path)
+	}
+	return nil, fmt.Errorf("unsupported database driver: %s", d.Driver)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//token的权限，read用于/a/和/me，admin用于/admin/，都不超过用户自己的权限
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+const (
+	//token的前缀，便于识别泄露到日志和代码中的token
+	tokenPrefix = "aq_"
+	//token的最长有效期(天)
+	maxTokenDays = 3650
+)
+
+//脚本使用的API token，只保存token的sha256，ID用于日志和吊销
+//Source为local时每次请求读取users表，为ldap时查询ldap中用户当前的组(缓存role_cache秒)
+type APIToken struct {
+	ID       string `json:"id"`
+	User     string `json:"user"`
+	Name     string `json:"name"`
+	Scopes   string `json:"scopes"`
+	Source   string `json:"source"`
+	Created  string `json:"created_at"`
+	Expires  string `json:"expires_at"`
+	LastUsed string `json:"last_used_at"`
+	hash     string
+	role     string
+}
+
+const tokenColumns = `id, user, name, hash, scopes, source, role, created_at, expires_at, last_used_at`
+
+func (s *sqlStore) InsertToken(t *APIToken) error {
+	var expires interface{}
+	if t.Expires != "" {
+		expires = t.Expires
+	}
+	_, err := s.db.Exec(`insert into api_tokens (id, user, name, hash, scopes, source, role, created_at, expires_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?)`, t.ID, t.User, t.Name, t.hash, t.Scopes, t.Source, t.role, t.Created, expires)
+	return err
+}
+
+func scanToken(row interface {
+	Scan(dest ...interface{}) error
+}) (*APIToken, error) {
+	var (
+		t                 = new(APIToken)
+		expires, lastUsed sql.NullString
+	)
+	if err := row.Scan(&t.ID, &t.User, &t.Name, &t.hash, &t.Scopes, &t.Source, &t.role, &t.Created,
+		&expires, &lastUsed); err != nil {
+		return nil, err
+	}
+	t.Expires, t.LastUsed = expires.String, lastUsed.String
+	return t, nil
+}
+
+func (s *sqlStore) SelectTokenByHash(hash string) (*APIToken, error) {
+	return scanToken(s.db.QueryRow(`select `+tokenColumns+` from api_tokens where hash = ?`, hash))
+}
+
+//user为空时返回所有用户的token
+func (s *sqlStore) SelectTokens(user string) ([]*APIToken, error) {
+	query, args := `select `+tokenColumns+` from api_tokens`, []interface{}{}
+	if user != "" {
+		query += ` where user = ?`
+		args = append(args, user)
+	}
+	rows, err := s.db.Query(query+` order by created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ts = make([]*APIToken, 0)
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+//吊销token并返回被吊销的token，user不为空时只能吊销该用户的token，没有找到时返回sql.ErrNoRows
+func (s *sqlStore) DeleteToken(id, user string) (*APIToken, error) {
+	t, err := scanToken(s.db.QueryRow(`select `+tokenColumns+` from api_tokens where id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	if user != "" && t.User != user {
+		return nil, sql.ErrNoRows
+	}
+	if _, err = s.db.Exec(`delete from api_tokens where id = ?`, id); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//删除users表中用户的所有token，删除用户时使用
+func (s *sqlStore) DeleteUserTokens(user string) error {
+	_, err := s.db.Exec(`delete from api_tokens where user = ? and source = ?`, user, SourceLocal)
+	return err
+}
+
+//记录最后使用的时间
+func (s *sqlStore) TouchToken(id, at string) error {
+	_, err := s.db.Exec(`update api_tokens set last_used_at = ? where id = ?`, at, id)
+	return err
+}
+
+//检查逗号分隔的scopes，为空时为read，按read、admin的顺序返回
+func parseScopes(s string) (string, error) {
+	var set = make(map[string]bool)
+	for _, sc := range splitRoles(s) {
+		if sc != ScopeRead && sc != ScopeAdmin {
+			return "", fmt.Errorf("invalid scope %q, should be read or admin", sc)
+		}
+		set[sc] = true
+	}
+	if len(set) == 0 {
+		return ScopeRead, nil
+	}
+	var scopes []string
+	for _, sc := range []string{ScopeRead, ScopeAdmin} {
+		if set[sc] {
+			scopes = append(scopes, sc)
+		}
+	}
+	return strings.Join(scopes, ","), nil
+}
+
+//为a的用户创建token，scopes不能超过用户的权限；days为0时不过期，返回的token只有这一次可以看到
+func (cfg *Config) createToken(a *Access, name, scopes string, days int) (string, *APIToken, error) {
+	scopes, err := parseScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.Contains(scopes, ScopeAdmin) && !a.IsAdmin() {
+		return "", nil, fmt.Errorf("user %s can not create token with admin scope", a.User)
+	}
+	if days < 0 || days > maxTokenDays {
+		return "", nil, fmt.Errorf("days must be between 0 and %d", maxTokenDays)
+	}
+	if len(name) > 100 {
+		return "", nil, fmt.Errorf("token name is too long")
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	t := &APIToken{
+		ID:      hex.EncodeToString(b),
+		User:    a.User,
+		Name:    name,
+		Scopes:  scopes,
+		Source:  a.Source,
+		Created: now.Format(timeFormat),
+	}
+	//ldap用户创建时的角色只作为记录，使用token时重新查询
+	if a.Source == SourceLDAP {
+		t.role = strings.Join(a.Roles, ",")
+	}
+	if days > 0 {
+		t.Expires = now.AddDate(0, 0, days).Format(timeFormat)
+	}
+	token := tokenPrefix + t.ID + "_" + secret
+	t.hash = hashToken(token)
+	if err = cfg.store.InsertToken(t); err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+//Authorization: Bearer头中的token
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+//根据token查找用户的权限，token不存在、过期或者用户被删除时返回errNoSession
+func (cfg *Config) tokenAccess(token string) (*Access, error) {
+	t, err := cfg.store.SelectTokenByHash(hashToken(token))
+	if err == sql.ErrNoRows {
+		return nil, errNoSession
+	} else if err != nil {
+		return nil, err
+	}
+	if t.Expires != "" && t.Expires < time.Now().Format(timeFormat) {
+		return nil, errNoSession
+	}
+	var a *Access
+	if t.Source == SourceLDAP {
+		//每次使用时按用户当前所属的组确定角色，不再使用ldap的用户没有权限
+		if cfg.LDAP == nil {
+			return nil, errNoSession
+		}
+		roles, err := cfg.LDAP.Roles(t.User)
+		if err == errLDAPNoRole {
+			return nil, errNoSession
+		} else if err != nil {
+			return nil, err
+		}
+		a = cfg.newAccess(t.User, SourceLDAP, roles)
+	} else {
+		u, err := cfg.store.SelectUser(t.User)
+		if err == sql.ErrNoRows {
+			return nil, errNoSession
+		} else if err != nil {
+			return nil, err
+		}
+		a = cfg.userAccess(u)
+	}
+	a.restrict(t.ID, t.Scopes)
+	return a, nil
+}
+
+//带token的请求由auth检查，来源ip不需要在whitelist中
+func tokenPath(path string) bool {
+	return path == "/me" || strings.HasPrefix(path, "/a/") || strings.HasPrefix(path, "/admin/")
+}
+
+//列出当前用户的token，只能使用登录会话
+func (cfg *Config) ListTokens(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	a := requestAccess(r)
+	if a.Token != "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "login required")
+		return
+	}
+	ts, err := cfg.store.SelectTokens(a.User)
+	if err != nil {
+		lg.Printf("select tokens of %s error: %s\n", a.User, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err = writeJSON(w, ts); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+type newAPIToken struct {
+	*APIToken
+	Token string `json:"token"`
+}
+
+//POST name、scopes和days创建token，返回的token只显示一次
+func (cfg *Config) CreateToken(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a := requestAccess(r)
+	if a.Token != "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "login required")
+		return
+	}
+	days, err := intValue(r, "days", 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	token, t, err := cfg.createToken(a, r.FormValue("name"), r.FormValue("scopes"), days)
+	if err != nil {
+		lg.Printf("[Error] client %s: create token for %s: %s\n", cfg.remoteAddr(r), a.User, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	lg.Printf("client %s: user %s created token %s, scopes: %s\n", cfg.remoteAddr(r), a.User, t.ID, t.Scopes)
+	cfg.audit(r, lg, ObjectToken, t.ID, ActionCreate, tokenChanges(nil, t))
+	if err = writeJSON(w, &newAPIToken{APIToken: t, Token: token}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//POST id吊销当前用户的token
+func (cfg *Config) RevokeToken(w http.ResponseWriter, r *http.Request, lg *log.Logger) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a := requestAccess(r)
+	if a.Token != "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "login required")
+		return
+	}
+	id := r.FormValue("id")
+	t, err := cfg.store.DeleteToken(id, a.User)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "token %s not found", id)
+		return
+	} else if err != nil {
+		lg.Printf("delete token %s error: %s\n", id, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	lg.Printf("client %s: user %s revoked token %s\n", cfg.remoteAddr(r), a.User, id)
+	cfg.audit(r, lg, ObjectToken, t.ID, ActionDelete, tokenChanges(t, nil))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//-tokenadd、-tokens和-tokendel，-tokenadd只能为users表中的用户创建token
+func (cfg *Config) RunTokenCmd(add, list, del, name, scopes string, days int, out io.Writer) error {
+	switch {
+	case add != "":
+		u, err := selectUser(cfg.store, add)
+		if err != nil {
+			return err
+		}
+		token, t, err := cfg.createToken(cfg.userAccess(u), name, scopes, days)
+		if err != nil {
+			return err
+		}
+		if err = cliAudit(cfg.store, ObjectToken, t.ID, ActionCreate, tokenChanges(nil, t)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "token %s created for %s, scopes: %s, expires: %s\n", t.ID, t.User, t.Scopes, orNever(t.Expires))
+		fmt.Fprintf(out, "%s\n", token)
+	case list != "":
+		//*列出所有用户的token
+		if list == "*" {
+			list = ""
+		}
+		ts, err := cfg.store.SelectTokens(list)
+		if err != nil {
+			return err
+		}
+		for _, t := range ts {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Source, t.Scopes, orNever(t.Expires), t.LastUsed, t.Name)
+		}
+	case del != "":
+		t, err := cfg.store.DeleteToken(del, "")
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("token %s not found", del)
+		} else if err != nil {
+			return err
+		}
+		if err = cliAudit(cfg.store, ObjectToken, t.ID, ActionDelete, tokenChanges(t, nil)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "token %s revoked\n", del)
+	}
+	return nil
+}
+
+//token的修改记录，创建时before为nil，吊销时after为nil
+func tokenChanges(before, after *APIToken) map[string]*Change {
+	var cs = make(map[string]*Change)
+	t := after
+	if t == nil {
+		t = before
+	}
+	for field, v := range map[string]string{"user": t.User, "name": t.Name, "scopes": t.Scopes, "expires_at": orNever(t.Expires)} {
+		if after != nil {
+			cs[field] = &Change{After: v}
+		} else {
+			cs[field] = &Change{Before: v}
+		}
+	}
+	return cs
+}
+
+func orNever(expires string) string {
+	if expires == "" {
+		return "never"
+	}
+	return expires
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSqlite(filepath.Join(dir, "aruba.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.db.Exec(`insert into routers (code, name, area) values ('531', 'jinan', '华东')`); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*UserPassword{{User: "root", Admin: true}, {User: "script"}} {
+		if u.Password, err = HashPassword("password"); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//请求经过可信的代理，日志中记录代理转发的客户端地址
+	cfg := &Config{store: s, TrustedProxies: []string{"10.0.0.2"}}
+	if err = cfg.ParseProxies(); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	lg := log.New(&logs, "", 0)
+
+	//whitelist为空，只有带token的接口请求可以访问
+	srv := &Server{ServeMux: http.NewServeMux(), Logger: lg, Proxies: cfg.proxies}
+	srv.HandleFunc("/a/counts", cfg.auth(false, lg, func(w http.ResponseWriter, r *http.Request) {}))
+	srv.HandleFunc("/admin/r/g", cfg.auth(true, lg, func(w http.ResponseWriter, r *http.Request) {
+		cfg.GetRouters(w, r, lg)
+	}))
+	srv.HandleFunc("/tokens/new", cfg.auth(false, lg, func(w http.ResponseWriter, r *http.Request) {
+		cfg.CreateToken(w, r, lg)
+	}))
+	get := func(method, path, token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = "10.0.0.2:40000"
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, r)
+		return w.Code
+	}
+	add := func(user, scopes string, days int) (string, string) {
+		var out bytes.Buffer
+		if err := cfg.RunTokenCmd(user, "", "", "ticketing", scopes, days, &out); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		return strings.Fields(lines[0])[1], lines[1]
+	}
+
+	readID, read := add("root", "read", 30)
+	adminID, admin := add("root", "read,admin", 0)
+	if err = cfg.RunTokenCmd("script", "", "", "", "admin", 0, ioutil.Discard); err == nil {
+		t.Error("admin scope token created for viewer")
+	}
+	var cases = []struct {
+		name, path, token string
+		status            int
+	}{
+		{"no token", "/a/counts", "", http.StatusForbidden},
+		{"wrong token", "/a/counts", "aq_0000_wrong", http.StatusUnauthorized},
+		{"read", "/a/counts", read, http.StatusOK},
+		{"read on admin", "/admin/r/g", read, http.StatusForbidden},
+		{"admin", "/admin/r/g", admin, http.StatusOK},
+		//token不能用来创建token
+		{"create token", "/tokens/new", admin, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if code := get("POST", c.path, c.token); code != c.status {
+			t.Errorf("%s: got %d, want %d", c.name, code, c.status)
+		}
+	}
+	if !strings.Contains(logs.String(), "client 198.51.100.7: token "+readID+" of user root") {
+		t.Errorf("token use not logged:\n%s", logs.String())
+	}
+
+	var out bytes.Buffer
+	if err = cfg.RunTokenCmd("", "root", "", "", "", 0, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), read) || !strings.Contains(out.String(), readID) {
+		t.Errorf("tokens listed as:\n%s", out.String())
+	}
+	if ts, _ := s.SelectTokens("root"); len(ts) != 2 || ts[0].LastUsed == "" {
+		t.Errorf("tokens of root: %+v", ts)
+	}
+
+	//吊销和过期的token不能使用
+	if err = cfg.RunTokenCmd("", "", adminID, "", "", 0, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("GET", "/admin/r/g", admin); code != http.StatusUnauthorized {
+		t.Errorf("revoked token got %d", code)
+	}
+	if _, err = s.db.Exec(`update api_tokens set expires_at = '2017-01-01 00:00:00' where id = ?`, readID); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("GET", "/a/counts", read); code != http.StatusUnauthorized {
+		t.Errorf("expired token got %d", code)
+	}
+	//删除用户时删除用户的token
+	_, script := add("script", "", 0)
+	if err = RunUserCmd(s, "", "", "script", "", false, "", nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("GET", "/a/counts", script); code != http.StatusUnauthorized {
+		t.Errorf("token of deleted user got %d", code)
+	}
+}
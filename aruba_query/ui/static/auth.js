@@ -0,0 +1,22 @@
+//未登录时跳转到登录页面，显示当前用户和退出
+$(document).ajaxError(function(event, xhr) {
+    if (xhr.status == 401) {
+        location.href = "login.html";
+    }
+});
+
+$(document).ready(function() {
+    $.getJSON("me", function(data) {
+        $("#logout").text("退出(" + data.user + ")");
+        if (!data.admin) {
+            $("#adminNav").hide();
+            $("#auditNav").hide();
+        }
+    });
+    $("#logout").click(function() {
+        $.post("logout").always(function() {
+            location.href = "login.html";
+        });
+        return false;
+    });
+});
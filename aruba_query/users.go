@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+//密码的最小长度
+const minPasswordLen = 8
+
+//-useradd、-passwd、-userdel和-usermod，每次只执行一个，密码从终端读取
+//roles为已检查过的逗号分隔的角色
+func RunUserCmd(s Store, add, passwd, del, mod string, admin bool, roles string, in *os.File, out io.Writer) error {
+	switch {
+	case add != "":
+		if strings.TrimSpace(add) != add || len(add) > 100 || strings.ContainsAny(add, " \t") {
+			return fmt.Errorf("invalid user name %q", add)
+		}
+		if _, err := s.SelectUser(add); err == nil {
+			return fmt.Errorf("user %s already exists", add)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		hash, err := readNewPassword(in, out)
+		if err != nil {
+			return err
+		}
+		u := &UserPassword{User: add, Password: hash, Admin: admin, Roles: roles}
+		if err = s.InsertUser(u); err != nil {
+			return err
+		}
+		if err = cliAudit(s, ObjectUser, add, ActionCreate, userChanges(nil, u)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "user %s added, admin: %v, roles: %s\n", add, admin, roles)
+	case passwd != "":
+		u, err := selectUser(s, passwd)
+		if err != nil {
+			return err
+		}
+		before := *u
+		if u.Password, err = readNewPassword(in, out); err != nil {
+			return err
+		}
+		if err = s.UpdateUser(u); err != nil {
+			return err
+		}
+		if err = cliAudit(s, ObjectUser, u.User, ActionUpdate, userChanges(&before, u)); err != nil {
+			return err
+		}
+		//已登录的会话需要使用新密码重新登录
+		if err = s.DeleteUserSessions(u.User); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "password of %s changed\n", u.User)
+	case del != "":
+		u, err := selectUser(s, del)
+		if err != nil {
+			return err
+		}
+		if err = s.DeleteUser(u.User); err != nil {
+			return err
+		}
+		if err = s.DeleteUserSessions(u.User); err != nil {
+			return err
+		}
+		if err = s.DeleteUserTokens(u.User); err != nil {
+			return err
+		}
+		if err = cliAudit(s, ObjectUser, u.User, ActionDelete, userChanges(u, nil)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "user %s deleted\n", u.User)
+	case mod != "":
+		u, err := selectUser(s, mod)
+		if err != nil {
+			return err
+		}
+		//每次请求都读取users表，不需要删除已有的会话
+		before := *u
+		u.Admin, u.Roles = admin, roles
+		if err = s.UpdateUser(u); err != nil {
+			return err
+		}
+		if err = cliAudit(s, ObjectUser, u.User, ActionUpdate, userChanges(&before, u)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "user %s modified, admin: %v, roles: %s\n", u.User, admin, roles)
+	}
+	return nil
+}
+
+func selectUser(s Store, user string) (*UserPassword, error) {
+	u, err := s.SelectUser(user)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user %s not found", user)
+	}
+	return u, err
+}
+
+//读取两次密码，返回bcrypt的结果；in不是终端时读取一行，用于脚本
+func readNewPassword(in *os.File, out io.Writer) (string, error) {
+	var password string
+	if fd := int(in.Fd()); term.IsTerminal(fd) {
+		var confirm []byte
+		fmt.Fprint(out, "New password: ")
+		b, err := term.ReadPassword(fd)
+		if err == nil {
+			fmt.Fprint(out, "\nRetype new password: ")
+			confirm, err = term.ReadPassword(fd)
+		}
+		fmt.Fprintln(out)
+		if err != nil {
+			return "", err
+		}
+		if string(b) != string(confirm) {
+			return "", errors.New("passwords do not match")
+		}
+		password = string(b)
+	} else {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if len(password) < minPasswordLen {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	}
+	return HashPassword(password)
+}